@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MasterSwitchResult is returned by the admin API when a master switch has
+// been requested.
+type MasterSwitchResult struct {
+	System    string `json:"system"`
+	Initiated bool   `json:"initiated"`
+	Master    string `json:"master,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Planned   bool   `json:"planned,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// MasterSwitchRequest is the (optional) JSON body of a master switch request.
+type MasterSwitchRequest struct {
+	Server  string `json:"server"`
+	Planned bool   `json:"planned"`
+}
+
+// RequestMasterSwitch validates the given system name and target server and
+// initiates a master switch on the dispatcher thread. Planned switches hand
+// over the master role while the current master is still available. Returns
+// the result and the HTTP status code to use for the response. The requester
+// is recorded in the failover history.
+func (s *ServerState) RequestMasterSwitch(system string, target string, planned bool, requester string) (*MasterSwitchResult, int) {
+	res := &MasterSwitchResult{System: system, Target: target, Planned: planned}
+	fs := s.failovers[system]
+	if fs == nil {
+		res.Error = fmt.Sprintf("Master switch not possible for unknown system: '%s'", system)
+		return res, http.StatusNotFound
+	}
+	servers := StringList(fs.redis.instances.Servers())
+	if target != "" && !servers.Include(target) {
+		res.Error = fmt.Sprintf("Target server '%s' is not configured for system '%s'", target, system)
+		return res, http.StatusBadRequest
+	}
+	var info *RedisServerInfo
+	s.Evaluate(func() {
+		info = fs.redis
+	})
+	// probe the redis servers on the request's go routine, so that the
+	// dispatcher does not have to wait for them
+	probe := info.Probe()
+	var err error
+	s.Evaluate(func() {
+		if fs.redis == info {
+			fs.redis.Apply(probe)
+		}
+		details := "regular switch"
+		if planned {
+			details = "planned switch"
+		}
+		fs.RecordEvent(HistoryEvent{Event: EVENT_SWITCH_REQUESTED, NewMaster: target, Requester: requester, Details: details})
+		if planned {
+			err = fs.StartPlannedSwitch(target)
+			res.Initiated = err == nil
+			if fs.plannedTarget != nil {
+				res.Target = fs.plannedTarget.server
+			}
+		} else {
+			res.Initiated = fs.InitiateMasterSwitch(target)
+		}
+		if fs.currentMaster != nil {
+			res.Master = fs.currentMaster.server
+		}
+	})
+	if err != nil {
+		res.Error = fmt.Sprintf("Planned master switch not possible: %s", err)
+		return res, http.StatusConflict
+	}
+	if res.Initiated {
+		res.Message = "Master switch initiated"
+		return res, http.StatusCreated
+	}
+	res.Message = "No master switch necessary"
+	return res, http.StatusOK
+}
+
+// AdminTokenRequired checks whether admin requests need to be authenticated.
+func (s *ServerState) AdminTokenRequired() bool {
+	return s.GetConfig().AdminToken != ""
+}
+
+// AuthorizeAdminRequest checks the bearer token sent in the Authorization header
+// (or the token posted by the forms of the HTML status page) against the
+// configured admin token. Tokens in the query string are ignored, as URLs end
+// up in logs. All requests are authorized if no token has been configured.
+func (s *ServerState) AuthorizeAdminRequest(r *http.Request) bool {
+	expected := s.GetConfig().AdminToken
+	if expected == "" {
+		return true
+	}
+	token := r.PostFormValue("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// serveAdminAPI handles requests to /api/. Currently supported:
+//
+//	POST /api/systems/{name}/switch
+//	POST /api/systems/{name}/fence
+//	POST /api/clients/{id}/approve
+//	POST /api/clients/{id}/retire
+//	POST /api/clients/retire_unseen
+func (s *ServerState) serveAdminAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "systems" && (parts[2] == "switch" || parts[2] == "fence"):
+	case len(parts) == 3 && parts[0] == "clients" && (parts[2] == "approve" || parts[2] == "retire"):
+	case len(parts) == 2 && parts[0] == "clients" && parts[1] == "retire_unseen":
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !s.AuthorizeAdminRequest(r) {
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "unauthorized"})
+		return
+	}
+	if parts[0] == "clients" {
+		s.serveClientRegistrationAPI(w, r, parts[1:])
+		return
+	}
+	if parts[2] == "fence" {
+		res, code := s.RequestFencing(parts[1], "admin API: "+r.RemoteAddr)
+		logInfo("admin API: fencing for system '%s' requested by %s: %s%s", parts[1], r.RemoteAddr, res.Message, res.Error)
+		writeJSON(w, code, res)
+		return
+	}
+	var req MasterSwitchRequest
+	if r.ContentLength != 0 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("could not parse request: %s", err)})
+			return
+		}
+	} else {
+		req.Server = r.FormValue("server")
+		req.Planned, _ = strconv.ParseBool(r.FormValue("planned"))
+	}
+	res, code := s.RequestMasterSwitch(parts[1], req.Server, req.Planned, "admin API: "+r.RemoteAddr)
+	logInfo("admin API: master switch for system '%s' requested by %s: %s%s", parts[1], r.RemoteAddr, res.Message, res.Error)
+	writeJSON(w, code, res)
+}
+
+// serveClientRegistrationAPI approves or retires clients. The system to
+// approve a client for and the number of days for retiring unseen clients are
+// passed as form values.
+func (s *ServerState) serveClientRegistrationAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	var res *ClientRegistrationResult
+	var code int
+	requester := "admin API: " + r.RemoteAddr
+	if len(parts) == 1 {
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "missing or invalid parameter: days"})
+			return
+		}
+		res, code = s.RequestClientRegistration(parts[0], "", "", days, requester)
+	} else {
+		res, code = s.RequestClientRegistration(parts[1], parts[0], r.FormValue("system"), 0, requester)
+	}
+	logInfo("admin API: %s for clients requested by %s: %s%s", strings.Join(parts, " "), r.RemoteAddr, res.Message, res.Error)
+	writeJSON(w, code, res)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAdminTestServer(token string) *ServerState {
+	o := serverTestOptions
+	config := *o.Config
+	config.AdminToken = token
+	o.Config = &config
+	return NewServerState(o)
+}
+
+func TestAdminAPIRequiresPost(t *testing.T) {
+	s := newAdminTestServer("")
+	w := httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/api/systems/beetle/switch", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/initiate_master_switch?system_name=beetle", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for HTML master switch, got %d", w.Code)
+	}
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	s := newAdminTestServer("sesame")
+	w := httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("POST", "/api/systems/beetle/switch", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/api/systems/beetle/switch", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for wrong token, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("POST", "/api/systems/beetle/switch?token=sesame", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for token in query string, got %d", w.Code)
+	}
+	r = httptest.NewRequest("POST", "/api/systems/unknown/switch", strings.NewReader("token=sesame"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for posted token, got %d: %s", w.Code, w.Body.String())
+	}
+	r = httptest.NewRequest("POST", "/api/systems/unknown/switch", nil)
+	r.Header.Set("Authorization", "Bearer sesame")
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, r)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "unknown system") {
+		t.Errorf("expected status 404 for unknown system, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminAPIRejectsUnknownTarget(t *testing.T) {
+	s := newAdminTestServer("")
+	r := httptest.NewRequest("POST", "/api/systems/beetle/switch", strings.NewReader(`{"server":"127.0.0.1:9999"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.dispatchRequest(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for unknown target, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPlannedSwitchRefusedWhileSwitchInProgress(t *testing.T) {
+	s := newAdminTestServer("")
+	fs := s.failovers["beetle"]
+	fs.PauseWatcher()
+	if err := fs.StartPlannedSwitch(""); err == nil {
+		t.Errorf("planned switch should be refused while another switch is in progress")
+	}
+	if fs.PlannedSwitchInProgress() {
+		t.Errorf("refused planned switch should not be in progress")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// WebSocketScheme returns the URL scheme to use for websocket connections to
+// the configuration server.
+func (c *Config) WebSocketScheme() string {
+	if c.ServerTLS {
+		return "wss"
+	}
+	return "ws"
+}
+
+// HTTPScheme returns the URL scheme to use for HTTP requests to the
+// configuration server.
+func (c *Config) HTTPScheme() string {
+	if c.ServerTLS {
+		return "https"
+	}
+	return "http"
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file '%s': %s", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file '%s'", path)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the TLS configuration for the configuration server
+// or nil, if TLS has not been enabled. If a CA file has been configured,
+// clients have to present a certificate signed by that CA.
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	if !c.ServerTLS {
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("TLS needs a certificate and a key file")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %s", err)
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.TLSCAFile != "" {
+		pool, err := loadCertPool(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// ClientTLSConfig returns the TLS configuration used by clients and the
+// mailer to contact the configuration server or nil, if TLS has not been
+// enabled. A client certificate is only sent if one has been configured.
+func (c *Config) ClientTLSConfig() (*tls.Config, error) {
+	if !c.ServerTLS {
+		return nil, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSCAFile != "" {
+		pool, err := loadCertPool(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if c.TLSCertFile != "" && c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS client certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+func (m *MsgBody) computeMac(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fields := []string{m.System, m.Name, m.Id, m.Token, m.Server}
+	if m.Planned {
+		fields = append(fields, "planned")
+	}
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign computes a HMAC over the message fields using the given shared secret.
+// Does nothing if the secret is empty.
+func (m *MsgBody) Sign(secret string) {
+	if secret == "" {
+		return
+	}
+	m.Mac = m.computeMac(secret)
+}
+
+// Authentic checks the message HMAC against the given shared secret. All
+// messages are considered authentic if the secret is empty.
+func (m *MsgBody) Authentic(secret string) bool {
+	if secret == "" {
+		return true
+	}
+	return hmac.Equal([]byte(m.Mac), []byte(m.computeMac(secret)))
+}
+
+// CertificateMatchesId checks whether a client certificate has been issued for
+// the given client id, either as common name or as subject alternative name.
+func CertificateMatchesId(cert *x509.Certificate, id string) bool {
+	if cert.Subject.CommonName == id {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if name == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestSigningMessages(t *testing.T) {
+	msg := MsgBody{System: "primary", Name: PONG, Id: "c1", Token: "42"}
+	msg.Sign("secret")
+	if msg.Mac == "" {
+		t.Errorf("signing did not set a mac")
+	}
+	if !msg.Authentic("secret") {
+		t.Errorf("signed message should be authentic")
+	}
+	if msg.Authentic("other") {
+		t.Errorf("message should not be authentic for a different secret")
+	}
+	forged := msg
+	forged.Id = "c2"
+	if forged.Authentic("secret") {
+		t.Errorf("message with modified id should not be authentic")
+	}
+	unsigned := MsgBody{Name: HEARTBEAT, Id: "c1"}
+	if !unsigned.Authentic("") {
+		t.Errorf("messages should be authentic when no secret has been configured")
+	}
+	if unsigned.Authentic("secret") {
+		t.Errorf("unsigned messages should not be authentic when a secret has been configured")
+	}
+}
+
+func TestCertificateMatchesId(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "c1"}, DNSNames: []string{"c1.example.com"}}
+	if !CertificateMatchesId(cert, "c1") {
+		t.Errorf("certificate should match its common name")
+	}
+	if !CertificateMatchesId(cert, "c1.example.com") {
+		t.Errorf("certificate should match its subject alternative names")
+	}
+	if CertificateMatchesId(cert, "c2") {
+		t.Errorf("certificate should not match other ids")
+	}
+}
+
+func TestSigningCoversPlannedFlag(t *testing.T) {
+	msg := MsgBody{System: "primary", Name: INVALIDATE, Token: "42"}
+	msg.Sign("secret")
+	msg.Planned = true
+	if msg.Authentic("secret") {
+		t.Errorf("message with modified planned flag should not be authentic")
+	}
+}
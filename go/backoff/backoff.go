@@ -0,0 +1,103 @@
+// Package backoff computes delays between reconnect attempts, growing
+// exponentially up to a cap, with random jitter so that many processes
+// restarting at the same time do not retry in lockstep.
+package backoff
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults used when the corresponding Backoff field is zero.
+const (
+	DefaultMin        = 1 * time.Second
+	DefaultMax        = 60 * time.Second
+	DefaultFactor     = 2.0
+	DefaultJitter     = 0.5
+	DefaultResetAfter = 60 * time.Second
+)
+
+// Backoff holds the policy and the number of consecutive failed attempts. The
+// zero value uses the defaults.
+type Backoff struct {
+	Min        time.Duration // Delay after the first failure.
+	Max        time.Duration // Upper bound for the delay.
+	Factor     float64       // Growth factor per consecutive failure.
+	Jitter     float64       // Fraction of the delay which is randomized (0 to 1).
+	ResetAfter time.Duration // Attempts lasting at least this long count as stable and reset the backoff.
+	attempts   int
+}
+
+// New creates a backoff with the given bounds, using the default growth
+// factor, jitter and reset period.
+func New(min, max, resetAfter time.Duration) *Backoff {
+	return &Backoff{Min: min, Max: max, ResetAfter: resetAfter}
+}
+
+var (
+	rnd      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	rndMutex sync.Mutex
+)
+
+func random() float64 {
+	rndMutex.Lock()
+	defer rndMutex.Unlock()
+	return rnd.Float64()
+}
+
+// Next returns the delay before the next attempt and counts the failure. The
+// delay is chosen randomly from [d*(1-Jitter), d], where d grows from Min by
+// Factor with each consecutive failure, but never exceeds Max.
+func (b *Backoff) Next() time.Duration {
+	min, max, factor, jitter := b.Min, b.Max, b.Factor, b.Jitter
+	if min <= 0 {
+		min = DefaultMin
+	}
+	if max <= 0 {
+		max = DefaultMax
+	}
+	if max < min {
+		max = min
+	}
+	if factor < 1 {
+		factor = DefaultFactor
+	}
+	if jitter <= 0 || jitter > 1 {
+		jitter = DefaultJitter
+	}
+	d := float64(min)
+	for i := 0; i < b.attempts && d < float64(max); i++ {
+		d *= factor
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	b.attempts++
+	return time.Duration(d * (1 - jitter*random()))
+}
+
+// Failed returns the delay before the next attempt, given that the failed
+// attempt was started at the given time. If the attempt lasted at least
+// ResetAfter, for example a connection which was stable for a while before it
+// broke, the backoff starts over.
+func (b *Backoff) Failed(started time.Time) time.Duration {
+	resetAfter := b.ResetAfter
+	if resetAfter <= 0 {
+		resetAfter = DefaultResetAfter
+	}
+	if time.Since(started) >= resetAfter {
+		b.Reset()
+	}
+	return b.Next()
+}
+
+// Reset starts over with the minimal delay.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// Attempts returns the number of consecutive failures.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
@@ -0,0 +1,55 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextGrowsUpToMax(t *testing.T) {
+	b := &Backoff{Min: time.Second, Max: 10 * time.Second, Jitter: 0.5}
+	bounds := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, upper := range bounds {
+		upper *= time.Second
+		d := b.Next()
+		if d > upper || d < upper/2 {
+			t.Errorf("attempt %d: expected delay between %s and %s, got %s", i, upper/2, upper, d)
+		}
+	}
+	if b.Attempts() != len(bounds) {
+		t.Errorf("expected %d attempts, got %d", len(bounds), b.Attempts())
+	}
+}
+
+func TestNextIsJittered(t *testing.T) {
+	b := New(time.Second, time.Second, time.Minute)
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		seen[b.Next()] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected different delays, got %v", seen)
+	}
+}
+
+func TestFailedResetsAfterStableAttempt(t *testing.T) {
+	b := New(time.Second, time.Minute, time.Minute)
+	for i := 0; i < 5; i++ {
+		b.Failed(time.Now())
+	}
+	if b.Attempts() != 5 {
+		t.Errorf("expected 5 attempts, got %d", b.Attempts())
+	}
+	if d := b.Failed(time.Now().Add(-2 * time.Minute)); d > time.Second {
+		t.Errorf("expected minimal delay after a stable attempt, got %s", d)
+	}
+	if b.Attempts() != 1 {
+		t.Errorf("expected 1 attempt after reset, got %d", b.Attempts())
+	}
+}
+
+func TestZeroValueUsesDefaults(t *testing.T) {
+	var b Backoff
+	if d := b.Next(); d > DefaultMin || d < DefaultMin/2 {
+		t.Errorf("expected delay between %s and %s, got %s", DefaultMin/2, DefaultMin, d)
+	}
+}
@@ -22,12 +22,12 @@ var opts struct {
 	Verbose                  bool          `short:"v" long:"verbose" description:"Be verbose."`
 	Daemonize                bool          `short:"d" long:"daemonize" description:"Run as a daemon. Use with --log-file."`
 	Id                       string        `long:"id" env:"HOST" description:"Set unique client id."`
-	ClientIds                string        `long:"client-ids" description:"Clients that have to acknowledge on master switch (e.g. client-id1,client-id2)."`
+	ClientIds                string        `long:"client-ids" description:"Clients that have to acknowledge on master switch (e.g. client-id1,client-id2). Can be given per system (e.g. primary/c1,c2;secondary/c3). Systems without ids of their own need default ids or an explicit empty list (e.g. secondary/)."`
 	ClientTimeout            int           `long:"client-timeout" description:"Number of seconds to wait until considering a client dead (or unreachable). Defaults to 10."`
 	ClientHeartbeatInterval  int           `long:"client-heartbeat-interval" description:"Number of seconds between client heartbeats. Defaults to 5."`
 	ConfigFile               string        `long:"config-file" description:"Config file path."`
 	RedisServers             string        `long:"redis-servers" description:"List of redis failover sets (separated by semicolon or newlines). Each set consists of comma separated host:port pairs, preceded by a system name and a slash. Example: primary/a1:4,a2:5;secondary/b1:3,b2:3"`
-	RedisMasterFile          string        `long:"redis-master-file" description:"Path of redis master file."`
+	RedisMasterFile          string        `long:"redis-master-file" description:"Path of redis master file. Its directory must be writable, as the file is replaced atomically."`
 	RedisMasterRetries       int           `long:"redis-master-retries" description:"How often to retry checking the availability of the current master before initiating a switch. Defaults to 3."`
 	RedisMasterRetryInterval int           `long:"redis-master-retry-interval" description:"Number of seconds to wait between master checks. Defaults to 10."`
 	PidFile                  string        `long:"pid-file" description:"Write process id into given path."`
@@ -44,11 +44,61 @@ var opts struct {
 	MailFrom                 string        `long:"mail-from" description:"From address to be used for email notifications."`
 	MailRelay                string        `long:"mail-relay" description:"SMTP mail relay to be used for sending notifications."`
 	DialTimeout              int           `long:"dial-timeout" description:"Number of seconds to wait until a connection attempt to the master times out. Defaults to 5."`
-	ConfidenceLevel          string        `long:"redis-failover-confidence-level" description:"A number between 0 and 100, defining the percent of clients which have to agree in an election process. Values are clamped to the interval [0,100]. Defaults to 100."`
+	ConfidenceLevel          string        `long:"redis-failover-confidence-level" description:"A number between 0 and 100, defining the percent of clients which have to agree in an election process. Values are clamped to the interval [0,100]. Can be given per system (e.g. primary/50;secondary/100). Defaults to 100."`
 	DeleteBefore             time.Duration `long:"delete-before" description:"Delete keys which do expire before the given time."`
 	CopyAfter                time.Duration `long:"copy-after" description:"Copy keys which do expire after the given time."`
 	TargetRedis              string        `long:"target-redis" description:"Specifies the target server for the copy_keys command (host:port)."`
 	QueuePrefix              string        `long:"queue-prefix" description:"Specifies the queue prefix for matching keys to be deleted/copied."`
+	ServerTLS                bool          `long:"tls" description:"Use TLS (wss/https) for connections between configuration server, clients and mailer."`
+	TLSCertFile              string        `long:"tls-cert" description:"Certificate file. Server certificate for the configuration server, client certificate (mutual TLS) for clients."`
+	TLSKeyFile               string        `long:"tls-key" description:"Private key file belonging to --tls-cert."`
+	TLSCAFile                string        `long:"tls-ca" description:"CA file. Used by clients to verify the server. If given to the server, clients must present a certificate issued for their id."`
+	SharedSecret             string        `long:"secret" env:"BEETLE_CONFIGURATION_SECRET" description:"Shared secret used to sign messages exchanged between configuration server and clients."`
+	AdminToken               string        `long:"admin-token" env:"BEETLE_ADMIN_TOKEN" description:"Bearer token required for requests to the admin API of the configuration server."`
+	PlannedSwitchTimeout     int           `long:"redis-planned-switch-timeout" description:"Number of seconds to wait for the target of a planned master switch to catch up with the current master. Defaults to 30."`
+	ReplicaMaxLinkDown       int           `long:"redis-replica-max-link-down" description:"Number of seconds a slave may have lost contact with its master before the master became unavailable and still be considered for promotion. Defaults to 300."`
+	SentinelPort             int           `long:"sentinel-port" description:"Port on which to answer redis sentinel queries for current masters. Disabled by default."`
+	HistoryFile              string        `long:"history-file" description:"Append failover history events to this file. If not given, the history is stored in a list on the redis master of each system."`
+	StateStore               string        `long:"state-store" description:"Where to persist server state: redis (default) or consul."`
+	LeaderElection           string        `long:"leader-election" description:"Elect a leader among several configuration servers using consul or a lock file (consul|file). File based election is only meant for tests."`
+	LeaderLockFile           string        `long:"leader-lock-file" description:"Lock file used for file based leader election."`
+	LeaderTTL                int           `long:"leader-ttl" description:"Seconds after which the leadership of an unresponsive server expires."`
+	AdvertiseAddress         string        `long:"advertise-address" description:"Address (host:port) followers redirect clients to when this server is the leader. Defaults to hostname and port."`
+	RedisUsername            string        `long:"redis-username" env:"BEETLE_REDIS_USERNAME" description:"Username for authenticating with redis servers (redis 6 ACLs)."`
+	RedisPassword            string        `long:"redis-password" env:"BEETLE_REDIS_PASSWORD" description:"Password for authenticating with redis servers."`
+	RedisPasswordFile        string        `long:"redis-password-file" description:"Read the password for authenticating with redis servers from this file."`
+	RedisTLS                 bool          `long:"redis-tls" description:"Use TLS for redis connections."`
+	RedisTLSCAFile           string        `long:"redis-tls-ca" description:"CA certificate file used to verify redis servers."`
+	RedisTLSCertFile         string        `long:"redis-tls-cert" description:"Client certificate file for redis TLS connections."`
+	RedisTLSKeyFile          string        `long:"redis-tls-key" description:"Client key file for redis TLS connections."`
+	ConfirmFencing           bool          `long:"fencing-requires-confirmation" description:"Do not demote rogue redis masters automatically, wait for an operator to confirm instead."`
+	ReconnectBackoffMin      int           `long:"reconnect-backoff-min" description:"Number of seconds to wait before reconnecting after the first failure. Defaults to 1."`
+	ReconnectBackoffMax      int           `long:"reconnect-backoff-max" description:"Maximum number of seconds to wait between reconnect attempts. Defaults to 60."`
+	ReconnectBackoffReset    int           `long:"reconnect-backoff-reset" description:"Number of seconds a connection must be stable to reset the reconnect delay. Defaults to 60."`
+	ClientHealthAddress      string        `long:"health-address" description:"Address (host:port) on which the configuration client serves its health status. Disabled by default. Example: 127.0.0.1:9651"`
+	RedisMasterFilePrevious  bool          `long:"redis-master-file-keep-previous" description:"Keep a copy of the previous content of the redis master file in <file>.previous."`
+	RedisMasterFileHook      string        `long:"redis-master-file-hook" description:"Shell command to run whenever the content of the redis master file changes. The path of the file is passed in BEETLE_REDIS_MASTER_FILE."`
+	RedisMasterFilePidFile   string        `long:"redis-master-file-pid-file" description:"Pid file of a process to signal whenever the content of the redis master file changes."`
+	RedisMasterFileSignal    string        `long:"redis-master-file-signal" description:"Signal to send to the process given by --redis-master-file-pid-file (HUP, USR1, USR2, INT or TERM). Defaults to HUP."`
+	RedisMasterFileFormat    string        `long:"redis-master-file-format" description:"Format of the redis master file: text, json or yaml. The structured formats include tokens, change times and states. Defaults to text."`
+	ClientRetirementDays     int           `long:"client-retirement-days" description:"Retire configured clients which have not been seen for the given number of days. Disabled by default."`
+	NotificationWebhooks     string        `long:"notification-webhooks" description:"YAML or JSON list of webhooks to which the notification mailer forwards notifications. Each webhook needs a url and may set name, format (json, slack, mattermost or template), template, headers, include, exclude, retries and retry_delay."`
+	NotificationFormat       string        `long:"notification-format" description:"Format of notifications sent to listeners which do not request one: text (default, understood by all notification listeners) or json."`
+	MailMinSeverity          string        `long:"mail-min-severity" description:"Only mail notifications of at least the given severity: info, warning, error or critical."`
+	MailNotificationTypes    string        `long:"mail-notification-types" description:"Comma separated list of notification types to mail. Mails all types by default."`
+	MailDedupWindow          int           `long:"mail-dedup-window" description:"Suppress mails for notifications identical to one mailed within the given number of seconds. Use -1 to disable."`
+	MailRateLimit            int           `long:"mail-rate-limit" description:"Maximum number of mails per hour for each notification type. Disabled by default."`
+	MailDigestInterval       int           `long:"mail-digest-interval" description:"Collect non-critical notifications and mail them as a digest every given number of seconds. Disabled by default."`
+	MailRelayUsername        string        `long:"mail-relay-username" description:"Username for SMTP authentication. Authentication is disabled without a username."`
+	MailRelayPassword        string        `long:"mail-relay-password" description:"Password for SMTP authentication. Use env:NAME or file:PATH to read it from the environment or a file."`
+	MailRelayAuth            string        `long:"mail-relay-auth" description:"SMTP authentication mechanism: plain, login or cram-md5. Defaults to plain."`
+	MailRelayTLS             string        `long:"mail-relay-tls" description:"TLS mode for the mail relay: starttls (required), tls (implicit TLS, usually port 465) or none. By default STARTTLS is used if the relay offers it."`
+	MailRelayTLSCAFile       string        `long:"mail-relay-tls-ca" description:"CA certificate file for verifying the mail relay."`
+	MailHTML                 bool          `long:"mail-html" description:"Send notification mails with an additional HTML part including a status snapshot of the affected system."`
+	MailSpoolDir             string        `long:"mail-spool-dir" description:"Directory in which the notification mailer keeps notifications it could not mail yet, so that they survive restarts. They are retried until the mail relay accepts them. The directory must be writable, otherwise they are only kept in memory. Defaults to beetle-mail-spool in the temporary directory."`
+	MailSpoolMaxAge          int           `long:"mail-spool-max-age" description:"Number of seconds after which spooled notifications are dropped. Defaults to one day."`
+	MailerHealthAddress      string        `long:"mailer-health-address" description:"Address (host:port) on which the notification mailer serves its health status, including the size of its spool. Disabled by default."`
+	NotificationBufferSize   int           `long:"notification-buffer-size" description:"Number of recent notifications kept for replay to listeners resuming after a reconnect."`
 }
 
 // Verbose stores verbosity or logging purposoes.
@@ -68,6 +118,7 @@ func (x *CmdRunClient) Execute(args []string) error {
 		Id:           opts.Id,
 		Config:       initialConfig,
 		ConsulClient: getConsulClient(),
+		ConfigSource: configSource(),
 	})
 }
 
@@ -97,6 +148,21 @@ func (x *CmdRunMailer) Execute(args []string) error {
 	})
 }
 
+// CmdRunForwarder is used when the program arguments tell us to run a
+// notification forwarder.
+type CmdRunForwarder struct{}
+
+var cmdRunForwarder CmdRunForwarder
+
+// Execute runs a mailer which only forwards notifications to webhooks.
+func (x *CmdRunForwarder) Execute(args []string) error {
+	return RunNotificationMailer(MailerOptions{
+		Config:       initialConfig,
+		ConsulClient: getConsulClient(),
+		DisableMail:  true,
+	})
+}
+
 // CmdSendMail is used when the program arguments tell us to send a
 // mail to the configured SMTP endpoint.
 type CmdSendMail struct{}
@@ -105,7 +171,7 @@ var cmdSendMail CmdSendMail
 
 // Execute sends a mail.
 func (x *CmdSendMail) Execute(args []string) error {
-	return SendMail(strings.Join(args, " "), MailerOptions{
+	return SendMail(NewTextNotification(strings.Join(args, " ")), MailerOptions{
 		Config:       initialConfig,
 		ConsulClient: getConsulClient(),
 	})
@@ -122,6 +188,17 @@ func (x *CmdPrintConfig) Execute(args []string) error {
 	return nil
 }
 
+// CmdPrintStatus is used when the program arguments tell us to print the
+// status of a running configuration server.
+type CmdPrintStatus struct{}
+
+var cmdPrintStatus CmdPrintStatus
+
+// Execute prints the server status.
+func (x *CmdPrintStatus) Execute(args []string) error {
+	return PrintServerStatus(initialConfig)
+}
+
 // CmdRunGCKeys is used when the program arguments tell us to garbage collect redis keys.
 type CmdRunGCKeys struct{}
 
@@ -298,6 +375,56 @@ func getProgramParameters() *Config {
 		MailFrom:                 opts.MailFrom,
 		MailRelay:                opts.MailRelay,
 		DialTimeout:              opts.DialTimeout,
+		ServerTLS:                opts.ServerTLS,
+		TLSCertFile:              opts.TLSCertFile,
+		TLSKeyFile:               opts.TLSKeyFile,
+		TLSCAFile:                opts.TLSCAFile,
+		SharedSecret:             opts.SharedSecret,
+		AdminToken:               opts.AdminToken,
+		PlannedSwitchTimeout:     opts.PlannedSwitchTimeout,
+		ReplicaMaxLinkDown:       opts.ReplicaMaxLinkDown,
+		SentinelPort:             opts.SentinelPort,
+		HistoryFile:              opts.HistoryFile,
+		StateStore:               opts.StateStore,
+		LeaderElection:           opts.LeaderElection,
+		LeaderLockFile:           opts.LeaderLockFile,
+		LeaderTTL:                opts.LeaderTTL,
+		AdvertiseAddress:         opts.AdvertiseAddress,
+		RedisUsername:            opts.RedisUsername,
+		RedisPassword:            opts.RedisPassword,
+		RedisPasswordFile:        opts.RedisPasswordFile,
+		RedisTLS:                 opts.RedisTLS,
+		RedisTLSCAFile:           opts.RedisTLSCAFile,
+		RedisTLSCertFile:         opts.RedisTLSCertFile,
+		RedisTLSKeyFile:          opts.RedisTLSKeyFile,
+		ConfirmFencing:           opts.ConfirmFencing,
+		ReconnectBackoffMin:      opts.ReconnectBackoffMin,
+		ReconnectBackoffMax:      opts.ReconnectBackoffMax,
+		ReconnectBackoffReset:    opts.ReconnectBackoffReset,
+		ClientHealthAddress:      opts.ClientHealthAddress,
+		RedisMasterFilePrevious:  opts.RedisMasterFilePrevious,
+		RedisMasterFileHook:      opts.RedisMasterFileHook,
+		RedisMasterFilePidFile:   opts.RedisMasterFilePidFile,
+		RedisMasterFileSignal:    opts.RedisMasterFileSignal,
+		RedisMasterFileFormat:    opts.RedisMasterFileFormat,
+		ClientRetirementDays:     opts.ClientRetirementDays,
+		NotificationWebhooks:     opts.NotificationWebhooks,
+		NotificationFormat:       opts.NotificationFormat,
+		MailMinSeverity:          opts.MailMinSeverity,
+		MailNotificationTypes:    opts.MailNotificationTypes,
+		MailDedupWindow:          opts.MailDedupWindow,
+		MailRateLimit:            opts.MailRateLimit,
+		MailDigestInterval:       opts.MailDigestInterval,
+		MailRelayUsername:        opts.MailRelayUsername,
+		MailRelayPassword:        opts.MailRelayPassword,
+		MailRelayAuth:            opts.MailRelayAuth,
+		MailRelayTLS:             opts.MailRelayTLS,
+		MailRelayTLSCAFile:       opts.MailRelayTLSCAFile,
+		MailHTML:                 opts.MailHTML,
+		MailSpoolDir:             opts.MailSpoolDir,
+		MailSpoolMaxAge:          opts.MailSpoolMaxAge,
+		MailerHealthAddress:      opts.MailerHealthAddress,
+		NotificationBufferSize:   opts.NotificationBufferSize,
 	}
 }
 
@@ -348,6 +475,18 @@ var (
 	initialConfig    *Config
 )
 
+// configSource describes where the configuration has been read from.
+func configSource() string {
+	sources := []string{"command line"}
+	if opts.ConfigFile != "" {
+		sources = append(sources, "file "+opts.ConfigFile)
+	}
+	if opts.ConsulUrl != "" {
+		sources = append(sources, "consul "+opts.ConsulUrl)
+	}
+	return strings.Join(sources, ", ")
+}
+
 func setupConfig() error {
 	configFromParams = getProgramParameters()
 	configFromFile = readConfigFile(opts.ConfigFile)
@@ -374,11 +513,13 @@ func main() {
 	parser.AddCommand("configuration_client", "run redis configuration client", "", &cmdRunClient)
 	parser.AddCommand("configuration_server", "run redis configuration server", "", &cmdRunServer)
 	parser.AddCommand("dump", "dump configuration after merging all config sources and exit", "", &cmdPrintConfig)
+	parser.AddCommand("status", "print the status of a running configuration server", "", &cmdPrintStatus)
 	parser.AddCommand("garbage_collect_deduplication_store", "garbage collect keys on redis servers", "", &cmdRunGCKeys)
 	parser.AddCommand("delete_queue_keys", "delete all keys for a given queue prefix on redis servers", "", &cmdRunDeleteKeys)
 	parser.AddCommand("copy_queue_keys", "copy all keys for a given queue prefix from current master to a given redis server", "", &cmdRunCopyKeys)
 	parser.AddCommand("dump_expiries", "print all expiry values from redis master", "", &cmdRunDumpExpiries)
-	parser.AddCommand("notification_mailer", "listen to system notifications and send them via SMTP", "", &cmdRunMailer)
+	parser.AddCommand("notification_mailer", "listen to system notifications and send them via SMTP and the configured webhooks", "", &cmdRunMailer)
+	parser.AddCommand("notification_forwarder", "listen to system notifications and forward them to the configured webhooks", "", &cmdRunForwarder)
 	parser.AddCommand("send_mail", "send a test mail to configured SMTP server", "", &cmdSendMail)
 	parser.CommandHandler = cmdHandler
 
@@ -390,7 +531,7 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	if cmd != &cmdPrintConfig {
+	if cmd != &cmdPrintConfig && cmd != &cmdPrintStatus {
 		redirectStdoutAndStderr(opts.LogFile)
 		if opts.Daemonize {
 			nochdir, noclose := true, false
@@ -412,6 +553,10 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if err = ConfigureRedisConnections(initialConfig); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	logDebug("config has been set up")
 	installSignalHandler()
 	writePidFile(opts.PidFile)
@@ -14,11 +14,13 @@ import (
 )
 
 // ClientOptions consist of the id by which the client identifies itself with
-// the server, the overall configuration and pointer to a ConsulClient.
+// the server, the overall configuration and pointer to a ConsulClient. The
+// config source describes where the configuration has been read from.
 type ClientOptions struct {
 	Id           string
 	Config       *Config
 	ConsulClient *consul.Client
+	ConfigSource string
 }
 
 // RedisSystem holds the switch protocol state for each system name.
@@ -39,6 +41,7 @@ type ClientState struct {
 	readerDone    chan struct{}
 	configChanges chan consul.Env
 	redisSystems  map[string]*RedisSystem
+	health        *ClientHealth
 }
 
 // GetConfig returns the client configuration in a thread safe way.
@@ -67,7 +70,7 @@ func (s *ClientState) SetConfig(config *Config) *Config {
 func (s *ClientState) ServerUrl() string {
 	config := s.GetConfig()
 	addr := fmt.Sprintf("%s:%d", config.Server, config.Port)
-	u := url.URL{Scheme: "ws", Host: addr, Path: "/configuration"}
+	u := url.URL{Scheme: config.WebSocketScheme(), Host: addr, Path: "/configuration"}
 	return u.String()
 }
 
@@ -77,13 +80,19 @@ func (s *ClientState) Connect() (err error) {
 	// copy default dialer to avoid race conditions
 	dialer := *websocket.DefaultDialer
 	dialer.HandshakeTimeout = time.Duration(s.opts.Config.DialTimeout) * time.Second
+	dialer.TLSClientConfig, err = s.GetConfig().ClientTLSConfig()
+	if err != nil {
+		logError("could not set up TLS: %s", err)
+		return
+	}
 	logInfo("connecting to %s, timeout: %s", url, dialer.HandshakeTimeout)
-	s.ws, _, err = dialer.Dial(url, nil)
+	s.ws, err = dialWebSocket(&dialer, url)
 	if err != nil {
 		logError("could not establish web socket connection")
 		return
 	}
 	logInfo("established web socket connection")
+	s.health.Connected(url)
 	return
 }
 
@@ -99,6 +108,7 @@ func (s *ClientState) Close() {
 
 // Send a message to the server.
 func (s *ClientState) send(msg MsgBody) error {
+	msg.Sign(s.GetConfig().SharedSecret)
 	b, err := json.Marshal(msg)
 	if err != nil {
 		logError("could not marshal message: %s", err)
@@ -166,17 +176,16 @@ func (s *RedisSystem) NewMaster(server string) {
 
 // UpdateMasterFile writes the known masters information to the redis master file.
 func (s *ClientState) UpdateMasterFile() {
-	path := s.GetConfig().RedisMasterFile
-	systems := make(map[string]string, 0)
+	config := s.GetConfig()
+	mf := NewMasterFile()
 	for system, rs := range s.redisSystems {
 		if rs.currentMaster == nil {
-			systems[system] = ""
+			mf.Set(system, "", rs.currentToken)
 		} else {
-			systems[system] = rs.currentMaster.server
+			mf.Set(system, rs.currentMaster.server, rs.currentToken)
 		}
 	}
-	content := MarshalMasterFileContent(systems)
-	WriteRedisMasterFile(path, content)
+	WriteMasterFile(config.RedisMasterFile, mf, config)
 }
 
 // DetermineInitialMasters tries to read the current masters from disk
@@ -217,10 +226,11 @@ func (s *ClientState) RegisterSystem(system string) *RedisSystem {
 // Invalidate sets the current master for the given system to nil, removes the
 // corresponding line from the the redis master file and sends a
 // CLIENT_INVALIDATED message to the server, provided the token sent with the
-// message is valid.
+// message is valid. Unless the invalidation is part of a planned master
+// switch, the current master is only invalidated if it is no longer a master.
 func (s *ClientState) Invalidate(msg MsgBody) error {
 	rs := s.RegisterSystem(msg.System)
-	if rs.RedeemToken(msg.Token) && (rs.currentMaster == nil || rs.currentMaster.Role() != MASTER) {
+	if rs.RedeemToken(msg.Token) && (msg.Planned || rs.currentMaster == nil || rs.currentMaster.Role() != MASTER) {
 		rs.currentMaster = nil
 		logInfo("Removing invalidated system '%s' from redis master file", msg.System)
 		s.UpdateMasterFile()
@@ -271,6 +281,10 @@ func (s *ClientState) Reader() {
 			logError("reader: could not parse msg: %s", err)
 			return
 		}
+		if !body.Authentic(s.GetConfig().SharedSecret) {
+			logError("reader: ignoring message with invalid signature: %s", string(bytes))
+			continue
+		}
 		s.input <- body
 	}
 }
@@ -312,6 +326,10 @@ func (s *ClientState) Writer() {
 					logInfo("restarting client because server url has changed: %s", newconfig.ServerUrl())
 					return
 				}
+				if newconfig.ServerTLS != oldconfig.ServerTLS {
+					logInfo("restarting client because server TLS setting has changed: %v", newconfig.ServerTLS)
+					return
+				}
 			}
 		}
 		if err != nil {
@@ -323,6 +341,8 @@ func (s *ClientState) Writer() {
 // Dispatch dispatches matches rceived from the server to appropriate methods.
 func (s *ClientState) Dispatch(msg MsgBody) error {
 	logDebug("dispatcher received: %+v", msg)
+	s.health.MessageReceived(msg.Name)
+	defer s.health.UpdateSystems(s.redisSystems)
 	switch msg.Name {
 	case RECONFIGURE:
 		return s.Reconfigure(msg)
@@ -339,9 +359,11 @@ func (s *ClientState) Dispatch(msg MsgBody) error {
 // Run establishes a websocket connection to the server, starts reader and
 // writer routines and a consul watcher for config changes. It exits when the
 // writer exits.
-func (s *ClientState) Run() error {
+func (s *ClientState) Run() (err error) {
 	s.DetermineInitialMasters()
+	s.health.UpdateSystems(s.redisSystems)
 	defer s.closeRedisConnections()
+	defer func() { s.health.Disconnected(err) }()
 	if err := s.Connect(); err != nil {
 		return err
 	}
@@ -353,6 +375,7 @@ func (s *ClientState) Run() error {
 	}
 	if s.opts.ConsulClient != nil {
 		var err error
+		s.opts.ConsulClient.SetRetryBackoff(s.GetConfig().ReconnectBackoff())
 		s.configChanges, err = s.opts.ConsulClient.WatchConfig()
 		if err != nil {
 			return err
@@ -377,9 +400,16 @@ func (s *ClientState) closeRedisConnections() {
 // INT or a TERM signal.
 func RunConfigurationClient(o ClientOptions) error {
 	logInfo("client started with options: %+v\n", o)
+	retry := o.Config.ReconnectBackoff()
+	health := NewClientHealth(o.Id, o.ConfigSource)
+	if address := o.Config.ClientHealthAddress; address != "" {
+		go RunClientHealthServer(address, health)
+	}
 	for !interrupted {
+		started := time.Now()
 		state := &ClientState{
 			opts:         &o,
+			health:       health,
 			readerDone:   make(chan struct{}, 1),
 			writerDone:   make(chan struct{}, 1),
 			redisSystems: make(map[string]*RedisSystem, 0),
@@ -389,8 +419,9 @@ func RunConfigurationClient(o ClientOptions) error {
 		if err != nil {
 			logError("client exited prematurely: %s", err)
 			if !interrupted {
-				// TODO: exponential backoff with jitter.
-				time.Sleep(1 * time.Second)
+				delay := retry.Failed(started)
+				logInfo("reconnecting in %s", delay)
+				time.Sleep(delay)
 			}
 		}
 	}
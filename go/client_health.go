@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientHealth records what a configuration client believes about the world.
+// It survives reconnects and is served on the local health endpoint, if
+// enabled. All methods are thread safe.
+type ClientHealth struct {
+	mutex           sync.Mutex
+	id              string
+	configSource    string
+	started         time.Time
+	connected       bool
+	connectedSince  time.Time
+	serverUrl       string
+	reconnects      int
+	lastError       string
+	lastMessage     string
+	lastMessageTime time.Time
+	systems         map[string]ClientSystemHealth
+}
+
+// ClientSystemHealth describes the state of a single redis system.
+type ClientSystemHealth struct {
+	Master string `json:"master"`
+	Token  string `json:"token"`
+}
+
+// ClientHealthStatus is the JSON representation of the client health.
+type ClientHealthStatus struct {
+	Id              string                        `json:"id"`
+	Healthy         bool                          `json:"healthy"`
+	BeetleVersion   string                        `json:"beetle_version"`
+	ConfigSource    string                        `json:"config_source"`
+	Uptime          float64                       `json:"uptime_seconds"`
+	Server          string                        `json:"server"`
+	Connected       bool                          `json:"connected"`
+	ConnectedSince  *time.Time                    `json:"connected_since,omitempty"`
+	Reconnects      int                           `json:"reconnects"`
+	LastError       string                        `json:"last_error,omitempty"`
+	LastMessage     string                        `json:"last_message,omitempty"`
+	LastMessageTime *time.Time                    `json:"last_message_time,omitempty"`
+	Systems         map[string]ClientSystemHealth `json:"systems"`
+}
+
+// NewClientHealth creates the health record for the client with the given id.
+func NewClientHealth(id string, configSource string) *ClientHealth {
+	return &ClientHealth{
+		id:           id,
+		configSource: configSource,
+		started:      time.Now(),
+		systems:      make(map[string]ClientSystemHealth),
+	}
+}
+
+// Connected records an established websocket connection.
+func (h *ClientHealth) Connected(serverUrl string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.connected = true
+	h.connectedSince = time.Now()
+	h.serverUrl = serverUrl
+	h.lastError = ""
+}
+
+// Disconnected records the loss of the websocket connection, or a failed
+// connection attempt.
+func (h *ClientHealth) Disconnected(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.connected {
+		h.reconnects++
+	}
+	h.connected = false
+	if err != nil {
+		h.lastError = err.Error()
+	}
+}
+
+// MessageReceived records the name of the last message received from the
+// server.
+func (h *ClientHealth) MessageReceived(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastMessage = name
+	h.lastMessageTime = time.Now()
+}
+
+// UpdateSystems replaces the information on redis systems.
+func (h *ClientHealth) UpdateSystems(systems map[string]*RedisSystem) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.systems = make(map[string]ClientSystemHealth, len(systems))
+	for name, rs := range systems {
+		sh := ClientSystemHealth{Token: rs.currentToken}
+		if rs.currentMaster != nil {
+			sh.Master = rs.currentMaster.server
+		}
+		h.systems[name] = sh
+	}
+}
+
+// Status returns a snapshot of the client health. The client is considered
+// healthy when it is connected to the configuration server.
+func (h *ClientHealth) Status() *ClientHealthStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	status := &ClientHealthStatus{
+		Id:            h.id,
+		Healthy:       h.connected,
+		BeetleVersion: BEETLE_VERSION,
+		ConfigSource:  h.configSource,
+		Uptime:        time.Since(h.started).Seconds(),
+		Server:        h.serverUrl,
+		Connected:     h.connected,
+		Reconnects:    h.reconnects,
+		LastError:     h.lastError,
+		LastMessage:   h.lastMessage,
+		Systems:       make(map[string]ClientSystemHealth, len(h.systems)),
+	}
+	if h.connected {
+		since := h.connectedSince
+		status.ConnectedSince = &since
+	}
+	if !h.lastMessageTime.IsZero() {
+		t := h.lastMessageTime
+		status.LastMessageTime = &t
+	}
+	for name, sh := range h.systems {
+		status.Systems[name] = sh
+	}
+	return status
+}
+
+// ServeHTTP serves the health status as JSON. Responds with 503 if the
+// client is unhealthy, so that health checks can simply look at the status
+// code.
+func (h *ClientHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/health" {
+		http.NotFound(w, r)
+		return
+	}
+	status := h.Status()
+	b, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// RunClientHealthServer serves the health endpoint on the given address. It
+// only returns if the listener cannot be established.
+func RunClientHealthServer(address string, h *ClientHealth) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logError("could not start client health endpoint: %s", err)
+		return
+	}
+	logInfo("serving client health on http://%s/health", l.Addr())
+	if err := http.Serve(l, h); err != nil {
+		logError("client health endpoint failed: %s", err)
+	}
+}
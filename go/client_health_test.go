@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientHealthEndpoint(t *testing.T) {
+	h := NewClientHealth("c1", "command line")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	checkEqual(t, w.Code, http.StatusServiceUnavailable)
+
+	h.Connected("ws://localhost:9650/configuration")
+	h.UpdateSystems(map[string]*RedisSystem{
+		"primary":   {system: "primary", currentMaster: NewRedisShim("127.0.0.1:7001"), currentToken: "3"},
+		"secondary": {system: "secondary"},
+	})
+	h.MessageReceived(RECONFIGURE)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	checkEqual(t, w.Code, http.StatusOK)
+	var status ClientHealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("could not parse health status: %s", err)
+	}
+	checkEqual(t, status.Id, "c1")
+	checkEqual(t, status.Connected, true)
+	checkEqual(t, status.ConfigSource, "command line")
+	checkEqual(t, status.LastMessage, RECONFIGURE)
+	checkEqual(t, status.Systems["primary"], ClientSystemHealth{Master: "127.0.0.1:7001", Token: "3"})
+	checkEqual(t, status.Systems["secondary"], ClientSystemHealth{})
+
+	h.Disconnected(fmt.Errorf("connection reset"))
+	status = *h.Status()
+	checkEqual(t, status.Healthy, false)
+	checkEqual(t, status.Reconnects, 1)
+	checkEqual(t, status.LastError, "connection reset")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	checkEqual(t, w.Code, http.StatusNotFound)
+}
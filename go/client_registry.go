@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ALL_SYSTEMS is the key under which clients approved for all systems are
+// persisted.
+const ALL_SYSTEMS = "*"
+
+var validClientId = regexp.MustCompile(`^[A-Za-z0-9._:@-]+$`)
+
+// applyClientRegistrations adds the clients approved by operators to the
+// configured client ids and removes retired clients. Clients approved for
+// all systems take part in the elections of all systems without own client
+// ids.
+func (s *ServerState) applyClientRegistrations() {
+	for id := range s.approvedClientIds[ALL_SYSTEMS] {
+		s.defaultClientIds.Add(id)
+	}
+	for system, ids := range s.approvedClientIds {
+		if system == ALL_SYSTEMS {
+			continue
+		}
+		set, ok := s.systemClientIds[system]
+		if !ok {
+			set = make(StringSet)
+			for id := range s.defaultClientIds {
+				set.Add(id)
+			}
+			s.systemClientIds[system] = set
+		}
+		for id := range ids {
+			set.Add(id)
+		}
+	}
+	for id := range s.retiredClientIds {
+		delete(s.defaultClientIds, id)
+		for _, set := range s.systemClientIds {
+			delete(set, id)
+		}
+	}
+}
+
+// restoreClientRegistrations takes over approvals and retirements from the
+// persisted state.
+func (s *ServerState) restoreClientRegistrations(state *PersistentState) {
+	s.approvedClientIds = make(map[string]StringSet)
+	for system, ids := range state.ApprovedClients {
+		set := make(StringSet)
+		for _, id := range ids {
+			set.Add(id)
+		}
+		s.approvedClientIds[system] = set
+	}
+	s.retiredClientIds = make(StringSet)
+	for _, id := range state.RetiredClients {
+		s.retiredClientIds.Add(id)
+	}
+	s.clientRegistrations = make(TimeSet)
+	for id, t := range state.Registrations {
+		s.clientRegistrations[id] = t
+	}
+	s.updateClientIds()
+}
+
+// clientRegistered remembers when the client was approved or retired, so that
+// the most recent registration wins when merging persisted states.
+func (s *ServerState) clientRegistered(id string) {
+	if s.clientRegistrations == nil {
+		s.clientRegistrations = make(TimeSet)
+	}
+	s.clientRegistrations[id] = time.Now()
+}
+
+// saveClientRegistrations adds approvals and retirements to the given state.
+func (s *ServerState) saveClientRegistrations(state *PersistentState) {
+	for system, ids := range s.approvedClientIds {
+		if len(ids) > 0 {
+			state.ApprovedClients[system] = ids.Keys()
+		}
+	}
+	state.RetiredClients = s.retiredClientIds.Keys()
+	for id, t := range s.clientRegistrations {
+		state.Registrations[id] = t
+	}
+}
+
+// ApproveClient promotes a client to a configured client taking part in
+// elections of the given system, or of all systems without own client ids if
+// no system is given. Retired clients can be approved again.
+func (s *ServerState) ApproveClient(id string, system string, requester string) error {
+	if !validClientId.MatchString(id) {
+		return fmt.Errorf("invalid client id: '%s'", id)
+	}
+	key := system
+	if system == "" {
+		key = ALL_SYSTEMS
+	} else if s.failovers[system] == nil {
+		return fmt.Errorf("unknown system: '%s'", system)
+	}
+	configured := s.defaultClientIds
+	if system != "" {
+		configured = s.failovers[system].ClientIds()
+	}
+	if configured.Include(id) {
+		return fmt.Errorf("client '%s' has already been configured", id)
+	}
+	if s.approvedClientIds == nil {
+		s.approvedClientIds = make(map[string]StringSet)
+	}
+	approved := s.approvedClientIds[key]
+	if approved == nil {
+		approved = make(StringSet)
+		s.approvedClientIds[key] = approved
+	}
+	approved.Add(id)
+	delete(s.retiredClientIds, id)
+	s.clientRegistered(id)
+	s.updateClientIds()
+	msg := fmt.Sprintf("Approved client '%s'", id)
+	if system != "" {
+		msg += fmt.Sprintf(" for system '%s'", system)
+	}
+	s.clientRegistrationChanged(EVENT_CLIENT_APPROVED, id, system, requester, msg)
+	return nil
+}
+
+// RetireClient removes a client from the configured clients of all systems.
+// The last client of a system cannot be retired, as its master would then be
+// switched without a vote.
+func (s *ServerState) RetireClient(id string, requester string, reason string) error {
+	if !s.clientIds.Include(id) {
+		return fmt.Errorf("client '%s' has not been configured", id)
+	}
+	if system := s.lastClientOf(id); system != "" {
+		return fmt.Errorf("client '%s' is the last client of system '%s'", id, system)
+	}
+	for _, ids := range s.approvedClientIds {
+		delete(ids, id)
+	}
+	if s.retiredClientIds == nil {
+		s.retiredClientIds = make(StringSet)
+	}
+	s.retiredClientIds.Add(id)
+	s.clientRegistered(id)
+	s.updateClientIds()
+	msg := fmt.Sprintf("Retired client '%s'", id)
+	if reason != "" {
+		msg += ": " + reason
+	}
+	s.clientRegistrationChanged(EVENT_CLIENT_RETIRED, id, "", requester, msg)
+	return nil
+}
+
+// lastClientOf returns the name of a system for which the given client is the
+// only configured client, or an empty string if there is none.
+func (s *ServerState) lastClientOf(id string) string {
+	for _, system := range s.systemNames {
+		ids := s.failovers[system].ClientIds()
+		if len(ids) == 1 && ids.Include(id) {
+			return system
+		}
+	}
+	return ""
+}
+
+// RetireUnseenClients retires all configured clients which have not been seen
+// for the given number of days. Clients which have never been seen are kept,
+// as we cannot tell for how long they have been gone. The last client of a
+// system is kept as well; operators are notified about it once. Returns the
+// retired client ids.
+func (s *ServerState) RetireUnseenClients(days int, requester string) []string {
+	retired := make([]string, 0)
+	if days <= 0 {
+		return retired
+	}
+	threshold := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	for _, id := range s.clientIds.Keys() {
+		if lastSeen, ok := s.clientsLastSeen[id]; ok && lastSeen.Before(threshold) {
+			if system := s.lastClientOf(id); system != "" {
+				s.keepLastClient(id, system, days)
+				continue
+			}
+			reason := fmt.Sprintf("not seen for more than %d days", days)
+			if err := s.RetireClient(id, requester, reason); err == nil {
+				retired = append(retired, id)
+			}
+		}
+	}
+	return retired
+}
+
+// keepLastClient notifies operators that an unseen client has not been retired
+// as it is the last client of a system. Each client is only reported once.
+func (s *ServerState) keepLastClient(id string, system string, days int) {
+	if s.keptLastClients == nil {
+		s.keptLastClients = make(StringSet)
+	}
+	if s.keptLastClients.Include(id) {
+		return
+	}
+	s.keptLastClients.Add(id)
+	msg := fmt.Sprintf("Not retiring client '%s', which has not been seen for more than %d days: it is the last client of system '%s'", id, days, system)
+	logWarn(msg)
+	s.SendNotification(&Notification{Type: NOTIFICATION_MESSAGE, Severity: SEVERITY_WARNING, System: system, ClientId: id, Text: msg})
+}
+
+func (s *ServerState) clientRegistrationChanged(event string, id string, system string, requester string, msg string) {
+	logInfo("%s (requested by %s)", msg, requester)
+	s.SendNotification(&Notification{Type: event, Severity: SEVERITY_INFO, System: system, ClientId: id, Text: msg})
+	s.history.Record(HistoryEvent{System: system, Event: event, ClientIds: []string{id}, Requester: requester, Details: msg})
+	s.SaveState()
+}
+
+// ApprovedClientIds returns the sorted list of client ids approved by
+// operators.
+func (s *ServerState) ApprovedClientIds() []string {
+	set := make(StringSet)
+	for _, ids := range s.approvedClientIds {
+		for id := range ids {
+			set.Add(id)
+		}
+	}
+	return set.Keys()
+}
+
+// RetiredClientIds returns the sorted list of retired client ids.
+func (s *ServerState) RetiredClientIds() []string {
+	return s.retiredClientIds.Keys()
+}
+
+// ClientRegistrationResult is returned by the admin API when a client has been
+// approved or retired.
+type ClientRegistrationResult struct {
+	ClientIds []string `json:"client_ids"`
+	System    string   `json:"system,omitempty"`
+	Message   string   `json:"message,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// RequestClientRegistration performs the given action ("approve", "retire" or
+// "retire_unseen") on the dispatcher thread. Returns the result and the HTTP
+// status code to use for the response.
+func (s *ServerState) RequestClientRegistration(action string, id string, system string, days int, requester string) (*ClientRegistrationResult, int) {
+	res := &ClientRegistrationResult{ClientIds: []string{}, System: system}
+	var err error
+	s.Evaluate(func() {
+		switch action {
+		case "approve":
+			if err = s.ApproveClient(id, system, requester); err == nil {
+				res.ClientIds = append(res.ClientIds, id)
+			}
+		case "retire":
+			if err = s.RetireClient(id, requester, ""); err == nil {
+				res.ClientIds = append(res.ClientIds, id)
+			}
+		case "retire_unseen":
+			if days <= 0 {
+				err = fmt.Errorf("invalid number of days: %d", days)
+			} else {
+				res.ClientIds = s.RetireUnseenClients(days, requester)
+			}
+		default:
+			err = fmt.Errorf("unknown action: %s", action)
+		}
+	})
+	if err != nil {
+		res.Error = err.Error()
+		return res, http.StatusBadRequest
+	}
+	switch {
+	case action == "approve":
+		res.Message = "Client approved"
+	case len(res.ClientIds) == 0:
+		res.Message = "No clients retired"
+	default:
+		res.Message = "Retired clients: " + strings.Join(res.ClientIds, ", ")
+	}
+	return res, http.StatusOK
+}
+
+func (s *ServerState) changeClientRegistration(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderErrorTemplate(w, 405, "Clients must be approved or retired using POST")
+		return
+	}
+	if !s.AuthorizeAdminRequest(r) {
+		renderErrorTemplate(w, 401, "Invalid admin token")
+		return
+	}
+	id := r.FormValue("client_id")
+	if id == "" {
+		renderErrorTemplate(w, 400, "Missing parameter: client_id")
+		return
+	}
+	res, code := s.RequestClientRegistration(action, id, r.FormValue("system_name"), 0, "status page: "+r.RemoteAddr)
+	if res.Error != "" {
+		renderErrorTemplate(w, code, res.Error)
+	} else {
+		renderErrorTemplate(w, code, res.Message)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xing/beetle/consul"
+)
+
+func newRegistryTestServer(t *testing.T, url string) *ServerState {
+	config := Config{
+		ClientTimeout: 1,
+		RedisServers:  "primary/127.0.0.1:7001,127.0.0.1:7002\nsecondary/127.0.0.1:7003,127.0.0.1:7004",
+		ClientIds:     "c1,c2",
+		StateStore:    "consul",
+	}
+	return NewServerState(ServerOptions{Config: &config, ConsulClient: consul.NewClient(url, "", "beetle")})
+}
+
+func TestApproveAndRetireClients(t *testing.T) {
+	srv := fakeConsulKV(t)
+	defer srv.Close()
+	s := newRegistryTestServer(t, srv.URL)
+	s.AddUnknownClientId("c3")
+	s.AddUnknownClientId("c4")
+
+	checkEqual(t, s.ApproveClient("c3", "", "test"), nil)
+	checkEqual(t, s.ApproveClient("c4", "secondary", "test"), nil)
+	checkEqual(t, s.clientIds.Keys(), []string{"c1", "c2", "c3", "c4"})
+	checkEqual(t, len(s.UnknownClientIds()), 0)
+	primary, secondary := s.failovers["primary"].ClientIds(), s.failovers["secondary"].ClientIds()
+	checkEqual(t, primary.Keys(), []string{"c1", "c2", "c3"})
+	checkEqual(t, secondary.Keys(), []string{"c1", "c2", "c3", "c4"})
+	if err := s.ApproveClient("c3", "", "test"); err == nil {
+		t.Errorf("expected an error when approving a configured client")
+	}
+	if err := s.ApproveClient("c5", "unknown", "test"); err == nil {
+		t.Errorf("expected an error when approving a client for an unknown system")
+	}
+
+	checkEqual(t, s.RetireClient("c1", "test", ""), nil)
+	if err := s.RetireClient("c1", "test", ""); err == nil {
+		t.Errorf("expected an error when retiring an unconfigured client")
+	}
+	checkEqual(t, s.clientIds.Keys(), []string{"c2", "c3", "c4"})
+	checkEqual(t, s.RetiredClientIds(), []string{"c1"})
+	events := s.history.Recent("", 10)
+	checkEqual(t, len(events), 3)
+	checkEqual(t, events[0].Event, EVENT_CLIENT_RETIRED)
+	checkEqual(t, events[2].ClientIds, []string{"c3"})
+
+	// registrations survive a restart
+	s = newRegistryTestServer(t, srv.URL)
+	s.LoadState()
+	checkEqual(t, s.clientIds.Keys(), []string{"c2", "c3", "c4"})
+	checkEqual(t, s.ApprovedClientIds(), []string{"c3", "c4"})
+	checkEqual(t, s.RetiredClientIds(), []string{"c1"})
+}
+
+func TestRetireUnseenClients(t *testing.T) {
+	srv := fakeConsulKV(t)
+	defer srv.Close()
+	s := newRegistryTestServer(t, srv.URL)
+	s.clientsLastSeen["c1"] = time.Now().Add(-3 * 24 * time.Hour)
+	s.ForgetOldLastSeenEntries()
+	checkEqual(t, s.RetireUnseenClients(5, "test"), []string{})
+	checkEqual(t, s.RetireUnseenClients(2, "test"), []string{"c1"})
+	checkEqual(t, s.clientIds.Keys(), []string{"c2"})
+}
+
+func TestLastClientOfASystemIsNotRetired(t *testing.T) {
+	config := Config{
+		ClientTimeout: 1,
+		RedisServers:  "primary/127.0.0.1:7001,127.0.0.1:7002\nsecondary/127.0.0.1:7003,127.0.0.1:7004",
+		ClientIds:     "primary/c1;secondary/c1,c2",
+	}
+	s := NewServerState(ServerOptions{Config: &config})
+	s.clientsLastSeen["c1"] = time.Now().Add(-3 * 24 * time.Hour)
+	if err := s.RetireClient("c1", "test", ""); err == nil {
+		t.Errorf("expected an error when retiring the last client of a system")
+	}
+	checkEqual(t, s.RetireUnseenClients(2, "test"), []string{})
+	checkEqual(t, s.RetireUnseenClients(2, "test"), []string{})
+	primary := s.failovers["primary"].ClientIds()
+	checkEqual(t, primary.Keys(), []string{"c1"})
+	checkEqual(t, len(s.RetiredClientIds()), 0)
+	// operators are told once
+	missed, _ := s.notificationLog.Since(&NotificationCursor{Epoch: s.notificationLog.Epoch()})
+	checkEqual(t, len(missed), 1)
+	checkEqual(t, missed[0].ClientId, "c1")
+	checkEqual(t, missed[0].System, "primary")
+}
+
+func TestAdminAPIClientRegistration(t *testing.T) {
+	s := newAdminTestServer("sesame")
+	for _, path := range []string{"/api/clients/c3/approve", "/api/clients/c1/retire", "/api/clients/retire_unseen"} {
+		w := httptest.NewRecorder()
+		s.dispatchRequest(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401, got %d", path, w.Code)
+		}
+	}
+	r := httptest.NewRequest("POST", "/api/clients/retire_unseen", strings.NewReader("days=x"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer sesame")
+	w := httptest.NewRecorder()
+	s.dispatchRequest(w, r)
+	checkEqual(t, w.Code, http.StatusBadRequest)
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("POST", "/api/clients/c1/promote", nil))
+	checkEqual(t, w.Code, http.StatusNotFound)
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/approve_client?client_id=c3", nil))
+	checkEqual(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+func TestVoteInProgress(t *testing.T) {
+	s := NewServerState(serverTestOptions)
+	checkEqual(t, s.VoteInProgress(), false)
+	s.failovers["beetle"].pinging = true
+	checkEqual(t, s.VoteInProgress(), true)
+}
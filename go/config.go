@@ -1,9 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/xing/beetle/backoff"
 	"github.com/xing/beetle/consul"
 	"gopkg.in/yaml.v2"
 )
@@ -26,6 +32,56 @@ type Config struct {
 	MailRelay                string `yaml:"mail_relay"`
 	DialTimeout              int    `yaml:"dial_timeout"`
 	ConfidenceLevel          string `yaml:"redis_failover_confidence_level"`
+	ServerTLS                bool   `yaml:"redis_configuration_server_tls"`
+	TLSCertFile              string `yaml:"redis_configuration_tls_cert"`
+	TLSKeyFile               string `yaml:"redis_configuration_tls_key"`
+	TLSCAFile                string `yaml:"redis_configuration_tls_ca"`
+	SharedSecret             string `yaml:"redis_configuration_secret"`
+	AdminToken               string `yaml:"redis_configuration_admin_token"`
+	PlannedSwitchTimeout     int    `yaml:"redis_planned_switch_timeout"`
+	ReplicaMaxLinkDown       int    `yaml:"redis_replica_max_link_down"`
+	SentinelPort             int    `yaml:"redis_configuration_sentinel_port"`
+	HistoryFile              string `yaml:"redis_configuration_history_file"`
+	StateStore               string `yaml:"redis_configuration_state_store"`
+	LeaderElection           string `yaml:"redis_configuration_leader_election"`
+	LeaderLockFile           string `yaml:"redis_configuration_leader_lock_file"`
+	LeaderTTL                int    `yaml:"redis_configuration_leader_ttl"`
+	AdvertiseAddress         string `yaml:"redis_configuration_advertise_address"`
+	RedisUsername            string `yaml:"redis_username"`
+	RedisPassword            string `yaml:"redis_password"`
+	RedisPasswordFile        string `yaml:"redis_password_file"`
+	RedisTLS                 bool   `yaml:"redis_tls"`
+	RedisTLSCAFile           string `yaml:"redis_tls_ca"`
+	RedisTLSCertFile         string `yaml:"redis_tls_cert"`
+	RedisTLSKeyFile          string `yaml:"redis_tls_key"`
+	ConfirmFencing           bool   `yaml:"redis_configuration_fencing_requires_confirmation"`
+	ReconnectBackoffMin      int    `yaml:"reconnect_backoff_min"`
+	ReconnectBackoffMax      int    `yaml:"reconnect_backoff_max"`
+	ReconnectBackoffReset    int    `yaml:"reconnect_backoff_reset"`
+	ClientHealthAddress      string `yaml:"redis_configuration_client_health_address"`
+	RedisMasterFilePrevious  bool   `yaml:"redis_master_file_keep_previous"`
+	RedisMasterFileHook      string `yaml:"redis_master_file_hook"`
+	RedisMasterFilePidFile   string `yaml:"redis_master_file_pid_file"`
+	RedisMasterFileSignal    string `yaml:"redis_master_file_signal"`
+	RedisMasterFileFormat    string `yaml:"redis_master_file_format"`
+	ClientRetirementDays     int    `yaml:"redis_configuration_client_retirement_days"`
+	NotificationWebhooks     string `yaml:"notification_webhooks"`
+	NotificationFormat       string `yaml:"notification_format"`
+	MailMinSeverity          string `yaml:"mail_min_severity"`
+	MailNotificationTypes    string `yaml:"mail_notification_types"`
+	MailDedupWindow          int    `yaml:"mail_dedup_window"`
+	MailRateLimit            int    `yaml:"mail_rate_limit"`
+	MailDigestInterval       int    `yaml:"mail_digest_interval"`
+	MailRelayUsername        string `yaml:"mail_relay_username"`
+	MailRelayPassword        string `yaml:"mail_relay_password"`
+	MailRelayAuth            string `yaml:"mail_relay_auth"`
+	MailRelayTLS             string `yaml:"mail_relay_tls"`
+	MailRelayTLSCAFile       string `yaml:"mail_relay_tls_ca"`
+	MailHTML                 bool   `yaml:"mail_html"`
+	MailSpoolDir             string `yaml:"mail_spool_dir"`
+	MailSpoolMaxAge          int    `yaml:"mail_spool_max_age"`
+	MailerHealthAddress      string `yaml:"mailer_health_address"`
+	NotificationBufferSize   int    `yaml:"notification_buffer_size"`
 }
 
 // Clone copies a give config.
@@ -34,28 +90,150 @@ func (c *Config) Clone() *Config {
 	return &d
 }
 
-// String converts a Config into its YAML representation.
+// String converts a Config into its YAML representation. Secrets are masked.
 func (c *Config) String() string {
-	yamlBytes, err := yaml.Marshal(c)
+	d := c.Clone()
+	if d.SharedSecret != "" {
+		d.SharedSecret = "********"
+	}
+	if d.AdminToken != "" {
+		d.AdminToken = "********"
+	}
+	if d.RedisPassword != "" {
+		d.RedisPassword = "********"
+	}
+	if d.MailRelayPassword != "" && !strings.HasPrefix(d.MailRelayPassword, "env:") && !strings.HasPrefix(d.MailRelayPassword, "file:") {
+		d.MailRelayPassword = "********"
+	}
+	d.RedisServers = MaskRedisCredentials(d.RedisServers)
+	yamlBytes, err := yaml.Marshal(d)
 	if err != nil {
 		return err.Error()
 	}
 	return string(yamlBytes)
 }
 
+// ReconnectBackoff creates the backoff policy for reconnect loops.
+func (c *Config) ReconnectBackoff() *backoff.Backoff {
+	return backoff.New(
+		time.Duration(c.ReconnectBackoffMin)*time.Second,
+		time.Duration(c.ReconnectBackoffMax)*time.Second,
+		time.Duration(c.ReconnectBackoffReset)*time.Second)
+}
+
 // ServerUrl constructs a server URL hostname and port.
 func (c *Config) ServerUrl() string {
 	return c.Server + ":" + strconv.Itoa(c.Port)
 }
 
-// Sanitize replaces newlines by commas. Used to support newlines in consul
-// definitions.
+// Sanitize replaces newlines by commas, or by semicolons if client ids are
+// given per system. Used to support newlines in consul definitions.
 func (c *Config) Sanitize() {
 	if strings.Contains(c.ClientIds, "\n") {
-		c.ClientIds = strings.Replace(c.ClientIds, "\n", ",", -1)
+		sep := ","
+		if strings.Contains(c.ClientIds, "/") {
+			sep = ";"
+		}
+		c.ClientIds = strings.Replace(strings.TrimSpace(c.ClientIds), "\n", sep, -1)
 	}
 }
 
+// splitPerSystemSpec splits a spec which is either a single value applying to
+// all systems, or a semicolon (or newline) separated list of values preceded by
+// a system name and a slash, e.g. "primary/c1,c2;secondary/c3". A value
+// without system name in such a list applies to all systems not explicitly
+// mentioned. Returns that default value and the per system values.
+func splitPerSystemSpec(spec string) (string, map[string]string) {
+	def := ""
+	systems := make(map[string]string)
+	for _, part := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			kv := strings.SplitN(part, "/", 2)
+			systems[kv[0]] = kv[1]
+		} else {
+			def = part
+		}
+	}
+	return def, systems
+}
+
+// SystemClientIds parses the client ids option. Returns the ids taking part in
+// elections of systems without own client ids, and the ids per system.
+func (c *Config) SystemClientIds() (StringSet, map[string]StringSet) {
+	def, systems := splitPerSystemSpec(c.ClientIds)
+	res := make(map[string]StringSet, len(systems))
+	for system, ids := range systems {
+		res[system] = parseClientIds(ids)
+	}
+	return parseClientIds(def), res
+}
+
+// CheckClientIds verifies that client ids given per system refer to
+// configured systems, and that no configured system is left without clients
+// by accident: if client ids are given per system and there are no default
+// ids, every system must be listed. Systems are run without voting only if
+// listed with an empty list of ids, e.g. "primary/c1,c2;secondary/".
+func (c *Config) CheckClientIds() error {
+	def, systems := splitPerSystemSpec(c.ClientIds)
+	if len(systems) == 0 {
+		return nil
+	}
+	sets := c.FailoverSets()
+	names := sets.SystemNames()
+	for system := range systems {
+		if !names.Include(system) {
+			return fmt.Errorf("client ids given for unknown system '%s'", system)
+		}
+	}
+	if len(parseClientIds(def)) > 0 {
+		return nil
+	}
+	for _, system := range names {
+		if _, ok := systems[system]; !ok {
+			return fmt.Errorf("no client ids given for system '%s' (use '%s/' to switch its master without a vote)", system, system)
+		}
+	}
+	return nil
+}
+
+func parseClientIds(ids string) StringSet {
+	set := make(StringSet)
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			set.Add(id)
+		}
+	}
+	return set
+}
+
+// SystemConfidenceLevels parses the confidence level option. Returns the
+// level for systems without own confidence level, and the levels per system.
+// Levels are normalized to the interval [0,1.0].
+func (c *Config) SystemConfidenceLevels() (float64, map[string]float64) {
+	def, systems := splitPerSystemSpec(c.ConfidenceLevel)
+	res := make(map[string]float64, len(systems))
+	for system, level := range systems {
+		res[system] = parseConfidenceLevel(level)
+	}
+	return parseConfidenceLevel(def), res
+}
+
+func parseConfidenceLevel(s string) float64 {
+	level, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		level = 100
+	} else if level < 0 {
+		level = 0
+	} else if level > 100 {
+		level = 100
+	}
+	return float64(level) / 100.0
+}
+
 type FailoverSet struct {
 	name string
 	spec string
@@ -71,6 +249,8 @@ func (fs *FailoverSets) SystemNames() StringList {
 	return res
 }
 
+var systemNameRegexp = regexp.MustCompile(`^[\w.-]+$`)
+
 // FailoverSets parses the redis server spec and returns a list of pairs of system
 // names and comma separated strings of redis server specs (host:port pairs). Examples:
 // "a1:5,a2:5" ==> {"system": "a1:5,a2:5" } "primary/a1:5,a2:5\nsecondary/b1:3,b2:3" ==>
@@ -81,8 +261,9 @@ func (c *Config) FailoverSets() FailoverSets {
 		if line == "" {
 			continue
 		}
-		if strings.Contains(line, "/") {
-			parts := strings.SplitN(line, "/", 2)
+		// the spec of a set without system name may contain a slash as well
+		// (user:file:/path/to/secret@host:port)
+		if parts := strings.SplitN(line, "/", 2); len(parts) == 2 && systemNameRegexp.MatchString(parts[0]) {
 			fs = append(fs, FailoverSet{name: parts[0], spec: parts[1]})
 			continue
 		}
@@ -136,6 +317,42 @@ func (c *Config) SetDefaults() *Config {
 	if c.ConfidenceLevel == "" {
 		c.ConfidenceLevel = "100"
 	}
+	if c.PlannedSwitchTimeout == 0 {
+		c.PlannedSwitchTimeout = 30
+	}
+	if c.ReplicaMaxLinkDown == 0 {
+		c.ReplicaMaxLinkDown = 300
+	}
+	if c.LeaderTTL == 0 {
+		c.LeaderTTL = 15
+	}
+	if c.ReconnectBackoffMin == 0 {
+		c.ReconnectBackoffMin = 1
+	}
+	if c.ReconnectBackoffMax == 0 {
+		c.ReconnectBackoffMax = 60
+	}
+	if c.ReconnectBackoffReset == 0 {
+		c.ReconnectBackoffReset = 60
+	}
+	if c.RedisMasterFileSignal == "" {
+		c.RedisMasterFileSignal = "HUP"
+	}
+	if c.NotificationFormat == "" {
+		c.NotificationFormat = NOTIFICATION_FORMAT_TEXT
+	}
+	if c.MailDedupWindow == 0 {
+		c.MailDedupWindow = 300
+	}
+	if c.MailSpoolDir == "" {
+		c.MailSpoolDir = filepath.Join(os.TempDir(), "beetle-mail-spool")
+	}
+	if c.MailSpoolMaxAge == 0 {
+		c.MailSpoolMaxAge = 86400
+	}
+	if c.NotificationBufferSize == 0 {
+		c.NotificationBufferSize = 1000
+	}
 	c.Sanitize()
 	return c
 }
@@ -193,6 +410,156 @@ func (c *Config) Merge(d *Config) *Config {
 	if c.ConfidenceLevel == "" {
 		c.ConfidenceLevel = d.ConfidenceLevel
 	}
+	if !c.ServerTLS {
+		c.ServerTLS = d.ServerTLS
+	}
+	if c.TLSCertFile == "" {
+		c.TLSCertFile = d.TLSCertFile
+	}
+	if c.TLSKeyFile == "" {
+		c.TLSKeyFile = d.TLSKeyFile
+	}
+	if c.TLSCAFile == "" {
+		c.TLSCAFile = d.TLSCAFile
+	}
+	if c.SharedSecret == "" {
+		c.SharedSecret = d.SharedSecret
+	}
+	if c.AdminToken == "" {
+		c.AdminToken = d.AdminToken
+	}
+	if c.PlannedSwitchTimeout == 0 {
+		c.PlannedSwitchTimeout = d.PlannedSwitchTimeout
+	}
+	if c.ReplicaMaxLinkDown == 0 {
+		c.ReplicaMaxLinkDown = d.ReplicaMaxLinkDown
+	}
+	if c.SentinelPort == 0 {
+		c.SentinelPort = d.SentinelPort
+	}
+	if c.HistoryFile == "" {
+		c.HistoryFile = d.HistoryFile
+	}
+	if c.StateStore == "" {
+		c.StateStore = d.StateStore
+	}
+	if c.LeaderElection == "" {
+		c.LeaderElection = d.LeaderElection
+	}
+	if c.LeaderLockFile == "" {
+		c.LeaderLockFile = d.LeaderLockFile
+	}
+	if c.LeaderTTL == 0 {
+		c.LeaderTTL = d.LeaderTTL
+	}
+	if c.AdvertiseAddress == "" {
+		c.AdvertiseAddress = d.AdvertiseAddress
+	}
+	if c.RedisUsername == "" {
+		c.RedisUsername = d.RedisUsername
+	}
+	if c.RedisPassword == "" {
+		c.RedisPassword = d.RedisPassword
+	}
+	if c.RedisPasswordFile == "" {
+		c.RedisPasswordFile = d.RedisPasswordFile
+	}
+	if !c.RedisTLS {
+		c.RedisTLS = d.RedisTLS
+	}
+	if c.RedisTLSCAFile == "" {
+		c.RedisTLSCAFile = d.RedisTLSCAFile
+	}
+	if c.RedisTLSCertFile == "" {
+		c.RedisTLSCertFile = d.RedisTLSCertFile
+	}
+	if c.RedisTLSKeyFile == "" {
+		c.RedisTLSKeyFile = d.RedisTLSKeyFile
+	}
+	if !c.ConfirmFencing {
+		c.ConfirmFencing = d.ConfirmFencing
+	}
+	if c.ReconnectBackoffMin == 0 {
+		c.ReconnectBackoffMin = d.ReconnectBackoffMin
+	}
+	if c.ReconnectBackoffMax == 0 {
+		c.ReconnectBackoffMax = d.ReconnectBackoffMax
+	}
+	if c.ReconnectBackoffReset == 0 {
+		c.ReconnectBackoffReset = d.ReconnectBackoffReset
+	}
+	if c.ClientHealthAddress == "" {
+		c.ClientHealthAddress = d.ClientHealthAddress
+	}
+	if !c.RedisMasterFilePrevious {
+		c.RedisMasterFilePrevious = d.RedisMasterFilePrevious
+	}
+	if c.RedisMasterFileHook == "" {
+		c.RedisMasterFileHook = d.RedisMasterFileHook
+	}
+	if c.RedisMasterFilePidFile == "" {
+		c.RedisMasterFilePidFile = d.RedisMasterFilePidFile
+	}
+	if c.RedisMasterFileSignal == "" {
+		c.RedisMasterFileSignal = d.RedisMasterFileSignal
+	}
+	if c.RedisMasterFileFormat == "" {
+		c.RedisMasterFileFormat = d.RedisMasterFileFormat
+	}
+	if c.ClientRetirementDays == 0 {
+		c.ClientRetirementDays = d.ClientRetirementDays
+	}
+	if c.NotificationWebhooks == "" {
+		c.NotificationWebhooks = d.NotificationWebhooks
+	}
+	if c.NotificationFormat == "" {
+		c.NotificationFormat = d.NotificationFormat
+	}
+	if c.MailMinSeverity == "" {
+		c.MailMinSeverity = d.MailMinSeverity
+	}
+	if c.MailNotificationTypes == "" {
+		c.MailNotificationTypes = d.MailNotificationTypes
+	}
+	if c.MailDedupWindow == 0 {
+		c.MailDedupWindow = d.MailDedupWindow
+	}
+	if c.MailRateLimit == 0 {
+		c.MailRateLimit = d.MailRateLimit
+	}
+	if c.MailDigestInterval == 0 {
+		c.MailDigestInterval = d.MailDigestInterval
+	}
+	if c.MailRelayUsername == "" {
+		c.MailRelayUsername = d.MailRelayUsername
+	}
+	if c.MailRelayPassword == "" {
+		c.MailRelayPassword = d.MailRelayPassword
+	}
+	if c.MailRelayAuth == "" {
+		c.MailRelayAuth = d.MailRelayAuth
+	}
+	if c.MailRelayTLS == "" {
+		c.MailRelayTLS = d.MailRelayTLS
+	}
+	if c.MailRelayTLSCAFile == "" {
+		c.MailRelayTLSCAFile = d.MailRelayTLSCAFile
+	}
+	if !c.MailHTML {
+		c.MailHTML = d.MailHTML
+	}
+	if c.MailSpoolDir == "" {
+		c.MailSpoolDir = d.MailSpoolDir
+	}
+	if c.MailSpoolMaxAge == 0 {
+		c.MailSpoolMaxAge = d.MailSpoolMaxAge
+	}
+	if c.MailerHealthAddress == "" {
+		c.MailerHealthAddress = d.MailerHealthAddress
+	}
+	if c.NotificationBufferSize == 0 {
+		c.NotificationBufferSize = d.NotificationBufferSize
+	}
 	c.Sanitize()
 	return c
 }
@@ -265,6 +632,192 @@ func configFromConsulEnv(env consul.Env) *Config {
 	if v, ok := env["REDIS_FAILOVER_CONFIDENCE_LEVEL"]; ok {
 		c.ConfidenceLevel = v
 	}
+	if v, ok := env["REDIS_CONFIGURATION_SERVER_TLS"]; ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.ServerTLS = b
+		}
+	}
+	if v, ok := env["REDIS_CONFIGURATION_TLS_CERT"]; ok {
+		c.TLSCertFile = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_TLS_KEY"]; ok {
+		c.TLSKeyFile = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_TLS_CA"]; ok {
+		c.TLSCAFile = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_SECRET"]; ok {
+		c.SharedSecret = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_ADMIN_TOKEN"]; ok {
+		c.AdminToken = v
+	}
+	if v, ok := env["REDIS_PLANNED_SWITCH_TIMEOUT"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.PlannedSwitchTimeout = d
+		}
+	}
+	if v, ok := env["REDIS_REPLICA_MAX_LINK_DOWN"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.ReplicaMaxLinkDown = d
+		}
+	}
+	if v, ok := env["REDIS_CONFIGURATION_SENTINEL_PORT"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.SentinelPort = d
+		}
+	}
+	if v, ok := env["REDIS_CONFIGURATION_HISTORY_FILE"]; ok {
+		c.HistoryFile = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_STATE_STORE"]; ok {
+		c.StateStore = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_LEADER_ELECTION"]; ok {
+		c.LeaderElection = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_LEADER_LOCK_FILE"]; ok {
+		c.LeaderLockFile = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_LEADER_TTL"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.LeaderTTL = d
+		}
+	}
+	if v, ok := env["REDIS_CONFIGURATION_ADVERTISE_ADDRESS"]; ok {
+		c.AdvertiseAddress = v
+	}
+	if v, ok := env["REDIS_USERNAME"]; ok {
+		c.RedisUsername = v
+	}
+	if v, ok := env["REDIS_PASSWORD"]; ok {
+		c.RedisPassword = v
+	}
+	if v, ok := env["REDIS_PASSWORD_FILE"]; ok {
+		c.RedisPasswordFile = v
+	}
+	if v, ok := env["REDIS_TLS"]; ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.RedisTLS = b
+		}
+	}
+	if v, ok := env["REDIS_TLS_CA"]; ok {
+		c.RedisTLSCAFile = v
+	}
+	if v, ok := env["REDIS_TLS_CERT"]; ok {
+		c.RedisTLSCertFile = v
+	}
+	if v, ok := env["REDIS_TLS_KEY"]; ok {
+		c.RedisTLSKeyFile = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_FENCING_REQUIRES_CONFIRMATION"]; ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.ConfirmFencing = b
+		}
+	}
+	if v, ok := env["RECONNECT_BACKOFF_MIN"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.ReconnectBackoffMin = d
+		}
+	}
+	if v, ok := env["RECONNECT_BACKOFF_MAX"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.ReconnectBackoffMax = d
+		}
+	}
+	if v, ok := env["RECONNECT_BACKOFF_RESET"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.ReconnectBackoffReset = d
+		}
+	}
+	if v, ok := env["REDIS_CONFIGURATION_CLIENT_HEALTH_ADDRESS"]; ok {
+		c.ClientHealthAddress = v
+	}
+	if v, ok := env["REDIS_MASTER_FILE_KEEP_PREVIOUS"]; ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.RedisMasterFilePrevious = b
+		}
+	}
+	if v, ok := env["REDIS_MASTER_FILE_HOOK"]; ok {
+		c.RedisMasterFileHook = v
+	}
+	if v, ok := env["REDIS_MASTER_FILE_PID_FILE"]; ok {
+		c.RedisMasterFilePidFile = v
+	}
+	if v, ok := env["REDIS_MASTER_FILE_SIGNAL"]; ok {
+		c.RedisMasterFileSignal = v
+	}
+	if v, ok := env["REDIS_MASTER_FILE_FORMAT"]; ok {
+		c.RedisMasterFileFormat = v
+	}
+	if v, ok := env["REDIS_CONFIGURATION_CLIENT_RETIREMENT_DAYS"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.ClientRetirementDays = d
+		}
+	}
+	if v, ok := env["NOTIFICATION_WEBHOOKS"]; ok {
+		c.NotificationWebhooks = v
+	}
+	if v, ok := env["NOTIFICATION_FORMAT"]; ok {
+		c.NotificationFormat = v
+	}
+	if v, ok := env["MAIL_MIN_SEVERITY"]; ok {
+		c.MailMinSeverity = v
+	}
+	if v, ok := env["MAIL_NOTIFICATION_TYPES"]; ok {
+		c.MailNotificationTypes = v
+	}
+	if v, ok := env["MAIL_DEDUP_WINDOW"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.MailDedupWindow = d
+		}
+	}
+	if v, ok := env["MAIL_RATE_LIMIT"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.MailRateLimit = d
+		}
+	}
+	if v, ok := env["MAIL_DIGEST_INTERVAL"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.MailDigestInterval = d
+		}
+	}
+	if v, ok := env["MAIL_RELAY_USERNAME"]; ok {
+		c.MailRelayUsername = v
+	}
+	if v, ok := env["MAIL_RELAY_PASSWORD"]; ok {
+		c.MailRelayPassword = v
+	}
+	if v, ok := env["MAIL_RELAY_AUTH"]; ok {
+		c.MailRelayAuth = v
+	}
+	if v, ok := env["MAIL_RELAY_TLS"]; ok {
+		c.MailRelayTLS = v
+	}
+	if v, ok := env["MAIL_RELAY_TLS_CA"]; ok {
+		c.MailRelayTLSCAFile = v
+	}
+	if v, ok := env["MAIL_HTML"]; ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.MailHTML = b
+		}
+	}
+	if v, ok := env["MAIL_SPOOL_DIR"]; ok {
+		c.MailSpoolDir = v
+	}
+	if v, ok := env["MAIL_SPOOL_MAX_AGE"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.MailSpoolMaxAge = d
+		}
+	}
+	if v, ok := env["MAILER_HEALTH_ADDRESS"]; ok {
+		c.MailerHealthAddress = v
+	}
+	if v, ok := env["NOTIFICATION_BUFFER_SIZE"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			c.NotificationBufferSize = d
+		}
+	}
 	c.Sanitize()
 	return &c
 }
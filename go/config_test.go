@@ -14,4 +14,57 @@ func TestCanGetFailoverSetsFromConfig(t *testing.T) {
 	expected = FailoverSets{{name: "s1", spec: "a.xxx.com:6379,b.xxx.com:6379"}, {name: "s2", spec: "a.yyy.com:6379,b.yyy.com:6379"}}
 	actual = c.FailoverSets()
 	checkEqual(t, actual, expected)
+
+	c = Config{RedisServers: "beetle:file:/etc/beetle/secret@a.xxx.com:6379,b.xxx.com:6379"}
+	expected = FailoverSets{{name: "system", spec: "beetle:file:/etc/beetle/secret@a.xxx.com:6379,b.xxx.com:6379"}}
+	actual = c.FailoverSets()
+	checkEqual(t, actual, expected)
+
+	c = Config{RedisServers: "s1/beetle:file:/etc/beetle/secret@a.xxx.com:6379"}
+	expected = FailoverSets{{name: "s1", spec: "beetle:file:/etc/beetle/secret@a.xxx.com:6379"}}
+	actual = c.FailoverSets()
+	checkEqual(t, actual, expected)
+}
+
+func TestSystemClientIdsAndConfidenceLevels(t *testing.T) {
+	c := Config{ClientIds: "c1,c2", ConfidenceLevel: "50"}
+	def, systems := c.SystemClientIds()
+	checkEqual(t, def.Keys(), []string{"c1", "c2"})
+	checkEqual(t, len(systems), 0)
+	level, levels := c.SystemConfidenceLevels()
+	checkEqual(t, level, 0.5)
+	checkEqual(t, len(levels), 0)
+
+	c = Config{ClientIds: "primary/c1,c2\nsecondary/c3", ConfidenceLevel: "primary/50;120"}
+	c.Sanitize()
+	checkEqual(t, c.ClientIds, "primary/c1,c2;secondary/c3")
+	def, systems = c.SystemClientIds()
+	checkEqual(t, len(def), 0)
+	primary, secondary := systems["primary"], systems["secondary"]
+	checkEqual(t, primary.Keys(), []string{"c1", "c2"})
+	checkEqual(t, secondary.Keys(), []string{"c3"})
+	level, levels = c.SystemConfidenceLevels()
+	checkEqual(t, level, 1.0)
+	checkEqual(t, levels, map[string]float64{"primary": 0.5})
+}
+
+func TestCheckClientIds(t *testing.T) {
+	servers := "primary/127.0.0.1:7001,127.0.0.1:7002\nsecondary/127.0.0.1:7003,127.0.0.1:7004"
+	valid := []string{"", "c1,c2", "primary/c1,c2;secondary/c3", "primary/c1,c2;c3", "primary/c1,c2;secondary/"}
+	for _, ids := range valid {
+		c := Config{RedisServers: servers, ClientIds: ids}
+		checkEqual(t, c.CheckClientIds(), nil)
+	}
+	invalid := []string{"primary/c1,c2", "primary/c1;secondary/c2;tertiary/c3", "primary/c1;secondry/c2"}
+	for _, ids := range invalid {
+		c := Config{RedisServers: servers, ClientIds: ids}
+		if c.CheckClientIds() == nil {
+			t.Errorf("expected client ids '%s' to be rejected", ids)
+		}
+	}
+}
+
+func TestNotificationFormatDefaultsToText(t *testing.T) {
+	c := (&Config{}).SetDefaults()
+	checkEqual(t, c.NotificationFormat, NOTIFICATION_FORMAT_TEXT)
 }
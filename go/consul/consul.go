@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/xing/beetle/backoff"
 )
 
 // Verbose defines the verbosity level
@@ -72,6 +73,7 @@ type Client struct {
 	state        Space
 	dataCenter   string
 	dataCenters  []string
+	retry        backoff.Backoff // Policy for retrying failed watches, the zero value uses the defaults.
 }
 
 // NewClient creates a new consul client
@@ -259,6 +261,13 @@ func (c *Client) GetEnv() (env Env, err error) {
 	return
 }
 
+// SetRetryBackoff sets the policy for retrying failed watches. Each watch
+// keeps its own copy of it.
+func (c *Client) SetRetryBackoff(retry *backoff.Backoff) {
+	c.retry = *retry
+	c.retry.Reset()
+}
+
 // WatchConfig watches for consul changes in the background. Returns a channel
 // on which to listen for new environments.
 func (c *Client) WatchConfig() (chan Env, error) {
@@ -277,15 +286,19 @@ func (c *Client) WatchConfig() (chan Env, error) {
 }
 
 // Watches run forever. We rely on sockets being closed automatically when the
-// program terminates.
+// program terminates. Failed long polls are retried with exponential backoff.
 func (c *Client) watchSpace(space *Space, channel chan Env) {
+	retry := c.retry
 	for {
 		oldIndex := space.modifyIndex
 		err := c.GetData(space, true)
 		if err != nil {
-			log.Println(err)
+			delay := retry.Next()
+			log.Printf("%s (retrying in %s)", err, delay)
+			time.Sleep(delay)
 			continue
 		}
+		retry.Reset()
 		if oldIndex != space.modifyIndex {
 			channel <- c.CombineConfigs()
 		}
@@ -11,6 +11,8 @@ import (
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/xing/beetle/backoff"
 )
 
 var testUrl = "http://localhost:8500"
@@ -87,3 +89,16 @@ func TestWatching(t *testing.T) {
 		}
 	}
 }
+
+func TestSetRetryBackoff(t *testing.T) {
+	client := NewClient(testUrl, testToken, testApp)
+	retry := backoff.New(2*time.Second, 4*time.Second, time.Minute)
+	retry.Next()
+	client.SetRetryBackoff(retry)
+	if client.retry.Min != 2*time.Second || client.retry.Max != 4*time.Second {
+		t.Errorf("retry policy not taken over: %+v", client.retry)
+	}
+	if client.retry.Attempts() != 0 {
+		t.Errorf("retry policy should start without failed attempts")
+	}
+}
@@ -0,0 +1,170 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSessionNotFound is returned when renewing a session which consul no
+// longer knows about, usually because its TTL has expired.
+var ErrSessionNotFound = errors.New("session not found")
+
+// LockKey returns the key used for the leader lock of the application.
+func (c *Client) LockKey() string {
+	return "apps/" + c.appName + "/leader"
+}
+
+func (c *Client) put(uri string, value string) ([]byte, int, error) {
+	client := &http.Client{Timeout: time.Second * 10}
+	if Verbose {
+		log.Printf("PUT %s\n", uri)
+	}
+	req, err := http.NewRequest(http.MethodPut, uri, bytes.NewBufferString(value))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "PUT %q failed", uri)
+	}
+	if c.consulToken != "" {
+		req.Header.Set("X-Consul-Token", c.consulToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "PUT %q failed", uri)
+	}
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, errors.Wrapf(err, "PUT %q failed", uri)
+	}
+	if Verbose {
+		log.Printf("PUT response: %s", string(d))
+	}
+	return d, resp.StatusCode, nil
+}
+
+// CreateSession creates a session which gets invalidated when not renewed
+// within the given TTL. Locks held by the session are released on
+// invalidation.
+func (c *Client) CreateSession(name string, ttl time.Duration) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"Name":      name,
+		"TTL":       ttl.String(),
+		"Behavior":  "release",
+		"LockDelay": "1s",
+	})
+	if err != nil {
+		return "", err
+	}
+	uri := c.consulUrl + "v1/session/create"
+	d, status, err := c.put(uri, string(body))
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("PUT %q failed with status: %d", uri, status)
+	}
+	var res struct{ ID string }
+	if err = json.Unmarshal(d, &res); err != nil {
+		return "", errors.Wrap(err, "json unmarshal failed")
+	}
+	return res.ID, nil
+}
+
+// RenewSession resets the TTL of the given session.
+func (c *Client) RenewSession(id string) error {
+	uri := c.consulUrl + "v1/session/renew/" + id
+	_, status, err := c.put(uri, "")
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return ErrSessionNotFound
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("PUT %q failed with status: %d", uri, status)
+	}
+	return nil
+}
+
+// DestroySession invalidates the given session, releasing all its locks.
+func (c *Client) DestroySession(id string) error {
+	uri := c.consulUrl + "v1/session/destroy/" + id
+	_, status, err := c.put(uri, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("PUT %q failed with status: %d", uri, status)
+	}
+	return nil
+}
+
+// AcquireLock tries to acquire the lock on the given key for the given
+// session, storing the value on success. Returns whether the session holds
+// the lock.
+func (c *Client) AcquireLock(key string, session string, value string) (bool, error) {
+	uri := c.kvUrl(key) + "?acquire=" + session
+	d, status, err := c.put(uri, value)
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("PUT %q failed with status: %d", uri, status)
+	}
+	return string(bytes.TrimSpace(d)) == "true", nil
+}
+
+// ReleaseLock releases the lock on the given key held by the given session.
+func (c *Client) ReleaseLock(key string, session string) error {
+	uri := c.kvUrl(key) + "?release=" + session
+	_, status, err := c.put(uri, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("PUT %q failed with status: %d", uri, status)
+	}
+	return nil
+}
+
+// LockHolder returns the value stored with the lock on the given key, or an
+// empty string if the lock is not held by any session.
+func (c *Client) LockHolder(key string) (string, error) {
+	uri := c.kvUrl(key)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "GET %q failed", uri)
+	}
+	if c.consulToken != "" {
+		req.Header.Set("X-Consul-Token", c.consulToken)
+	}
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "GET %q failed", uri)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %q failed with status: %s", uri, resp.Status)
+	}
+	var entries []struct {
+		Value   string
+		Session string
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", errors.Wrap(err, "json unmarshal failed")
+	}
+	if len(entries) == 0 || entries[0].Session == "" {
+		return "", nil
+	}
+	return decodeBase64(entries[0].Value)
+}
@@ -108,7 +108,7 @@ func (s *CopierState) copyKeys(db int) {
 	var copied int
 	defer func() { logInfo("copied %d keys from db %d", copied, db) }()
 	ticker := time.NewTicker(100 * time.Millisecond)
-	s.targetRedis = redis.NewClient(&redis.Options{Addr: s.opts.TargetRedis, DB: db})
+	s.targetRedis = NewRedisClient(s.opts.TargetRedis, db)
 	keyPattern := "msgid:" + s.opts.QueuePrefix + "*:expires"
 	expiry := time.Now().Add(s.opts.CopyAfter)
 	logInfo("copying keys for queue prefix '%s' expiring after %s", s.opts.QueuePrefix, expiry.Format(time.RFC3339))
@@ -170,7 +170,7 @@ func (s *CopierState) getMaster(db int) bool {
 			}
 			s.redis = nil
 		} else {
-			s.redis = redis.NewClient(&redis.Options{Addr: server, DB: db})
+			s.redis = NewRedisClient(server, db)
 		}
 	}
 	if s.redis == nil {
@@ -184,7 +184,12 @@ func (s *CopierState) getMaster(db int) bool {
 // should the master change while running the scan. Terminates as soon
 // as a full scan has been performed on all databases.
 func RunCopyKeys(opts CopyKeysOptions) error {
-	logDebug("deleting keys with options: %+v", opts)
+	logDebug("copying keys with options: %+v", opts)
+	target, err := ParseRedisServerSpec(opts.TargetRedis)
+	if err != nil {
+		return err
+	}
+	opts.TargetRedis = target
 	state := &CopierState{opts: opts}
 	state.keySuffixes = []string{"status", "ack_count", "timeout", "delay", "attempts", "exceptions", "mutex", "expires"}
 	for _, s := range strings.Split(opts.Databases, ",") {
@@ -121,7 +121,7 @@ func (s *DumperState) getMaster(db int) bool {
 			}
 			s.redis = nil
 		} else {
-			s.redis = redis.NewClient(&redis.Options{Addr: server, DB: db})
+			s.redis = NewRedisClient(server, db)
 		}
 	}
 	if s.redis == nil {
@@ -27,6 +27,24 @@ type FailoverState struct {
 	system                       string           // The name of the failover set.
 	server                       *ServerState     // Backpointer to embedding server.
 	gcInfo                       *GCInfo          // Information on last garbage collection.
+	switchCount                  int              // Number of master switches performed since server start.
+	requestedMaster              string           // Server requested as new master by an operator (host:port format), if any.
+	plannedTarget                *RedisShim       // Target of a planned master switch, if one is in progress.
+	plannedDeadline              time.Time        // Time at which we give up waiting for the planned target to catch up.
+	catchingUp                   bool             // Whether we're waiting for the target of a planned switch to catch up.
+	checkingCatchUp              bool             // Whether a background check of the replication lag of the planned target is running.
+	promoting                    bool             // Whether the target of a planned switch is being promoted in the background.
+	refreshing                   bool             // Whether a background refresh of the redis info is running.
+	rogueMasters                 StringList       // Servers besides the current master claiming to be master, which have not been demoted yet.
+	masterUnavailableSince       time.Time        // When the current master was first found unavailable, zero while it is available.
+}
+
+// RefreshResult is sent to the dispatcher when a background refresh of the
+// redis info of a failover set has completed.
+type RefreshResult struct {
+	system string
+	info   *RedisServerInfo // The refreshed info, results are discarded if it has been replaced meanwhile.
+	probe  RedisProbe
 }
 
 // GetConfig returns the server state in a thread safe manner.
@@ -58,14 +76,34 @@ func (s *FailoverState) SetGCInfo() {
 	s.gcInfo = &info
 }
 
+// RecordEvent adds an event to the failover history. System, current token
+// and current master are filled in automatically.
+func (s *FailoverState) RecordEvent(e HistoryEvent) {
+	e.System = s.system
+	if e.Token == "" {
+		e.Token = s.currentToken
+	}
+	if e.Master == "" && s.currentMaster != nil {
+		e.Master = s.currentMaster.server
+	}
+	s.server.history.Record(e)
+}
+
 // SendToWebSockets sends a message to all registered clients channels.
 func (s *FailoverState) SendToWebSockets(msg *MsgBody) (err error) {
 	return s.server.SendToWebSockets(msg)
 }
 
-// SendNotification sends a notifcation on all registered notifcation channels.
-func (s *FailoverState) SendNotification(text string) (err error) {
-	return s.server.SendNotification(text)
+// SendNotification sends a notifcation on all registered notifcation channels,
+// filling in the system and the current token.
+func (s *FailoverState) SendNotification(n *Notification) (err error) {
+	if n.System == "" {
+		n.System = s.system
+	}
+	if n.Token == "" {
+		n.Token = s.currentToken
+	}
+	return s.server.SendNotification(n)
 }
 
 // StopPinging changes the current state to 'not pinging' and cancels the
@@ -93,11 +131,15 @@ func (s *FailoverState) StopInvalidating() {
 // switch or not. If no client ids have been configured, it switches the master
 // immediately.
 func (s *FailoverState) MasterUnavailable() {
+	if s.masterUnavailableSince.IsZero() {
+		s.masterUnavailableSince = time.Now()
+	}
 	s.PauseWatcher()
 	msg := fmt.Sprintf("Redis master '%s' not available", s.currentMaster.server)
 	logWarn(msg)
-	s.SendNotification(msg)
-	if len(s.server.clientIds) == 0 {
+	s.SendNotification(&Notification{Type: EVENT_MASTER_UNAVAILABLE, Severity: SEVERITY_ERROR, OldMaster: s.currentMaster.server, Text: msg})
+	s.RecordEvent(HistoryEvent{Event: EVENT_MASTER_UNAVAILABLE})
+	if len(s.ClientIds()) == 0 {
 		s.SwitchMaster()
 	} else {
 		s.StartInvalidation()
@@ -125,14 +167,16 @@ func (s *FailoverState) AvailableSlaves() RedisShims {
 	return s.redis.Slaves()
 }
 
-// InitiateMasterSwitch refreshes the cached redis information and starts a vote
-// on a new redis server, unless there is already a vote in progress or the
-// currently configured redis master is available.
-func (s *FailoverState) InitiateMasterSwitch() bool {
-	s.redis.Refresh()
+// InitiateMasterSwitch starts a vote on a new redis server, unless there is
+// already a vote in progress or the currently configured redis master is
+// available according to the cached redis information, which callers should
+// refresh beforehand. If a target server is given, it will be preferred when
+// selecting the new master.
+func (s *FailoverState) InitiateMasterSwitch(target string) bool {
 	available, switchInProgress := s.MasterIsAvailable(), s.WatcherPaused()
 	logInfo("Initiating master switch: already in progress = %v", switchInProgress)
 	if !(available || switchInProgress) {
+		s.requestedMaster = target
 		s.MasterUnavailable()
 	}
 	return !available || switchInProgress
@@ -146,6 +190,24 @@ func (s *FailoverState) CheckRedisConfiguration() {
 	}
 }
 
+// followMaster makes the given server the current master of a follower,
+// reusing the connection of a configured server.
+func (s *FailoverState) followMaster(server string) {
+	s.releaseMaster()
+	if s.currentMaster = s.redis.Instance(server); s.currentMaster == nil {
+		s.currentMaster = NewRedisShim(server)
+	}
+}
+
+// releaseMaster forgets the current master, closing its connection unless it
+// belongs to one of the configured servers.
+func (s *FailoverState) releaseMaster() {
+	if s.currentMaster != nil && s.redis.Instance(s.currentMaster.server) != s.currentMaster {
+		s.currentMaster.Close()
+	}
+	s.currentMaster = nil
+}
+
 // DetermineInitialMaster either uses information from the master file on disk
 // (passed in as a map) or tries to auto detect inital redis masters and writes
 // the updated file to disk. If no master can be determined, the main server
@@ -173,14 +235,54 @@ func (s *FailoverState) DetermineInitialMaster(mastersFromFile map[string]string
 func (s *FailoverState) DetermineNewMaster() *RedisShim {
 	if s.redis.Unknowns().Include(s.currentMaster) {
 		slaves := s.redis.SlavesOf(s.currentMaster)
-		if len(slaves) == 0 {
-			return nil
-		}
-		return slaves[0]
+		return s.SelectNewMaster(slaves)
 	}
 	return s.currentMaster
 }
 
+// SelectNewMaster selects the slave to promote from the given list of slaves
+// of the current master. A server requested by an operator is preferred.
+// Otherwise the slave with the highest replication offset is chosen, ignoring
+// slaves which had lost contact with the master for too long before it became
+// unavailable. Returns nil if no slave qualifies.
+func (s *FailoverState) SelectNewMaster(slaves RedisShims) *RedisShim {
+	if len(slaves) == 0 {
+		return nil
+	}
+	for _, slave := range slaves {
+		if slave.server == s.requestedMaster {
+			return slave
+		}
+	}
+	if s.requestedMaster != "" {
+		logWarn("Requested master '%s' is not an available slave of '%s'", s.requestedMaster, s.currentMaster.server)
+	}
+	return s.redis.BestReplica(slaves, s.MaxReplicaLinkDown())
+}
+
+// MaxReplicaLinkDown returns the number of seconds a slave may have lost
+// contact with the current master and still be promoted. While the master is
+// unavailable, all slaves lose contact with it, so the time since the master
+// was first found unavailable (plus one check interval, as it may have failed
+// right after the previous check) is added to the configured limit.
+func (s *FailoverState) MaxReplicaLinkDown() int {
+	config := s.GetConfig()
+	if s.masterUnavailableSince.IsZero() {
+		return config.ReplicaMaxLinkDown
+	}
+	unavailable := int(time.Since(s.masterUnavailableSince).Seconds()) + 1
+	return config.ReplicaMaxLinkDown + config.RedisMasterRetryInterval + unavailable
+}
+
+// replicationOffsetInfo describes the replication offset of the given server
+// for use in notifications.
+func (s *FailoverState) replicationOffsetInfo(r *RedisShim) string {
+	if ri, ok := s.redis.ReplicaInfo(r); ok {
+		return fmt.Sprintf("replication offset: %d", ri.Offset)
+	}
+	return "replication offset: unknown"
+}
+
 // RedeemToken checks whether the given token is valid for the current vote.
 func (s *FailoverState) RedeemToken(token string) bool {
 	if token == s.currentToken {
@@ -191,10 +293,11 @@ func (s *FailoverState) RedeemToken(token string) bool {
 }
 
 // GenerateNewToken generates a new token by incrementing a counter maintained
-// in the server state.
+// in the server state. The new token is persisted immediately.
 func (s *FailoverState) GenerateNewToken() {
 	s.currentTokenInt++
 	s.currentToken = strconv.Itoa(s.currentTokenInt)
+	s.server.SaveState()
 }
 
 // StartInvalidation resets the state information used to keep track of the an
@@ -211,6 +314,7 @@ func (s *FailoverState) StartInvalidation() {
 func (s *FailoverState) CheckEnoughClientsAvailable() {
 	s.GenerateNewToken()
 	logInfo("Sending ping messages with token '%s'", s.currentToken)
+	s.RecordEvent(HistoryEvent{Event: EVENT_PING_ROUND_STARTED})
 	msg := &MsgBody{System: s.system, Name: PING, Token: s.currentToken}
 	s.SendToWebSockets(msg)
 	s.availabilityTimer = time.AfterFunc(s.ClientTimeout(), func() {
@@ -225,7 +329,8 @@ func (s *FailoverState) InvalidateCurrentMaster() {
 	s.GenerateNewToken()
 	s.invalidating = true
 	logInfo("Sending invalidate messages with token '%s'", s.currentToken)
-	msg := &MsgBody{System: s.system, Name: INVALIDATE, Token: s.currentToken}
+	s.RecordEvent(HistoryEvent{Event: EVENT_INVALIDATION_STARTED, ClientIds: s.clientPongIdsReceived.Keys()})
+	msg := &MsgBody{System: s.system, Name: INVALIDATE, Token: s.currentToken, Planned: s.PlannedSwitchInProgress()}
 	s.SendToWebSockets(msg)
 	s.invalidateTimer = time.AfterFunc(s.ClientTimeout(), func() {
 		s.invalidateTimer = nil
@@ -236,26 +341,56 @@ func (s *FailoverState) InvalidateCurrentMaster() {
 // CancelInvalidation generates a new token to the next vote and unpauses the
 // watcher.
 func (s *FailoverState) CancelInvalidation() {
+	if s.pinging {
+		s.RecordEvent(HistoryEvent{Event: EVENT_VOTE_TIMED_OUT, ClientIds: s.clientPongIdsReceived.Keys(), Details: "waiting for pong messages"})
+	} else if s.invalidating {
+		s.RecordEvent(HistoryEvent{Event: EVENT_VOTE_TIMED_OUT, ClientIds: s.clientInvalidatedIdsReceived.Keys(), Details: "waiting for client_invalidated messages"})
+	}
 	s.pinging = false
 	s.invalidating = false
+	s.requestedMaster = ""
 	s.GenerateNewToken()
+	if s.PlannedSwitchInProgress() {
+		s.AbortPlannedSwitch("not enough clients answered in time")
+		return
+	}
 	s.StartWatcher()
 }
 
-// ReceivedEnoughClientPongIds checks whether a sufficient number of client's have
-// answered the PING message by sending a PONG.
+// ClientIds returns the clients taking part in master elections of the system.
+func (s *FailoverState) ClientIds() StringSet {
+	if ids, ok := s.server.systemClientIds[s.system]; ok {
+		return ids
+	}
+	return s.server.defaultClientIds
+}
+
+// ConfidenceLevel returns the fraction of the system's clients which must
+// answer before the master is switched.
+func (s *FailoverState) ConfidenceLevel() float64 {
+	if level, ok := s.server.systemConfidenceLevels[s.system]; ok {
+		return level
+	}
+	return s.server.failoverConfidenceLevel
+}
+
+// ReceivedEnoughClientPongIds checks whether a sufficient number of the
+// system's clients have answered the PING message by sending a PONG.
 func (s *FailoverState) ReceivedEnoughClientPongIds() (float64, bool) {
-	received := s.clientPongIdsReceived.Intersect(s.server.clientIds)
-	level := float64(len(received)) / float64(len(s.server.clientIds))
-	return level, level >= s.server.failoverConfidenceLevel
+	ids := s.ClientIds()
+	received := s.clientPongIdsReceived.Intersect(ids)
+	level := float64(len(received)) / float64(len(ids))
+	return level, level >= s.ConfidenceLevel()
 }
 
-// ReceivedEnoughClientInvalidatedIds checks whether all client's have answered the
-// INVALIDATE message by sending a CLIENT_INVALIDATED message back.
+// ReceivedEnoughClientInvalidatedIds checks whether a sufficient number of the
+// system's clients have answered the INVALIDATE message by sending a
+// CLIENT_INVALIDATED message back.
 func (s *FailoverState) ReceivedEnoughClientInvalidatedIds() (float64, bool) {
-	received := s.clientInvalidatedIdsReceived.Intersect(s.server.clientIds)
-	level := float64(len(received)) / float64(len(s.server.clientIds))
-	return level, level >= s.server.failoverConfidenceLevel
+	ids := s.ClientIds()
+	received := s.clientInvalidatedIdsReceived.Intersect(ids)
+	level := float64(len(received)) / float64(len(ids))
+	return level, level >= s.ConfidenceLevel()
 }
 
 // SwitchMaster is called after a successfully completed vote and performs a
@@ -263,19 +398,30 @@ func (s *FailoverState) ReceivedEnoughClientInvalidatedIds() (float64, bool) {
 // starts watching the old master again. In either case, a notification message
 // is sent out.
 func (s *FailoverState) SwitchMaster() {
+	if s.PlannedSwitchInProgress() {
+		s.CompletePlannedSwitch()
+		return
+	}
 	newMaster := s.DetermineNewMaster()
 	if newMaster != nil {
-		msg := fmt.Sprintf("Setting redis master to '%s' (was '%s')", newMaster.server, s.currentMaster.server)
+		msg := fmt.Sprintf("Setting redis master to '%s' (was '%s', %s)", newMaster.server, s.currentMaster.server, s.replicationOffsetInfo(newMaster))
 		logWarn(msg)
-		s.SendNotification(msg)
+		s.SendNotification(&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, OldMaster: s.currentMaster.server, NewMaster: newMaster.server, Text: msg})
 		newMaster.MakeMaster()
+		oldMaster := s.currentMaster
 		s.currentMaster = newMaster
+		s.switchCount++
 		s.server.UpdateMasterFile()
+		s.server.PublishSwitchMaster(s.system, oldMaster.server, newMaster.server)
+		s.RecordEvent(HistoryEvent{Event: EVENT_MASTER_SWITCHED, Master: oldMaster.server, NewMaster: newMaster.server, Details: msg})
 	} else {
 		msg := fmt.Sprintf("Redis master could not be switched, no slave available to become new master, promoting old master")
 		logError(msg)
-		s.SendNotification(msg)
+		s.SendNotification(&Notification{Type: EVENT_SWITCH_ABORTED, Severity: SEVERITY_CRITICAL, OldMaster: s.currentMaster.server, Text: msg})
+		s.RecordEvent(HistoryEvent{Event: EVENT_SWITCH_ABORTED, Details: msg})
 	}
+	s.requestedMaster = ""
+	s.masterUnavailableSince = time.Time{}
 	s.PublishMaster(s.currentMaster.server)
 	s.StartWatcher()
 }
@@ -288,9 +434,10 @@ func (s *FailoverState) PublishMaster(server string) {
 }
 
 // ConfigureSlaves turns all available servers into slaves of the current master.
+// Rogue masters waiting for operator confirmation are left alone.
 func (s *FailoverState) ConfigureSlaves(master *RedisShim) {
 	for _, r := range s.redis.MastersAndSlaves() {
-		if r.server != master.server {
+		if r.server != master.server && !s.rogueMasters.Include(r.server) {
 			r.redis.SlaveOf(master.host, strconv.Itoa(master.port))
 		}
 	}
@@ -318,11 +465,42 @@ func (s *FailoverState) PauseWatcher() {
 	}
 }
 
-// CheckRedisAvailability uses
+// RetriesLeft returns the number of availability checks left before a master
+// switch gets initiated. Returns 0 while a switch is in progress.
+func (s *FailoverState) RetriesLeft() int {
+	left := s.GetConfig().RedisMasterRetries - s.retries
+	if left < 0 || s.retries < 0 {
+		return 0
+	}
+	return left
+}
+
+// StartRefresh probes the redis servers in the background, unless a refresh
+// is already running. The result is delivered to the dispatcher on the refresh
+// channel.
+func (s *FailoverState) StartRefresh() {
+	if s.refreshing {
+		return
+	}
+	s.refreshing = true
+	info, results := s.redis, s.server.refreshChannel
+	system := s.system
+	go func() {
+		results <- &RefreshResult{system: system, info: info, probe: info.Probe()}
+	}()
+}
+
+// CheckRedisAvailability uses the cached redis information to check whether
+// the current master is available and initiates a master switch if it has
+// been unavailable too often.
 func (s *FailoverState) CheckRedisAvailability() {
-	s.redis.Refresh()
+	if s.PlannedSwitchInProgress() {
+		// the planned switch either completes or times out on its own
+		return
+	}
 	if s.MasterIsAvailable() {
 		s.retries = 0
+		s.masterUnavailableSince = time.Time{}
 		if s.pinging {
 			s.StopPinging()
 			logInfo("Redis master came online while pinging")
@@ -332,11 +510,15 @@ func (s *FailoverState) CheckRedisAvailability() {
 			logInfo("Redis master came online while invalidating")
 		}
 		s.StartWatcher()
+		s.CheckSplitBrain()
 		s.MasterAvailable()
 		s.SetGCInfo()
 	} else {
 		retriesLeft := s.GetConfig().RedisMasterRetries - (s.retries + 1)
 		logWarn("Redis master not available! (Retries left: %d)", retriesLeft)
+		if s.masterUnavailableSince.IsZero() {
+			s.masterUnavailableSince = time.Now()
+		}
 		s.retries++
 		if s.retries >= s.GetConfig().RedisMasterRetries {
 			// prevent starting a new master switch while one is running
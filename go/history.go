@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event names recorded in the failover history.
+const (
+	EVENT_MASTER_UNAVAILABLE         = "master_unavailable"
+	EVENT_SWITCH_REQUESTED           = "switch_requested"
+	EVENT_PLANNED_SWITCH_STARTED     = "planned_switch_started"
+	EVENT_PING_ROUND_STARTED         = "ping_round_started"
+	EVENT_PONG_QUORUM_REACHED        = "pong_quorum_reached"
+	EVENT_INVALIDATION_STARTED       = "invalidation_started"
+	EVENT_INVALIDATED_QUORUM_REACHED = "invalidated_quorum_reached"
+	EVENT_VOTE_TIMED_OUT             = "vote_timed_out"
+	EVENT_MASTER_SWITCHED            = "master_switched"
+	EVENT_SWITCH_ABORTED             = "switch_aborted"
+	EVENT_SPLIT_BRAIN_DETECTED       = "split_brain_detected"
+	EVENT_ROGUE_MASTER_FENCED        = "rogue_master_fenced"
+	EVENT_CLIENT_APPROVED            = "client_approved"
+	EVENT_CLIENT_RETIRED             = "client_retired"
+)
+
+// HistoryEvent describes a significant event in the life of a failover set.
+type HistoryEvent struct {
+	Time      time.Time `json:"time"`
+	System    string    `json:"system"`
+	Event     string    `json:"event"`
+	Token     string    `json:"token,omitempty"`
+	ClientIds []string  `json:"client_ids,omitempty"`
+	Master    string    `json:"master,omitempty"`
+	NewMaster string    `json:"new_master,omitempty"`
+	Requester string    `json:"requester,omitempty"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// TimeHuman returns the event time in human readable form.
+func (e *HistoryEvent) TimeHuman() string {
+	return e.Time.Format(time.RFC1123)
+}
+
+// HistoryStore persists history events.
+type HistoryStore interface {
+	// Append persists a single event.
+	Append(e *HistoryEvent) error
+	// Load returns at most n of the most recent events, oldest first.
+	Load(n int) ([]HistoryEvent, error)
+}
+
+// MaxHistoryEvents limits the number of events kept in memory and loaded on
+// startup.
+const MaxHistoryEvents = 1000
+
+// FailoverHistory keeps the most recent history events in memory and
+// persists every event using a HistoryStore. It must only be accessed from
+// the dispatcher thread.
+type FailoverHistory struct {
+	events []HistoryEvent // Oldest first.
+	store  HistoryStore
+}
+
+// NewFailoverHistory creates a history persisting to the given store.
+func NewFailoverHistory(store HistoryStore) *FailoverHistory {
+	return &FailoverHistory{events: make([]HistoryEvent, 0), store: store}
+}
+
+// Load fills the in memory history from the store.
+func (h *FailoverHistory) Load() {
+	events, err := h.store.Load(MaxHistoryEvents)
+	if err != nil {
+		logError("could not load failover history: %s", err)
+		return
+	}
+	h.events = events
+	logInfo("loaded %d failover history events", len(events))
+}
+
+// Record adds an event to the history, setting its timestamp if missing.
+func (h *FailoverHistory) Record(e HistoryEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	logInfo("failover history: %s %s (token: '%s', master: '%s', new master: '%s', clients: %v, requester: '%s') %s",
+		e.System, e.Event, e.Token, e.Master, e.NewMaster, e.ClientIds, e.Requester, e.Details)
+	h.events = append(h.events, e)
+	if len(h.events) > MaxHistoryEvents {
+		h.events = h.events[len(h.events)-MaxHistoryEvents:]
+	}
+	if err := h.store.Append(&e); err != nil {
+		logError("could not persist failover history event: %s", err)
+	}
+}
+
+// Recent returns at most n events for the given system (all systems if
+// empty), newest first.
+func (h *FailoverHistory) Recent(system string, n int) []HistoryEvent {
+	res := make([]HistoryEvent, 0)
+	for i := len(h.events) - 1; i >= 0 && len(res) < n; i-- {
+		if system == "" || h.events[i].System == system {
+			res = append(res, h.events[i])
+		}
+	}
+	return res
+}
+
+// FileHistoryStore appends events as JSON lines to a local file.
+type FileHistoryStore struct {
+	path string
+}
+
+// Append writes the event to the end of the history file.
+func (fh *FileHistoryStore) Append(e *HistoryEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fh.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Load reads the last n events from the history file. A missing file is not
+// an error.
+func (fh *FileHistoryStore) Load(n int) ([]HistoryEvent, error) {
+	events := make([]HistoryEvent, 0)
+	f, err := os.Open(fh.path)
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e HistoryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			logError("ignoring invalid failover history line: %s", scanner.Text())
+			continue
+		}
+		events = append(events, e)
+		if len(events) > n {
+			events = events[1:]
+		}
+	}
+	return events, scanner.Err()
+}
+
+// RedisHistoryKey is the name of the redis list holding history events.
+const RedisHistoryKey = "beetle:failover-history"
+
+// maxRedisHistoryEvents limits the length of the history list in redis.
+const maxRedisHistoryEvents = 10000
+
+// RedisHistoryStore stores events in a list on the current redis master of
+// the system an event belongs to. Events are written by a separate go routine,
+// so that the dispatcher does not block on masters which have just become
+// unavailable. Events which cannot be written are kept and written along with
+// the next event for that system.
+type RedisHistoryStore struct {
+	server  *ServerState
+	writes  chan historyWrite   // Events queued for the writer go routine.
+	start   sync.Once           // Starts the writer go routine on the first event.
+	pending map[string][]string // Serialized events per system which could not be written yet. Only accessed by the writer.
+}
+
+// historyWrite is an event queued for writing to the given master.
+type historyWrite struct {
+	system string
+	master *RedisShim
+	data   string
+}
+
+// NewRedisHistoryStore creates a history store using the redis masters of the
+// given server.
+func NewRedisHistoryStore(server *ServerState) *RedisHistoryStore {
+	return &RedisHistoryStore{server: server, writes: make(chan historyWrite, MaxHistoryEvents), pending: make(map[string][]string)}
+}
+
+// Append queues the event for the current master of its system. Must be
+// called on the dispatcher thread.
+func (rh *RedisHistoryStore) Append(e *HistoryEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	rh.start.Do(func() { go rh.writer() })
+	w := historyWrite{system: e.System, data: string(data)}
+	if fs := rh.server.failovers[e.System]; fs != nil {
+		w.master = fs.currentMaster
+	}
+	select {
+	case rh.writes <- w:
+		return nil
+	default:
+		return fmt.Errorf("history writer is falling behind, dropped event for system '%s'", e.System)
+	}
+}
+
+func (rh *RedisHistoryStore) writer() {
+	for w := range rh.writes {
+		if err := rh.write(w); err != nil {
+			logError("could not persist failover history event: %s", err)
+		}
+	}
+}
+
+// write pushes the event and all pending events of the same system onto the
+// history list of the given master.
+func (rh *RedisHistoryStore) write(w historyWrite) error {
+	pending := append(rh.pending[w.system], w.data)
+	rh.pending[w.system] = pending
+	if w.master == nil {
+		return fmt.Errorf("no redis master for system '%s', %d events pending", w.system, len(pending))
+	}
+	values := make([]interface{}, len(pending))
+	for i, v := range pending {
+		values[i] = v
+	}
+	if err := w.master.redis.LPush(RedisHistoryKey, values...).Err(); err != nil {
+		if len(pending) > MaxHistoryEvents {
+			rh.pending[w.system] = pending[len(pending)-MaxHistoryEvents:]
+		}
+		return fmt.Errorf("could not write to '%s', %d events pending: %s", w.master.server, len(pending), err)
+	}
+	delete(rh.pending, w.system)
+	w.master.redis.LTrim(RedisHistoryKey, 0, maxRedisHistoryEvents-1)
+	return nil
+}
+
+// Load reads the most recent events from the masters of all systems and
+// merges them by time.
+func (rh *RedisHistoryStore) Load(n int) ([]HistoryEvent, error) {
+	events := make([]HistoryEvent, 0)
+	for _, system := range rh.server.systemNames {
+		fs := rh.server.failovers[system]
+		if fs == nil || fs.currentMaster == nil {
+			continue
+		}
+		values, err := fs.currentMaster.redis.LRange(RedisHistoryKey, 0, int64(n-1)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			var e HistoryEvent
+			if err := json.Unmarshal([]byte(v), &e); err != nil {
+				logError("ignoring invalid failover history entry: %s", v)
+				continue
+			}
+			// systems sharing a redis server also share the list
+			if e.System == system {
+				events = append(events, e)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if len(events) > n {
+		events = events[len(events)-n:]
+	}
+	return events, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileHistoryStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	store := &FileHistoryStore{path: path}
+	events, err := store.Load(10)
+	if err != nil {
+		t.Fatalf("loading missing history file failed: %s", err)
+	}
+	checkEqual(t, len(events), 0)
+
+	h := NewFailoverHistory(store)
+	h.Record(HistoryEvent{System: "a", Event: EVENT_MASTER_UNAVAILABLE, Master: "127.0.0.1:7001"})
+	h.Record(HistoryEvent{System: "a", Event: EVENT_PONG_QUORUM_REACHED, ClientIds: []string{"1", "2"}})
+	h.Record(HistoryEvent{System: "a", Event: EVENT_MASTER_SWITCHED, NewMaster: "127.0.0.1:7002"})
+
+	events, err = store.Load(2)
+	if err != nil {
+		t.Fatalf("loading history failed: %s", err)
+	}
+	checkEqual(t, len(events), 2)
+	checkEqual(t, events[0].Event, EVENT_PONG_QUORUM_REACHED)
+	checkEqual(t, events[0].ClientIds, []string{"1", "2"})
+	checkEqual(t, events[1].NewMaster, "127.0.0.1:7002")
+	if events[1].Time.IsZero() {
+		t.Errorf("event time was not recorded")
+	}
+}
+
+func TestFileHistoryStoreIgnoresInvalidLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	err := os.WriteFile(path, []byte("garbage\n{\"system\":\"a\",\"event\":\"master_switched\"}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := (&FileHistoryStore{path: path}).Load(10)
+	if err != nil {
+		t.Fatalf("loading history failed: %s", err)
+	}
+	checkEqual(t, len(events), 1)
+	checkEqual(t, events[0].Event, EVENT_MASTER_SWITCHED)
+}
+
+func TestFailoverHistoryRecent(t *testing.T) {
+	h := NewFailoverHistory(&FileHistoryStore{path: filepath.Join(t.TempDir(), "history.log")})
+	now := time.Now()
+	h.Record(HistoryEvent{Time: now, System: "a", Event: EVENT_MASTER_UNAVAILABLE})
+	h.Record(HistoryEvent{Time: now.Add(time.Second), System: "b", Event: EVENT_MASTER_UNAVAILABLE})
+	h.Record(HistoryEvent{Time: now.Add(2 * time.Second), System: "a", Event: EVENT_MASTER_SWITCHED})
+
+	all := h.Recent("", 10)
+	checkEqual(t, len(all), 3)
+	checkEqual(t, all[0].Event, EVENT_MASTER_SWITCHED)
+	checkEqual(t, all[2].System, "a")
+
+	a := h.Recent("a", 10)
+	checkEqual(t, len(a), 2)
+	checkEqual(t, a[0].Event, EVENT_MASTER_SWITCHED)
+	checkEqual(t, a[1].Event, EVENT_MASTER_UNAVAILABLE)
+
+	checkEqual(t, len(h.Recent("a", 1)), 1)
+	checkEqual(t, len(h.Recent("c", 10)), 0)
+}
+
+func TestRedisHistoryStoreDoesNotBlockOnUnavailableMasters(t *testing.T) {
+	s := NewServerState(serverTestOptions)
+	// a non routable address makes connection attempts hang until they time out
+	s.failovers["beetle"].currentMaster = NewRedisShim("10.255.255.1:6379")
+	store := NewRedisHistoryStore(s)
+	started := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := store.Append(&HistoryEvent{System: "beetle", Event: EVENT_MASTER_UNAVAILABLE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("appending history events blocked for %s", elapsed)
+	}
+}
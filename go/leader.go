@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xing/beetle/consul"
+)
+
+// LeaderElector decides which of several configuration server instances is
+// the leader.
+type LeaderElector interface {
+	// Campaign acquires or renews the leadership if possible. Returns whether
+	// this instance is the leader and the advertised address of the current
+	// leader (empty if unknown).
+	Campaign() (bool, string, error)
+	// Resign gives up the leadership.
+	Resign() error
+}
+
+// NewLeaderElector creates the leader elector selected in the configuration.
+// Returns nil if leader election is disabled.
+func NewLeaderElector(s *ServerState) LeaderElector {
+	config := s.GetConfig()
+	ttl := time.Duration(config.LeaderTTL) * time.Second
+	address := config.AdvertiseAddress
+	if address == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logError("could not determine hostname: %s", err)
+		}
+		address = fmt.Sprintf("%s:%d", hostname, config.Port)
+	}
+	switch config.LeaderElection {
+	case "":
+		return nil
+	case "consul":
+		if s.opts.ConsulClient == nil {
+			logError("consul leader election configured, but no consul url given")
+			os.Exit(1)
+		}
+		return &ConsulLeaderElector{client: s.opts.ConsulClient, address: address, ttl: ttl}
+	case "file":
+		if config.LeaderLockFile == "" {
+			logError("file based leader election configured, but no lock file given")
+			os.Exit(1)
+		}
+		return &FileLeaderElector{path: config.LeaderLockFile, address: address, ttl: ttl}
+	default:
+		logError("unknown leader election method: %s", config.LeaderElection)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// ConsulLeaderElector holds the leadership as long as it holds a lock in
+// consul, which is bound to a session with a TTL.
+type ConsulLeaderElector struct {
+	client  *consul.Client
+	address string
+	ttl     time.Duration
+	session string
+}
+
+// Campaign renews our session (creating a new one if necessary) and tries to
+// acquire the lock.
+func (e *ConsulLeaderElector) Campaign() (bool, string, error) {
+	if e.session != "" {
+		if err := e.client.RenewSession(e.session); err != nil {
+			if err != consul.ErrSessionNotFound {
+				return false, "", err
+			}
+			logWarn("consul session %s expired", e.session)
+			e.session = ""
+		}
+	}
+	if e.session == "" {
+		id, err := e.client.CreateSession("beetle configuration server "+e.address, e.ttl)
+		if err != nil {
+			return false, "", err
+		}
+		e.session = id
+	}
+	key := e.client.LockKey()
+	acquired, err := e.client.AcquireLock(key, e.session, e.address)
+	if err != nil {
+		return false, "", err
+	}
+	if acquired {
+		return true, e.address, nil
+	}
+	holder, err := e.client.LockHolder(key)
+	return false, holder, err
+}
+
+// Resign releases the lock and destroys the session.
+func (e *ConsulLeaderElector) Resign() error {
+	if e.session == "" {
+		return nil
+	}
+	if err := e.client.ReleaseLock(e.client.LockKey(), e.session); err != nil {
+		return err
+	}
+	err := e.client.DestroySession(e.session)
+	e.session = ""
+	return err
+}
+
+// FileLeaderElector is a stand-in for the consul elector, using a lock file
+// containing the address of the leader. The leader renews the lock by touching
+// the file. A lock which has not been renewed within the TTL may be taken
+// over. Taking over is not atomic: servers taking over the same stale lock at
+// the same time may all consider themselves leader until their next campaign.
+// Only use it for tests.
+type FileLeaderElector struct {
+	path    string
+	address string
+	ttl     time.Duration
+}
+
+// Campaign acquires the lock file if it does not exist or is stale, or
+// renews it if we hold it.
+func (e *FileLeaderElector) Campaign() (bool, string, error) {
+	data, err := os.ReadFile(e.path)
+	if os.IsNotExist(err) {
+		return e.create()
+	}
+	if err != nil {
+		return false, "", err
+	}
+	holder := strings.TrimSpace(string(data))
+	if holder == e.address {
+		now := time.Now()
+		return true, e.address, os.Chtimes(e.path, now, now)
+	}
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, holder, err
+	}
+	if time.Since(info.ModTime()) <= e.ttl {
+		return false, holder, nil
+	}
+	logWarn("taking over stale leader lock of %s", holder)
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		return false, holder, err
+	}
+	return e.create()
+}
+
+func (e *FileLeaderElector) create() (bool, string, error) {
+	f, err := os.OpenFile(e.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		// somebody else was faster, we'll learn who on the next campaign
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	defer f.Close()
+	if _, err = f.WriteString(e.address + "\n"); err != nil {
+		return false, "", err
+	}
+	return true, e.address, f.Sync()
+}
+
+// Resign removes the lock file if we hold it.
+func (e *FileLeaderElector) Resign() error {
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if strings.TrimSpace(string(data)) != e.address {
+		return nil
+	}
+	return os.Remove(e.path)
+}
+
+// Leadership returns whether this server is the leader and the address of the
+// current leader. Safe to call from any thread.
+func (s *ServerState) Leadership() (bool, string) {
+	s.leaderMutex.Lock()
+	defer s.leaderMutex.Unlock()
+	return s.leader, s.leaderAddress
+}
+
+// IsLeader returns whether this server is the leader. Safe to call from any
+// thread.
+func (s *ServerState) IsLeader() bool {
+	leader, _ := s.Leadership()
+	return leader
+}
+
+// runLeaderElection campaigns for leadership until interrupted. The campaign
+// interval is a third of the leader TTL. Before taking over, the information
+// needed by the new leader is gathered here, so that the dispatcher does not
+// block on network I/O. If the takeover fails, the leadership is given up
+// again, so that another server can take over.
+func (s *ServerState) runLeaderElection() {
+	interval := time.Duration(s.GetConfig().LeaderTTL) * time.Second / 3
+	for !interrupted {
+		leader, address, err := s.elector.Campaign()
+		if err != nil {
+			// we cannot know whether we still hold the lock, so we must
+			// assume we don't
+			logError("leader election failed: %s", err)
+			leader = false
+		}
+		var takeover *LeaderTakeover
+		if leader && !s.IsLeader() {
+			takeover = s.prepareTakeover()
+		}
+		s.Evaluate(func() {
+			err = s.SetLeadership(leader, address, takeover)
+		})
+		if err != nil {
+			logError("could not take over leadership: %s", err)
+			if err := s.elector.Resign(); err != nil {
+				logError("could not resign leadership: %s", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+	if err := s.elector.Resign(); err != nil {
+		logError("could not resign leadership: %s", err)
+	}
+}
+
+// LeaderTakeover holds the redis information and the state persisted by the
+// previous leader, gathered off the dispatcher before taking over.
+type LeaderTakeover struct {
+	infos  map[string]*RedisServerInfo // The redis info of every system, probes are discarded if it has been replaced meanwhile.
+	probes map[string]RedisProbe
+	state  *PersistentState
+	err    error // Error loading the state.
+}
+
+// prepareTakeover probes the redis servers of all systems and loads the state
+// persisted by the previous leader. Must not be called on the dispatcher.
+func (s *ServerState) prepareTakeover() *LeaderTakeover {
+	t := &LeaderTakeover{infos: make(map[string]*RedisServerInfo), probes: make(map[string]RedisProbe)}
+	var sources map[string]RedisShims
+	s.Evaluate(func() {
+		for system, fs := range s.failovers {
+			t.infos[system] = fs.redis
+		}
+		sources = s.stateSources()
+	})
+	for system, info := range t.infos {
+		t.probes[system] = info.Probe()
+	}
+	t.state, t.err = s.stateStore.Load(sources)
+	return t
+}
+
+// SetLeadership records the election result, taking over or stepping down as
+// necessary. Returns an error if taking over failed, in which case this server
+// remains a follower.
+func (s *ServerState) SetLeadership(leader bool, address string, takeover *LeaderTakeover) error {
+	s.leaderMutex.Lock()
+	wasLeader := s.leader
+	s.leader = leader
+	s.leaderAddress = address
+	s.leaderMutex.Unlock()
+	if leader && !wasLeader {
+		if err := s.BecomeLeader(takeover); err != nil {
+			s.leaderMutex.Lock()
+			s.leader = false
+			s.leaderAddress = ""
+			s.leaderMutex.Unlock()
+			return err
+		}
+	} else if !leader && wasLeader {
+		s.StepDown()
+	}
+	return nil
+}
+
+// BecomeLeader takes over from the previous leader, resuming from the
+// persisted state.
+func (s *ServerState) BecomeLeader(t *LeaderTakeover) error {
+	if t == nil {
+		return fmt.Errorf("no takeover information gathered")
+	}
+	for system, fs := range s.failovers {
+		if t.infos[system] == fs.redis {
+			fs.redis.Apply(t.probes[system])
+		}
+	}
+	if err := s.initializeLeader(s.RestoreState(t.state, t.err)); err != nil {
+		msg := fmt.Sprintf("Configuration server could not take over leadership: %s", err)
+		s.SendNotification(&Notification{Type: NOTIFICATION_LEADER_CHANGED, Severity: SEVERITY_ERROR, Text: msg})
+		return err
+	}
+	msg := "Configuration server became leader"
+	logWarn(msg)
+	s.SendNotification(&Notification{Type: NOTIFICATION_LEADER_CHANGED, Severity: SEVERITY_WARNING, Text: msg})
+	return nil
+}
+
+// StepDown stops all running elections and closes all websocket connections,
+// so that clients reconnect and get redirected to the new leader.
+func (s *ServerState) StepDown() {
+	msg := "Configuration server lost leadership"
+	logWarn(msg)
+	s.SendNotification(&Notification{Type: NOTIFICATION_LEADER_CHANGED, Severity: SEVERITY_WARNING, Text: msg})
+	for _, fs := range s.failovers {
+		if fs.PlannedSwitchInProgress() {
+			fs.AbortPlannedSwitch("lost leadership")
+		} else if fs.pinging || fs.invalidating {
+			fs.CancelInvalidation()
+		}
+	}
+	s.closeConnections()
+}
+
+// FollowLeader updates the read-only view of a follower from the state
+// persisted by the leader and the cached redis information. Used on startup,
+// afterwards the view is updated in the background by StartFollowLeader.
+func (s *ServerState) FollowLeader() {
+	s.ApplyLeaderState(s.stateStore.Load(s.stateSources()))
+}
+
+// StartFollowLeader loads the state persisted by the leader in the background
+// and applies it on the dispatcher, unless a load is already running.
+func (s *ServerState) StartFollowLeader() {
+	if s.following {
+		return
+	}
+	s.following = true
+	sources := s.stateSources()
+	go func() {
+		state, err := s.stateStore.Load(sources)
+		s.Evaluate(func() {
+			s.following = false
+			if !s.IsLeader() {
+				s.ApplyLeaderState(state, err)
+			}
+		})
+	}()
+}
+
+// ApplyLeaderState updates the read-only view of a follower from the state
+// persisted by the leader. Systems missing in the state get their master auto
+// detected from the cached redis information.
+func (s *ServerState) ApplyLeaderState(state *PersistentState, err error) {
+	if err != nil {
+		logError("could not load state of leader: %s", err)
+	}
+	for system, fs := range s.failovers {
+		if state != nil && state.Masters[system] != "" {
+			if fs.currentMaster == nil || fs.currentMaster.server != state.Masters[system] {
+				fs.followMaster(state.Masters[system])
+			}
+		} else if fs.currentMaster == nil {
+			fs.currentMaster = fs.redis.AutoDetectMaster()
+		}
+	}
+	if state != nil {
+		for id, t := range state.ClientsLastSeen {
+			if t.After(s.clientsLastSeen[id]) {
+				s.clientsLastSeen[id] = t
+			}
+		}
+		s.restoreClientRegistrations(state)
+	}
+}
+
+func (s *ServerState) addConnection(ws *websocket.Conn) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	s.connections[ws] = true
+}
+
+func (s *ServerState) removeConnection(ws *websocket.Conn) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	delete(s.connections, ws)
+}
+
+// closeConnections closes all websocket connections. Readers notice and
+// clean up as usual.
+func (s *ServerState) closeConnections() {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	for ws := range s.connections {
+		ws.Close()
+	}
+}
+
+// redirectToLeader redirects requests which must be handled by the leader,
+// if this server is a follower. Returns true if the request has been handled.
+func (s *ServerState) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if s.elector == nil {
+		return false
+	}
+	scheme := s.GetConfig().HTTPScheme()
+	switch {
+	case r.URL.Path == "/configuration" || r.URL.Path == "/notifications":
+		scheme = s.GetConfig().WebSocketScheme()
+	case r.URL.Path == "/initiate_master_switch" || r.URL.Path == "/fence_rogue_masters" || r.URL.Path == "/approve_client" || r.URL.Path == "/retire_client" || strings.HasPrefix(r.URL.Path, "/api/"):
+	default:
+		return false
+	}
+	leader, address := s.Leadership()
+	if leader {
+		return false
+	}
+	if address == "" {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return true
+	}
+	u := url.URL{Scheme: scheme, Host: address, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	logDebug("redirecting %s to leader: %s", r.URL.Path, u.String())
+	http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// maxLeaderRedirects limits the number of redirects followed when dialing.
+const maxLeaderRedirects = 3
+
+// dialWebSocket dials the given url, following redirects from configuration
+// servers which are not the leader.
+func dialWebSocket(dialer *websocket.Dialer, url string) (*websocket.Conn, error) {
+	for i := 0; i <= maxLeaderRedirects; i++ {
+		ws, resp, err := dialer.Dial(url, nil)
+		if err == websocket.ErrBadHandshake && resp != nil && resp.StatusCode == http.StatusTemporaryRedirect {
+			if location := resp.Header.Get("Location"); location != "" {
+				logInfo("redirected to leader: %s", location)
+				url = location
+				continue
+			}
+		}
+		return ws, err
+	}
+	return nil, fmt.Errorf("too many redirects")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLeaderElector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a := &FileLeaderElector{path: path, address: "a:9650", ttl: time.Minute}
+	b := &FileLeaderElector{path: path, address: "b:9650", ttl: time.Minute}
+
+	leader, address, err := a.Campaign()
+	if err != nil || !leader || address != "a:9650" {
+		t.Fatalf("a should have become leader, got %v, %q, %v", leader, address, err)
+	}
+	leader, address, err = b.Campaign()
+	if err != nil || leader || address != "a:9650" {
+		t.Fatalf("b should follow a, got %v, %q, %v", leader, address, err)
+	}
+	leader, _, err = a.Campaign()
+	if err != nil || !leader {
+		t.Fatalf("a should have kept the leadership, got %v, %v", leader, err)
+	}
+
+	if err = b.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("a follower must not remove the lock: %s", err)
+	}
+	if err = a.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	leader, address, err = b.Campaign()
+	if err != nil || !leader || address != "b:9650" {
+		t.Fatalf("b should have become leader, got %v, %q, %v", leader, address, err)
+	}
+}
+
+func TestFileLeaderElectorTakesOverStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a := &FileLeaderElector{path: path, address: "a:9650", ttl: time.Minute}
+	b := &FileLeaderElector{path: path, address: "b:9650", ttl: time.Minute}
+	if leader, _, _ := a.Campaign(); !leader {
+		t.Fatal("a should have become leader")
+	}
+	past := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+	leader, address, err := b.Campaign()
+	if err != nil || !leader || address != "b:9650" {
+		t.Fatalf("b should have taken over, got %v, %q, %v", leader, address, err)
+	}
+	leader, address, _ = a.Campaign()
+	if leader || address != "b:9650" {
+		t.Fatalf("a should follow b, got %v, %q", leader, address)
+	}
+}
+
+func TestFollowerRedirectsToLeader(t *testing.T) {
+	s := NewServerState(serverTestOptions)
+	s.elector = &FileLeaderElector{path: filepath.Join(t.TempDir(), "leader.lock"), address: "me:9650", ttl: time.Minute}
+	s.leader = false
+
+	w := httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/configuration", nil))
+	checkEqual(t, w.Code, http.StatusServiceUnavailable)
+
+	s.leaderAddress = "leader:9650"
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/configuration", nil))
+	checkEqual(t, w.Code, http.StatusTemporaryRedirect)
+	checkEqual(t, w.Header().Get("Location"), "ws://leader:9650/configuration")
+
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("POST", "/api/systems/beetle/switch?x=1", nil))
+	checkEqual(t, w.Code, http.StatusTemporaryRedirect)
+	checkEqual(t, w.Header().Get("Location"), "http://leader:9650/api/systems/beetle/switch?x=1")
+
+	s.leader = true
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/api/systems/beetle/switch", nil))
+	checkEqual(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+func newTakeoverTestServer(t *testing.T) *ServerState {
+	s := NewServerState(serverTestOptions)
+	s.elector = &FileLeaderElector{path: filepath.Join(t.TempDir(), "leader.lock"), address: "me:9650", ttl: time.Minute}
+	s.leader = false
+	return s
+}
+
+func TestFailedTakeoverKeepsServerFollowing(t *testing.T) {
+	s := newTakeoverTestServer(t)
+	fs := s.failovers["beetle"]
+	takeover := &LeaderTakeover{
+		infos:  map[string]*RedisServerInfo{"beetle": fs.redis},
+		probes: map[string]RedisProbe{"beetle": {}},
+		state:  NewPersistentState(),
+	}
+	if err := s.SetLeadership(true, "me:9650", takeover); err == nil {
+		t.Fatal("taking over without a known master should fail")
+	}
+	leader, address := s.Leadership()
+	checkEqual(t, leader, false)
+	checkEqual(t, address, "")
+}
+
+func TestTakeoverUsesGatheredInformation(t *testing.T) {
+	s := newTakeoverTestServer(t)
+	fs := s.failovers["beetle"]
+	takeover := &LeaderTakeover{
+		infos: map[string]*RedisServerInfo{"beetle": fs.redis},
+		probes: map[string]RedisProbe{"beetle": {
+			"127.0.0.1:7001": {"role": MASTER},
+			"127.0.0.1:7002": {"role": SLAVE, "master_host": "127.0.0.1", "master_port": "7001"},
+		}},
+		state: NewPersistentState(),
+	}
+	takeover.state.Tokens["beetle"] = fs.currentTokenInt + 10
+	checkEqual(t, s.SetLeadership(true, "me:9650", takeover), nil)
+	checkEqual(t, s.IsLeader(), true)
+	checkEqual(t, fs.currentMaster.server, "127.0.0.1:7001")
+	checkEqual(t, fs.currentTokenInt, takeover.state.Tokens["beetle"])
+}
+
+func TestFollowerReusesConnectionsOfConfiguredServers(t *testing.T) {
+	s := newTakeoverTestServer(t)
+	fs := s.failovers["beetle"]
+	state := NewPersistentState()
+	state.Masters["beetle"] = "127.0.0.1:7002"
+	s.ApplyLeaderState(state, nil)
+	checkEqual(t, fs.currentMaster == fs.redis.Instance("127.0.0.1:7002"), true)
+	state.Masters["beetle"] = "127.0.0.1:7001"
+	s.ApplyLeaderState(state, nil)
+	checkEqual(t, fs.currentMaster == fs.redis.Instance("127.0.0.1:7001"), true)
+}
@@ -36,9 +36,12 @@ func logWarn(format string, args ...interface{}) {
 }
 
 func (s *ServerState) statsReporter() {
+	var last int64
 	for !interrupted {
 		time.Sleep(1 * time.Second)
-		msgCount := atomic.SwapInt64(&processed, 0)
+		total := atomic.LoadInt64(&processed)
+		msgCount := total - last
+		last = total
 		connCount := atomic.LoadInt64(&wsConnections)
 		logInfo("processed: %d, ws connections: %d", msgCount, connCount)
 	}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xing/beetle/backoff"
+)
+
+// Retry delays for spooled mails.
+const (
+	MAIL_SPOOL_RETRY_MIN = 10 * time.Second
+	MAIL_SPOOL_RETRY_MAX = 10 * time.Minute
+)
+
+// SpoolEntry is a notification which could not be mailed yet.
+type SpoolEntry struct {
+	Id           string        `json:"id"`
+	Queued       time.Time     `json:"queued"`
+	Attempts     int           `json:"attempts"`
+	LastError    string        `json:"last_error,omitempty"`
+	Notification *Notification `json:"notification"`
+}
+
+// MailSpool keeps notifications which could not be mailed, in order, and
+// retries them with exponential backoff until the mail relay accepts them or
+// they exceed the maximum age. Entries are stored as one JSON file each in the
+// spool directory, so that they survive restarts of the mailer. If the spool
+// directory cannot be used, entries are only kept in memory. The spool is
+// only used from the mailer goroutine and therefore not thread safe.
+type MailSpool struct {
+	dir         string
+	maxAge      time.Duration
+	entries     []*SpoolEntry
+	retry       backoff.Backoff
+	nextAttempt time.Time
+}
+
+// NewMailSpool creates the spool directory, if necessary, and loads all
+// entries left over from previous runs.
+func NewMailSpool(dir string, maxAge time.Duration) *MailSpool {
+	s := &MailSpool{
+		dir:    dir,
+		maxAge: maxAge,
+		retry:  backoff.Backoff{Min: MAIL_SPOOL_RETRY_MIN, Max: MAIL_SPOOL_RETRY_MAX},
+	}
+	if dir == "" {
+		return s
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logError("could not create mail spool directory, spooling in memory only: %s", err)
+		s.dir = ""
+		return s
+	}
+	if err := checkWritable(dir); err != nil {
+		logError("mail spool directory is not writable, spooling in memory only: %s", err)
+		s.dir = ""
+		return s
+	}
+	s.load()
+	if len(s.entries) > 0 {
+		logInfo("loaded %d spooled notifications from %s", len(s.entries), dir)
+	}
+	return s
+}
+
+// checkWritable verifies that files can be created in the given directory.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (s *MailSpool) load() {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		logError("could not read mail spool: %s", err)
+		return
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			logError("could not read spooled notification: %s", err)
+			continue
+		}
+		e := &SpoolEntry{}
+		if err := json.Unmarshal(b, e); err != nil || e.Notification == nil {
+			logError("discarding invalid spooled notification %s", path)
+			os.Remove(path)
+			continue
+		}
+		e.Id = strings.TrimSuffix(filepath.Base(path), ".json")
+		s.entries = append(s.entries, e)
+	}
+}
+
+func (s *MailSpool) path(e *SpoolEntry) string {
+	return filepath.Join(s.dir, e.Id+".json")
+}
+
+func (s *MailSpool) save(e *SpoolEntry) {
+	if s.dir == "" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = writeFileAtomically(s.path(e), b)
+	}
+	if err != nil {
+		logError("could not spool notification to disk: %s", err)
+	}
+}
+
+func (s *MailSpool) remove(e *SpoolEntry) {
+	if s.dir == "" {
+		return
+	}
+	if err := os.Remove(s.path(e)); err != nil && !os.IsNotExist(err) {
+		logError("could not remove spooled notification: %s", err)
+	}
+}
+
+// Add spools a notification which could not be mailed because of the given
+// transient error. The error is nil for notifications spooled to preserve the
+// order while older ones are waiting.
+func (s *MailSpool) Add(n *Notification, err error, now time.Time) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	e := &SpoolEntry{
+		Id:           fmt.Sprintf("%019d-%s", now.UnixNano(), hex.EncodeToString(b)),
+		Queued:       now,
+		Notification: n,
+	}
+	if err != nil {
+		e.Attempts = 1
+		e.LastError = err.Error()
+	}
+	s.entries = append(s.entries, e)
+	s.save(e)
+	if len(s.entries) == 1 {
+		s.nextAttempt = now.Add(s.retry.Next())
+	}
+	logWarn("spooled notification, mail spool size: %d", len(s.entries))
+}
+
+// Size returns the number of spooled notifications.
+func (s *MailSpool) Size() int {
+	return len(s.entries)
+}
+
+// Oldest returns the time the oldest spooled notification has been queued.
+func (s *MailSpool) Oldest() time.Time {
+	if len(s.entries) == 0 {
+		return time.Time{}
+	}
+	return s.entries[0].Queued
+}
+
+// Due checks whether spooled notifications should be retried.
+func (s *MailSpool) Due(now time.Time) bool {
+	return len(s.entries) > 0 && !now.Before(s.nextAttempt)
+}
+
+// Flush tries to send all spooled notifications in order, dropping those
+// older than the maximum age and those failing permanently. Notifications the
+// relay refuses temporarily stay spooled without holding back the following
+// ones. If the relay cannot be reached, the remaining notifications are kept
+// and the next attempt is scheduled. Returns the number of notifications
+// sent.
+func (s *MailSpool) Flush(send func(*Notification) error, now time.Time) int {
+	sent := 0
+	kept := make([]*SpoolEntry, 0, len(s.entries))
+	unavailable := false
+	for _, e := range s.entries {
+		if unavailable {
+			kept = append(kept, e)
+			continue
+		}
+		if s.maxAge > 0 && now.Sub(e.Queued) > s.maxAge {
+			logError("dropping spooled notification after %d attempts: %s", e.Attempts, e.Notification.Text)
+			s.remove(e)
+			continue
+		}
+		e.Attempts++
+		err := send(e.Notification)
+		switch {
+		case err == nil:
+			s.remove(e)
+			sent++
+		case !IsTransientMailError(err):
+			logError("dropping spooled notification, mail relay refused it permanently: %s: %s", err, e.Notification.Text)
+			s.remove(e)
+		default:
+			e.LastError = err.Error()
+			s.save(e)
+			kept = append(kept, e)
+			unavailable = !IsMailRelayReply(err)
+		}
+	}
+	s.entries = kept
+	if sent > 0 {
+		logInfo("flushed mail spool, sent %d notifications", sent)
+	}
+	if len(s.entries) == 0 {
+		s.retry.Reset()
+		return sent
+	}
+	delay := s.retry.Next()
+	s.nextAttempt = now.Add(delay)
+	logWarn("%d notifications still spooled, retrying in %s", len(s.entries), delay)
+	return sent
+}
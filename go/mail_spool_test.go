@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMailSpoolPersistsEntries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	spool := NewMailSpool(dir, time.Hour)
+	now := time.Now()
+	spool.Add(NewTextNotification("first"), errors.New("connection refused"), now)
+	spool.Add(NewTextNotification("second"), nil, now.Add(time.Millisecond))
+	checkEqual(t, spool.Size(), 2)
+
+	spool = NewMailSpool(dir, time.Hour)
+	checkEqual(t, spool.Size(), 2)
+	checkEqual(t, spool.entries[0].Notification.Text, "first")
+	checkEqual(t, spool.entries[0].Attempts, 1)
+	checkEqual(t, spool.entries[0].LastError, "connection refused")
+	checkEqual(t, spool.entries[1].Notification.Text, "second")
+	checkEqual(t, spool.Due(now), true)
+
+	var sent []string
+	checkEqual(t, spool.Flush(func(n *Notification) error { sent = append(sent, n.Text); return nil }, now), 2)
+	checkEqual(t, sent, []string{"first", "second"})
+	checkEqual(t, NewMailSpool(dir, time.Hour).Size(), 0)
+}
+
+func TestMailSpoolDirDefaultsToTemporaryDirectory(t *testing.T) {
+	c := (&Config{}).SetDefaults()
+	checkEqual(t, c.MailSpoolDir, filepath.Join(os.TempDir(), "beetle-mail-spool"))
+}
+
+func TestMailSpoolFallsBackToMemory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	spool := NewMailSpool(filepath.Join(file, "spool"), time.Hour)
+	checkEqual(t, spool.dir, "")
+	spool.Add(NewTextNotification("first"), errors.New("down"), time.Now())
+	checkEqual(t, spool.Size(), 1)
+}
+
+func TestMailSpoolRetriesWithBackoff(t *testing.T) {
+	spool := NewMailSpool("", time.Hour)
+	now := time.Now()
+	spool.Add(NewTextNotification("first"), errors.New("down"), now)
+	checkEqual(t, spool.Due(now), false)
+	checkEqual(t, spool.Due(now.Add(MAIL_SPOOL_RETRY_MIN)), true)
+
+	attempts := 0
+	failing := func(n *Notification) error { attempts++; return errors.New("still down") }
+	later := now.Add(MAIL_SPOOL_RETRY_MIN)
+	checkEqual(t, spool.Flush(failing, later), 0)
+	checkEqual(t, attempts, 1)
+	checkEqual(t, spool.Size(), 1)
+	checkEqual(t, spool.entries[0].Attempts, 2)
+	checkEqual(t, spool.entries[0].LastError, "still down")
+	checkEqual(t, spool.Due(later.Add(MAIL_SPOOL_RETRY_MIN/2-time.Second)), false)
+	checkEqual(t, spool.Due(later.Add(2*MAIL_SPOOL_RETRY_MIN)), true)
+}
+
+func TestMailSpoolDropsExpiredEntries(t *testing.T) {
+	spool := NewMailSpool("", time.Hour)
+	now := time.Now()
+	spool.Add(NewTextNotification("old"), errors.New("down"), now.Add(-2*time.Hour))
+	spool.Add(NewTextNotification("new"), nil, now)
+	var sent []string
+	spool.Flush(func(n *Notification) error { sent = append(sent, n.Text); return nil }, now)
+	checkEqual(t, sent, []string{"new"})
+	checkEqual(t, spool.Size(), 0)
+}
+
+func TestMailSinkSpoolsUndeliverableMails(t *testing.T) {
+	config := &Config{MailSpoolDir: filepath.Join(t.TempDir(), "spool"), MailSpoolMaxAge: 3600, MailDedupWindow: -1}
+	health := NewMailerHealth()
+	health.Connected(true, nil)
+	sink := NewMailSink(&MailerOptions{Config: config}, health)
+	relayDown := true
+	var sent []string
+	sink.sendMail = func(n *Notification) error {
+		if relayDown {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, n.Text)
+		return nil
+	}
+	sink.Deliver(unavailable("127.0.0.1:7001"))
+	sink.Deliver(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, Text: "unknown"})
+	checkEqual(t, len(sent), 0)
+	checkEqual(t, sink.spool.Size(), 2)
+	relayDown = false
+
+	status := health.Status()
+	checkEqual(t, status.Healthy, false)
+	checkEqual(t, status.SpoolSize, 2)
+	checkEqual(t, status.SpoolOldest != nil, true)
+
+	sink.Tick(time.Now().Add(MAIL_SPOOL_RETRY_MAX))
+	checkEqual(t, sent, []string{"Redis master '127.0.0.1:7001' not available", "unknown"})
+	checkEqual(t, health.Status().Healthy, true)
+	checkEqual(t, health.Status().SpoolSize, 0)
+}
+
+func TestMailSinkRetriesSpoolOnMasterSwitch(t *testing.T) {
+	sink := NewMailSink(&MailerOptions{Config: &Config{}}, NewMailerHealth())
+	relayDown := true
+	var sent []string
+	sink.sendMail = func(n *Notification) error {
+		if relayDown {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, n.Text)
+		return nil
+	}
+	sink.Deliver(unavailable("127.0.0.1:7001"))
+	relayDown = false
+	sink.Deliver(&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, Text: "switched"})
+	checkEqual(t, sent, []string{"Redis master '127.0.0.1:7001' not available", "switched"})
+}
+
+func TestMailSinkDropsPermanentlyFailingMails(t *testing.T) {
+	sink := NewMailSink(&MailerOptions{Config: &Config{MailDedupWindow: -1}}, NewMailerHealth())
+	sink.sendMail = func(n *Notification) error {
+		return permanentMailError{errors.New("unsupported mail relay TLS mode: ssl")}
+	}
+	sink.Deliver(unavailable("127.0.0.1:7001"))
+	checkEqual(t, sink.spool.Size(), 0)
+	sink.sendMail = func(n *Notification) error {
+		return &textproto.Error{Code: 550, Msg: "mailbox unavailable"}
+	}
+	sink.Deliver(unavailable("127.0.0.1:7002"))
+	checkEqual(t, sink.spool.Size(), 0)
+	sink.sendMail = func(n *Notification) error {
+		return &textproto.Error{Code: 451, Msg: "try again later"}
+	}
+	sink.Deliver(unavailable("127.0.0.1:7003"))
+	checkEqual(t, sink.spool.Size(), 1)
+}
+
+func TestMailSpoolDoesNotHoldBackMailsBehindRefusedOnes(t *testing.T) {
+	spool := NewMailSpool("", time.Hour)
+	now := time.Now()
+	spool.Add(NewTextNotification("refused"), &textproto.Error{Code: 452, Msg: "insufficient storage"}, now)
+	spool.Add(NewTextNotification("broken"), nil, now)
+	spool.Add(NewTextNotification("new"), nil, now)
+	var sent []string
+	send := func(n *Notification) error {
+		switch n.Text {
+		case "refused":
+			return &textproto.Error{Code: 452, Msg: "insufficient storage"}
+		case "broken":
+			return permanentMailError{errors.New("could not build mail")}
+		}
+		sent = append(sent, n.Text)
+		return nil
+	}
+	checkEqual(t, spool.Flush(send, now), 1)
+	checkEqual(t, sent, []string{"new"})
+	checkEqual(t, spool.Size(), 1)
+	checkEqual(t, spool.entries[0].Notification.Text, "refused")
+
+	// unreachable relays stop the flush
+	spool.Add(NewTextNotification("later"), nil, now)
+	attempts := 0
+	checkEqual(t, spool.Flush(func(n *Notification) error { attempts++; return errors.New("connection refused") }, now), 0)
+	checkEqual(t, attempts, 1)
+	checkEqual(t, spool.Size(), 2)
+}
+
+func TestIsTransientMailError(t *testing.T) {
+	checkEqual(t, IsTransientMailError(errors.New("dial tcp: i/o timeout")), true)
+	checkEqual(t, IsTransientMailError(&textproto.Error{Code: 421, Msg: "service not available"}), true)
+	checkEqual(t, IsTransientMailError(&textproto.Error{Code: 535, Msg: "authentication failed"}), false)
+	checkEqual(t, IsTransientMailError(permanentMailError{errors.New("unsupported SMTP authentication mechanism: x")}), false)
+}
+
+func TestMailerHealthEndpoint(t *testing.T) {
+	health := NewMailerHealth()
+	health.Connected(true, nil)
+	health.SpoolChanged(3, time.Now())
+	w := httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	checkEqual(t, w.Code, 503)
+	var status MailerHealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, status.SpoolSize, 3)
+	checkEqual(t, status.Connected, true)
+
+	health.SpoolChanged(0, time.Time{})
+	w = httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	checkEqual(t, w.Code, 200)
+}
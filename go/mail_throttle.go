@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Decisions of the mail throttle.
+const (
+	MAIL_SEND = iota
+	MAIL_SUPPRESS
+	MAIL_DIGEST
+)
+
+// MAIL_RATE_INTERVAL is the interval the mail rate limit applies to.
+const MAIL_RATE_INTERVAL = time.Hour
+
+// MailThrottle decides which notifications get mailed immediately, which are
+// suppressed and which are collected for the next digest. Master switches are
+// always mailed immediately. Everything else is deduplicated within the
+// deduplication window and rate limited per notification type. With digests
+// enabled, non-critical notifications are mailed as a digest. The throttle is
+// only used from the mailer goroutine and therefore not thread safe.
+type MailThrottle struct {
+	DedupWindow    time.Duration
+	RateLimit      int
+	DigestInterval time.Duration
+	lastMailed     map[string]time.Time
+	mailed         map[string][]time.Time
+	suppressed     map[string]int
+	digest         []*Notification
+	digestDue      time.Time
+}
+
+// NewMailThrottle creates a throttle without any limits.
+func NewMailThrottle() *MailThrottle {
+	return &MailThrottle{
+		lastMailed: make(map[string]time.Time),
+		mailed:     make(map[string][]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// Configure takes over the limits from the given config.
+func (t *MailThrottle) Configure(config *Config) {
+	t.DedupWindow = time.Duration(config.MailDedupWindow) * time.Second
+	t.RateLimit = config.MailRateLimit
+	interval := time.Duration(config.MailDigestInterval) * time.Second
+	if interval != t.DigestInterval && !t.digestDue.IsZero() {
+		// apply the new interval to a pending digest
+		t.digestDue = t.digestDue.Add(interval - t.DigestInterval)
+	}
+	t.DigestInterval = interval
+}
+
+// Immediate checks whether the notification must be mailed without delay.
+func (t *MailThrottle) Immediate(n *Notification) bool {
+	return n.Type == EVENT_MASTER_SWITCHED
+}
+
+func dedupKey(n *Notification) string {
+	return n.Type + "\x00" + n.System + "\x00" + n.Text
+}
+
+// Check decides what to do with the given notification and records the
+// decision.
+func (t *MailThrottle) Check(n *Notification, now time.Time) int {
+	if t.Immediate(n) {
+		t.recordMail(n, now)
+		return MAIL_SEND
+	}
+	key := dedupKey(n)
+	if last, ok := t.lastMailed[key]; ok && t.DedupWindow > 0 && now.Sub(last) < t.DedupWindow {
+		t.suppressed[n.Type]++
+		return MAIL_SUPPRESS
+	}
+	if t.DigestInterval > 0 && !n.AtLeast(SEVERITY_CRITICAL) {
+		t.lastMailed[key] = now
+		if len(t.digest) == 0 {
+			t.digestDue = now.Add(t.DigestInterval)
+		}
+		t.digest = append(t.digest, n)
+		return MAIL_DIGEST
+	}
+	if t.RateLimit > 0 && t.recentMails(n.Type, now) >= t.RateLimit {
+		t.suppressed[n.Type]++
+		return MAIL_SUPPRESS
+	}
+	t.recordMail(n, now)
+	return MAIL_SEND
+}
+
+func (t *MailThrottle) recordMail(n *Notification, now time.Time) {
+	t.lastMailed[dedupKey(n)] = now
+	t.mailed[n.Type] = append(t.mailed[n.Type], now)
+}
+
+// recentMails counts the mails sent for the given type within the rate limit
+// interval, forgetting older ones.
+func (t *MailThrottle) recentMails(notificationType string, now time.Time) int {
+	times := t.mailed[notificationType]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= MAIL_RATE_INTERVAL {
+		i++
+	}
+	t.mailed[notificationType] = times[i:]
+	return len(times) - i
+}
+
+// Suppressed returns and resets the number of suppressed notifications of the
+// given type.
+func (t *MailThrottle) Suppressed(notificationType string) int {
+	n := t.suppressed[notificationType]
+	delete(t.suppressed, notificationType)
+	return n
+}
+
+// Expire forgets deduplication entries older than the deduplication window.
+func (t *MailThrottle) Expire(now time.Time) {
+	for key, last := range t.lastMailed {
+		if now.Sub(last) >= t.DedupWindow {
+			delete(t.lastMailed, key)
+		}
+	}
+}
+
+// DigestDue checks whether collected notifications should be mailed.
+func (t *MailThrottle) DigestDue(now time.Time) bool {
+	return len(t.digest) > 0 && !now.Before(t.digestDue)
+}
+
+// TakeDigest returns a notification summarizing all collected notifications
+// and empties the digest. Returns nil if nothing has been collected.
+func (t *MailThrottle) TakeDigest() *Notification {
+	if len(t.digest) == 0 {
+		return nil
+	}
+	severity := SEVERITY_INFO
+	lines := make([]string, 0, len(t.digest)+1)
+	for _, n := range t.digest {
+		if n.AtLeast(severity) {
+			severity = n.Severity
+		}
+		line := fmt.Sprintf("%s [%s] %s", n.Time.Format(time.RFC3339), n.Severity, n.Text)
+		lines = append(lines, line)
+	}
+	var suppressed []string
+	for notificationType, count := range t.suppressed {
+		suppressed = append(suppressed, fmt.Sprintf("%d %s", count, notificationType))
+	}
+	if len(suppressed) > 0 {
+		lines = append(lines, "", "Suppressed duplicates: "+strings.Join(suppressed, ", "))
+		t.suppressed = make(map[string]int)
+	}
+	digest := &Notification{
+		Type:     NOTIFICATION_DIGEST,
+		Severity: severity,
+		Time:     time.Now(),
+		Text:     fmt.Sprintf("%d notifications since the last digest:\n\n%s", len(t.digest), strings.Join(lines, "\n")),
+	}
+	t.digest = nil
+	t.digestDue = time.Time{}
+	return digest
+}
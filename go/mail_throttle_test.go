@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestThrottle(dedup int, rateLimit int, digest int) *MailThrottle {
+	t := NewMailThrottle()
+	t.Configure(&Config{MailDedupWindow: dedup, MailRateLimit: rateLimit, MailDigestInterval: digest})
+	return t
+}
+
+func unavailable(server string) *Notification {
+	return &Notification{Type: EVENT_MASTER_UNAVAILABLE, Severity: SEVERITY_ERROR, System: "beetle", Text: "Redis master '" + server + "' not available"}
+}
+
+func TestMailThrottleSuppressesDuplicates(t *testing.T) {
+	throttle := newTestThrottle(60, 0, 0)
+	now := time.Now()
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now), MAIL_SEND)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now.Add(30*time.Second)), MAIL_SUPPRESS)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7002"), now.Add(30*time.Second)), MAIL_SEND)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now.Add(61*time.Second)), MAIL_SEND)
+	checkEqual(t, throttle.Suppressed(EVENT_MASTER_UNAVAILABLE), 1)
+	checkEqual(t, throttle.Suppressed(EVENT_MASTER_UNAVAILABLE), 0)
+
+	throttle = newTestThrottle(-1, 0, 0)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now), MAIL_SEND)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now), MAIL_SEND)
+}
+
+func TestMailThrottleRateLimitsPerType(t *testing.T) {
+	throttle := newTestThrottle(-1, 2, 0)
+	now := time.Now()
+	unknown := &Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, Text: "unknown"}
+	checkEqual(t, throttle.Check(unknown, now), MAIL_SEND)
+	checkEqual(t, throttle.Check(unknown, now), MAIL_SEND)
+	checkEqual(t, throttle.Check(unknown, now), MAIL_SUPPRESS)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now), MAIL_SEND)
+	checkEqual(t, throttle.Check(unknown, now.Add(MAIL_RATE_INTERVAL)), MAIL_SEND)
+}
+
+func TestMailThrottleAlwaysSendsMasterSwitches(t *testing.T) {
+	throttle := newTestThrottle(60, 1, 60)
+	now := time.Now()
+	switched := &Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, Text: "switched"}
+	for i := 0; i < 3; i++ {
+		checkEqual(t, throttle.Check(switched, now), MAIL_SEND)
+	}
+}
+
+func TestMailThrottleCollectsDigest(t *testing.T) {
+	throttle := newTestThrottle(60, 0, 300)
+	now := time.Now()
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now), MAIL_DIGEST)
+	checkEqual(t, throttle.Check(unavailable("127.0.0.1:7001"), now), MAIL_SUPPRESS)
+	checkEqual(t, throttle.Check(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, Text: "unknown"}, now), MAIL_DIGEST)
+	checkEqual(t, throttle.Check(&Notification{Type: EVENT_SPLIT_BRAIN_DETECTED, Severity: SEVERITY_CRITICAL, Text: "split"}, now), MAIL_SEND)
+	checkEqual(t, throttle.DigestDue(now.Add(299*time.Second)), false)
+	checkEqual(t, throttle.DigestDue(now.Add(300*time.Second)), true)
+
+	digest := throttle.TakeDigest()
+	checkEqual(t, digest.Type, NOTIFICATION_DIGEST)
+	checkEqual(t, digest.Severity, SEVERITY_ERROR)
+	checkEqual(t, digest.Subject(), "Beetle ERROR: notification digest")
+	if !strings.Contains(digest.Text, "2 notifications") || !strings.Contains(digest.Text, "[warning] unknown") || !strings.Contains(digest.Text, "1 master_unavailable") {
+		t.Errorf("unexpected digest: %s", digest.Text)
+	}
+	checkEqual(t, throttle.DigestDue(now.Add(time.Hour)), false)
+	if throttle.TakeDigest() != nil {
+		t.Errorf("expected an empty digest")
+	}
+}
+
+func TestMailThrottleExpiresDeduplicationEntries(t *testing.T) {
+	throttle := newTestThrottle(60, 0, 0)
+	now := time.Now()
+	throttle.Check(unavailable("127.0.0.1:7001"), now)
+	throttle.Expire(now.Add(30 * time.Second))
+	checkEqual(t, len(throttle.lastMailed), 1)
+	throttle.Expire(now.Add(60 * time.Second))
+	checkEqual(t, len(throttle.lastMailed), 0)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MailerHealth records the state of the notification mailer. It is served on
+// the mailer health endpoint, if enabled. All methods are thread safe.
+type MailerHealth struct {
+	mutex        sync.Mutex
+	started      time.Time
+	connected    bool
+	lastError    string
+	lastMailSent time.Time
+	spoolSize    int
+	spoolOldest  time.Time
+}
+
+// MailerHealthStatus is the JSON representation of the mailer health.
+type MailerHealthStatus struct {
+	Healthy       bool       `json:"healthy"`
+	BeetleVersion string     `json:"beetle_version"`
+	Uptime        float64    `json:"uptime_seconds"`
+	Connected     bool       `json:"connected"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastMailSent  *time.Time `json:"last_mail_sent,omitempty"`
+	SpoolSize     int        `json:"spool_size"`
+	SpoolOldest   *time.Time `json:"spool_oldest,omitempty"`
+}
+
+// NewMailerHealth creates the health record of the mailer.
+func NewMailerHealth() *MailerHealth {
+	return &MailerHealth{started: time.Now()}
+}
+
+// Connected records whether the mailer is connected to the configuration
+// server.
+func (h *MailerHealth) Connected(connected bool, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.connected = connected
+	if err != nil {
+		h.lastError = err.Error()
+	}
+}
+
+// MailSent records the result of a mail delivery.
+func (h *MailerHealth) MailSent(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err != nil {
+		h.lastError = err.Error()
+	} else {
+		h.lastMailSent = time.Now()
+	}
+}
+
+// SpoolChanged records the size of the mail spool and the queue time of its
+// oldest entry.
+func (h *MailerHealth) SpoolChanged(size int, oldest time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.spoolSize = size
+	h.spoolOldest = oldest
+}
+
+// Status returns a snapshot of the mailer health. The mailer is considered
+// healthy when it is connected and has no undeliverable mails.
+func (h *MailerHealth) Status() *MailerHealthStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	status := &MailerHealthStatus{
+		Healthy:       h.connected && h.spoolSize == 0,
+		BeetleVersion: BEETLE_VERSION,
+		Uptime:        time.Since(h.started).Seconds(),
+		Connected:     h.connected,
+		LastError:     h.lastError,
+		SpoolSize:     h.spoolSize,
+	}
+	if !h.lastMailSent.IsZero() {
+		t := h.lastMailSent
+		status.LastMailSent = &t
+	}
+	if h.spoolSize > 0 {
+		t := h.spoolOldest
+		status.SpoolOldest = &t
+	}
+	return status
+}
+
+// ServeHTTP serves the health status as JSON. Responds with 503 if the
+// mailer is unhealthy.
+func (h *MailerHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/health" {
+		http.NotFound(w, r)
+		return
+	}
+	status := h.Status()
+	b, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// RunMailerHealthServer serves the health endpoint on the given address. It
+// only returns if the listener cannot be established.
+func RunMailerHealthServer(address string, h *MailerHealth) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logError("could not start mailer health endpoint: %s", err)
+		return
+	}
+	logInfo("serving mailer health on http://%s/health", l.Addr())
+	if err := http.Serve(l, h); err != nil {
+		logError("mailer health endpoint failed: %s", err)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MasterFileOptions control how the redis master file is written and who gets
+// told about changes.
+type MasterFileOptions struct {
+	KeepPrevious bool   // Keep the old content in <path>.previous.
+	Hook         string // Shell command to run when the content has changed.
+	PidFile      string // Pid file of a process to signal when the content has changed.
+	Signal       string // Signal to send (HUP, USR1, USR2, INT or TERM).
+}
+
+// MasterFileOptions extracts the master file options from the config.
+func (c *Config) MasterFileOptions() MasterFileOptions {
+	return MasterFileOptions{
+		KeepPrevious: c.RedisMasterFilePrevious,
+		Hook:         c.RedisMasterFileHook,
+		PidFile:      c.RedisMasterFilePidFile,
+		Signal:       c.RedisMasterFileSignal,
+	}
+}
+
+// MasterFileHookTimeout limits the run time of the change hook.
+const MasterFileHookTimeout = 30 * time.Second
+
+// UpdateRedisMasterFile atomically replaces the content of the master file and
+// notifies the configured consumers if the content has changed. Readers never
+// see a partially written file: the content is written to a temporary file in
+// the same directory, synced to disk and renamed. Consumers are notified in
+// the background, so that slow hooks do not delay the caller. Returns whether
+// the content has changed.
+func UpdateRedisMasterFile(path string, content string, o MasterFileOptions) (bool, error) {
+	trimmed := strings.TrimRight(content, "\n")
+	old, err := ioutil.ReadFile(path)
+	exists := err == nil
+	if exists && strings.TrimRight(string(old), "\n") == trimmed {
+		return false, nil
+	}
+	escaped := strings.Replace(trimmed, "\n", "\\n", -1)
+	logInfo("writing '%s' to redis master file '%s'", escaped, path)
+	if exists && o.KeepPrevious {
+		if err := writeFileAtomically(path+".previous", old); err != nil {
+			logError("could not save previous master file content: %s", err)
+		}
+	}
+	if err := writeFileAtomically(path, []byte(trimmed)); err != nil {
+		logError("could not write master file '%s': %s", path, err)
+		return false, err
+	}
+	notifyMasterFileChange(path, o)
+	return true, nil
+}
+
+// writeFileAtomically writes data to a temporary file next to the given path,
+// syncs it and renames it to path. The directory is synced as well, so that
+// the rename survives a crash. The mode of an existing file is kept.
+func writeFileAtomically(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op after a successful rename
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// masterFileNotifier notifies the consumers of a single master file about
+// changes, one notification after another. Changes arriving while a
+// notification is pending are coalesced, as consumers read the latest content.
+type masterFileNotifier struct {
+	pending chan MasterFileOptions
+	busy    sync.WaitGroup // Counts pending and running notifications.
+}
+
+var (
+	masterFileNotifiersMutex sync.Mutex
+	masterFileNotifiers      = make(map[string]*masterFileNotifier)
+)
+
+// notifyMasterFileChange schedules the notification of the consumers of the
+// given master file, starting its notifier if necessary.
+func notifyMasterFileChange(path string, o MasterFileOptions) {
+	if o.Hook == "" && o.PidFile == "" {
+		return
+	}
+	masterFileNotifiersMutex.Lock()
+	n := masterFileNotifiers[path]
+	if n == nil {
+		n = &masterFileNotifier{pending: make(chan MasterFileOptions, 1)}
+		masterFileNotifiers[path] = n
+		go n.run(path)
+	}
+	n.busy.Add(1)
+	masterFileNotifiersMutex.Unlock()
+	select {
+	case n.pending <- o:
+	default:
+		n.busy.Done()
+		logDebug("master file notification for '%s' already pending", path)
+	}
+}
+
+func (n *masterFileNotifier) run(path string) {
+	for o := range n.pending {
+		o.notify(path)
+		n.busy.Done()
+	}
+}
+
+// waitForMasterFileNotifications waits until all scheduled notifications of
+// the consumers of the given master file have been delivered.
+func waitForMasterFileNotifications(path string) {
+	masterFileNotifiersMutex.Lock()
+	n := masterFileNotifiers[path]
+	masterFileNotifiersMutex.Unlock()
+	if n != nil {
+		n.busy.Wait()
+	}
+}
+
+// notify runs the change hook and signals the configured process.
+func (o MasterFileOptions) notify(path string) {
+	if o.Hook != "" {
+		if err := runMasterFileHook(o.Hook, path); err != nil {
+			logError("master file hook '%s' failed: %s", o.Hook, err)
+		}
+	}
+	if o.PidFile != "" {
+		if err := signalPidFile(o.PidFile, o.Signal); err != nil {
+			logError("could not signal process of pid file '%s': %s", o.PidFile, err)
+		}
+	}
+}
+
+func runMasterFileHook(hook string, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), MasterFileHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook)
+	cmd.Env = append(os.Environ(), "BEETLE_REDIS_MASTER_FILE="+path)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logInfo("master file hook output: %s", strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+var masterFileSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+}
+
+func signalPidFile(pidFile string, signal string) error {
+	if signal == "" {
+		signal = "HUP"
+	}
+	sig, ok := masterFileSignals[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]
+	if !ok {
+		return fmt.Errorf("unsupported signal: %s", signal)
+	}
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid pid: %q", strings.TrimSpace(string(b)))
+	}
+	logInfo("sending SIG%s to process %d", strings.TrimPrefix(strings.ToUpper(signal), "SIG"), pid)
+	return syscall.Kill(pid, sig)
+}
+
+// Master file formats.
+const (
+	MASTER_FILE_FORMAT_TEXT = "text"
+	MASTER_FILE_FORMAT_JSON = "json"
+	MASTER_FILE_FORMAT_YAML = "yaml"
+)
+
+// States of a system recorded in structured master files.
+const (
+	MASTER_FILE_STATE_ACTIVE      = "active"
+	MASTER_FILE_STATE_INVALIDATED = "invalidated"
+)
+
+// MasterFileSystem describes a single system in a structured master file.
+type MasterFileSystem struct {
+	Master    string    `json:"master" yaml:"master"`
+	Token     string    `json:"token,omitempty" yaml:"token,omitempty"` // Token of the vote which last changed master or state.
+	ChangedAt time.Time `json:"changed_at" yaml:"changed_at"`
+	State     string    `json:"state" yaml:"state"`
+}
+
+// MasterFile is the content of a structured (JSON or YAML) master file.
+type MasterFile struct {
+	Systems map[string]MasterFileSystem `json:"systems" yaml:"systems"`
+}
+
+// NewMasterFile creates an empty master file.
+func NewMasterFile() *MasterFile {
+	return &MasterFile{Systems: make(map[string]MasterFileSystem)}
+}
+
+// Set records the master and token of a system. Systems without a master are
+// marked as invalidated.
+func (mf *MasterFile) Set(system string, master string, token string) {
+	state := MASTER_FILE_STATE_ACTIVE
+	if master == "" {
+		state = MASTER_FILE_STATE_INVALIDATED
+	}
+	mf.Systems[system] = MasterFileSystem{Master: master, Token: token, State: state}
+}
+
+// Masters returns the system to master mapping.
+func (mf *MasterFile) Masters() map[string]string {
+	m := make(map[string]string, len(mf.Systems))
+	for system, entry := range mf.Systems {
+		m[system] = entry.Master
+	}
+	return m
+}
+
+// Marshal converts the master file into the given format. For systems whose
+// master and state have not changed, tokens and (unless already set) change
+// times are carried over from the previous file content, so that rewriting an
+// unchanged file does not alter its content. Tokens therefore identify the
+// vote which last changed the system's master or state.
+func (mf *MasterFile) Marshal(format string, previous string) (string, error) {
+	switch format {
+	case "", MASTER_FILE_FORMAT_TEXT:
+		return MarshalMasterFileContent(mf.Masters()), nil
+	case MASTER_FILE_FORMAT_JSON, MASTER_FILE_FORMAT_YAML:
+	default:
+		return "", fmt.Errorf("unknown master file format: %s", format)
+	}
+	old := ParseMasterFile(previous)
+	now := time.Now().UTC().Truncate(time.Second)
+	for system, entry := range mf.Systems {
+		if o, ok := old.Systems[system]; ok && o.Master == entry.Master && o.State == entry.State {
+			// tokens change with every vote, rewriting the file for them would
+			// make readers reload it for nothing
+			if o.Token != "" {
+				entry.Token = o.Token
+			}
+			if entry.ChangedAt.IsZero() {
+				entry.ChangedAt = o.ChangedAt
+			}
+		}
+		if entry.ChangedAt.IsZero() {
+			entry.ChangedAt = now
+		}
+		mf.Systems[system] = entry
+	}
+	var b []byte
+	var err error
+	if format == MASTER_FILE_FORMAT_JSON {
+		b, err = json.MarshalIndent(mf, "", "  ")
+	} else {
+		b, err = yaml.Marshal(mf)
+	}
+	return string(b), err
+}
+
+// IsStructuredMasterFileContent checks whether the given master file content
+// is in JSON or YAML format.
+func IsStructuredMasterFileContent(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "{") || strings.HasPrefix(s, "---") || strings.HasPrefix(s, "systems:")
+}
+
+// ParseMasterFile parses master file content in any of the supported formats.
+// Legacy text content yields systems without tokens and change times. Invalid
+// structured content yields an empty master file.
+func ParseMasterFile(s string) *MasterFile {
+	mf := NewMasterFile()
+	if !IsStructuredMasterFileContent(s) {
+		for system, master := range unmarshalLegacyMasterFileContent(s) {
+			mf.Set(system, master, "")
+		}
+		return mf
+	}
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		err = json.Unmarshal([]byte(s), mf)
+	} else {
+		err = yaml.Unmarshal([]byte(s), mf)
+	}
+	if err != nil {
+		logError("could not parse master file content: %s", err)
+		return NewMasterFile()
+	}
+	if mf.Systems == nil {
+		mf.Systems = make(map[string]MasterFileSystem)
+	}
+	return mf
+}
+
+// WriteMasterFile writes the master file in the configured format.
+func WriteMasterFile(path string, mf *MasterFile, config *Config) error {
+	content, err := mf.Marshal(config.RedisMasterFileFormat, readMasterFileQuietly(path))
+	if err != nil {
+		logError("could not write master file '%s': %s", path, err)
+		return err
+	}
+	_, err = UpdateRedisMasterFile(path, content, config.MasterFileOptions())
+	return err
+}
+
+func readMasterFileQuietly(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
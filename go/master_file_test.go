@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUpdateRedisMasterFileKeepsPreviousAndRunsHook(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "redis-master")
+	log := filepath.Join(dir, "hook.log")
+	o := MasterFileOptions{KeepPrevious: true, Hook: "echo $BEETLE_REDIS_MASTER_FILE >> " + log}
+
+	changed, err := UpdateRedisMasterFile(path, "primary/127.0.0.1:7001\n", o)
+	checkEqual(t, err, nil)
+	checkEqual(t, changed, true)
+	checkEqual(t, ReadRedisMasterFile(path), "primary/127.0.0.1:7001")
+	checkEqual(t, MasterFileExists(path+".previous"), false)
+
+	changed, err = UpdateRedisMasterFile(path, "primary/127.0.0.1:7001", o)
+	checkEqual(t, err, nil)
+	checkEqual(t, changed, false)
+
+	waitForFileContent(t, log, path)
+
+	changed, err = UpdateRedisMasterFile(path, "primary/127.0.0.1:7002", o)
+	checkEqual(t, err, nil)
+	checkEqual(t, changed, true)
+	checkEqual(t, ReadRedisMasterFile(path), "primary/127.0.0.1:7002")
+	checkEqual(t, ReadRedisMasterFile(path+".previous"), "primary/127.0.0.1:7001")
+
+	// the hook only ran for actual changes
+	waitForFileContent(t, log, path+"\n"+path)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	checkEqual(t, err, nil)
+	checkEqual(t, len(entries), 3)
+}
+
+func TestUpdateRedisMasterFileKeepsFileMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis-master")
+	if err := os.WriteFile(path, []byte("primary/127.0.0.1:7001"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateRedisMasterFile(path, "primary/127.0.0.1:7002", MasterFileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	checkEqual(t, err, nil)
+	checkEqual(t, fi.Mode().Perm(), os.FileMode(0640))
+}
+
+// waitForFileContent waits for a master file consumer to write the expected
+// content, as consumers are notified in the background.
+func waitForFileContent(t *testing.T, path string, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for ReadRedisMasterFile(path) != expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkEqual(t, ReadRedisMasterFile(path), expected)
+}
+
+func TestUpdateRedisMasterFileDoesNotWaitForHooks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "redis-master")
+	log := filepath.Join(dir, "hook.log")
+	o := MasterFileOptions{Hook: "sleep 1; echo done >> " + log}
+	started := time.Now()
+	for _, master := range []string{"127.0.0.1:7001", "127.0.0.1:7002", "127.0.0.1:7003"} {
+		if _, err := UpdateRedisMasterFile(path, master, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("updating the master file waited %s for the hook", elapsed)
+	}
+	// changes arriving while the hook is pending or running are coalesced
+	waitForMasterFileNotifications(path)
+	if runs := strings.Count(ReadRedisMasterFile(log), "done"); runs < 1 || runs > 2 {
+		t.Errorf("expected the hook to run once or twice, but it ran %d times", runs)
+	}
+}
+
+func TestUpdateRedisMasterFileSignalsProcess(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "consumer.pid")
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := MasterFileOptions{PidFile: pidFile, Signal: "usr1"}
+	if _, err := UpdateRedisMasterFile(filepath.Join(dir, "redis-master"), "127.0.0.1:7001", o); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sig := <-signals:
+		checkEqual(t, sig, syscall.SIGUSR1)
+	case <-time.After(time.Second):
+		t.Errorf("no signal received")
+	}
+}
+
+func TestSignalPidFileRejectsUnknownSignals(t *testing.T) {
+	if err := signalPidFile("/nonexistent", "KILL"); err == nil {
+		t.Errorf("expected an error for unsupported signal")
+	}
+}
+
+func TestStructuredMasterFileFormats(t *testing.T) {
+	for _, format := range []string{MASTER_FILE_FORMAT_JSON, MASTER_FILE_FORMAT_YAML} {
+		mf := NewMasterFile()
+		mf.Set("primary", "127.0.0.1:7001", "4")
+		mf.Set("secondary", "", "2")
+		content, err := mf.Marshal(format, "")
+		if err != nil {
+			t.Fatalf("%s: marshal failed: %s", format, err)
+		}
+		if !IsStructuredMasterFileContent(content) {
+			t.Errorf("%s: content not recognized as structured: %s", format, content)
+		}
+		checkEqual(t, UnmarshalMasterFileContent(content), map[string]string{"primary": "127.0.0.1:7001", "secondary": ""})
+		parsed := ParseMasterFile(content)
+		checkEqual(t, parsed.Systems["primary"].Token, "4")
+		checkEqual(t, parsed.Systems["primary"].State, MASTER_FILE_STATE_ACTIVE)
+		checkEqual(t, parsed.Systems["secondary"].State, MASTER_FILE_STATE_INVALIDATED)
+		if parsed.Systems["primary"].ChangedAt.IsZero() {
+			t.Errorf("%s: change time missing", format)
+		}
+
+		// token changes alone do not alter the content
+		mf.Set("primary", "127.0.0.1:7001", "5")
+		mf.Set("secondary", "", "3")
+		rewritten, _ := mf.Marshal(format, content)
+		checkEqual(t, rewritten, content)
+
+		// change times of unchanged systems are kept
+		changedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		entry := parsed.Systems["primary"]
+		entry.ChangedAt = changedAt
+		parsed.Systems["primary"] = entry
+		previous, _ := parsed.Marshal(format, "")
+		mf = NewMasterFile()
+		mf.Set("primary", "127.0.0.1:7001", "5")
+		mf.Set("secondary", "127.0.0.1:7002", "3")
+		content, _ = mf.Marshal(format, previous)
+		parsed = ParseMasterFile(content)
+		checkEqual(t, parsed.Systems["primary"].ChangedAt, changedAt)
+		checkEqual(t, parsed.Systems["primary"].Token, "4")
+		checkEqual(t, parsed.Systems["secondary"].Token, "3")
+		if !parsed.Systems["secondary"].ChangedAt.After(changedAt) {
+			t.Errorf("%s: change time of changed system not updated", format)
+		}
+	}
+}
+
+func TestLegacyMasterFileFormatIsDefault(t *testing.T) {
+	mf := NewMasterFile()
+	mf.Set("primary", "127.0.0.1:7001", "4")
+	content, err := mf.Marshal("", "")
+	checkEqual(t, err, nil)
+	checkEqual(t, content, "primary/127.0.0.1:7001\n")
+	checkEqual(t, ParseMasterFile("127.0.0.1:7001").Masters(), map[string]string{"system": "127.0.0.1:7001"})
+	if _, err := mf.Marshal("xml", ""); err == nil {
+		t.Errorf("expected an error for unknown format")
+	}
+}
+
+func TestWriteMasterFileReadsBackTransparently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis-master")
+	mf := NewMasterFile()
+	mf.Set("primary", "127.0.0.1:7001", "1")
+	if err := WriteMasterFile(path, mf, &Config{RedisMasterFileFormat: MASTER_FILE_FORMAT_YAML}); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, RedisMastersFromMasterFile(path), map[string]string{"primary": "127.0.0.1:7001"})
+}
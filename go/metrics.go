@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// SystemMetrics holds the metrics exported for a single failover set.
+type SystemMetrics struct {
+	SystemName       string
+	MasterAvailable  bool
+	SwitchInProgress bool
+	Failovers        int
+	RetriesLeft      int
+	LastGCTimestamp  int64
+}
+
+// Metrics holds a snapshot of all values exported on the /metrics endpoint.
+type Metrics struct {
+	Systems              []SystemMetrics
+	ConnectedClients     int
+	UnseenClients        int
+	UnresponsiveClients  int
+	WebSocketConnections int64
+	ProcessedMessages    int64
+}
+
+// GetMetrics creates a Metrics snapshot from the current server state.
+func (s *ServerState) GetMetrics() *Metrics {
+	var keys []string
+	for k := range s.failovers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	systems := make([]SystemMetrics, 0, len(keys))
+	for _, system := range keys {
+		fs := s.failovers[system]
+		m := SystemMetrics{
+			SystemName:       system,
+			MasterAvailable:  fs.currentMaster != nil && fs.MasterIsAvailable(),
+			SwitchInProgress: fs.WatcherPaused(),
+			Failovers:        fs.switchCount,
+			RetriesLeft:      fs.RetriesLeft(),
+		}
+		if fs.gcInfo != nil {
+			m.LastGCTimestamp = fs.gcInfo.Timestamp
+		}
+		systems = append(systems, m)
+	}
+
+	return &Metrics{
+		Systems:              systems,
+		ConnectedClients:     len(s.clientChannels),
+		UnseenClients:        len(s.UnseenClientIds()),
+		UnresponsiveClients:  len(s.UnresponsiveClients()),
+		WebSocketConnections: atomic.LoadInt64(&wsConnections),
+		ProcessedMessages:    atomic.LoadInt64(&processed),
+	}
+}
+
+// GetMetricsFromDispatcher retrieves the metrics from the dispatcher thread.
+func (s *ServerState) GetMetricsFromDispatcher() *Metrics {
+	var res *Metrics
+	s.Evaluate(func() {
+		res = s.GetMetrics()
+	})
+	return res
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Render writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) Render(w io.Writer) {
+	perSystem := func(name, kind, help string, value func(sm *SystemMetrics) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for i := range m.Systems {
+			sm := &m.Systems[i]
+			fmt.Fprintf(w, "%s{system=%q} %d\n", name, sm.SystemName, value(sm))
+		}
+	}
+	global := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	perSystem("beetle_redis_master_available", "gauge", "Whether the current redis master is available.",
+		func(sm *SystemMetrics) int64 { return int64(boolToInt(sm.MasterAvailable)) })
+	perSystem("beetle_switch_in_progress", "gauge", "Whether a master switch is in progress.",
+		func(sm *SystemMetrics) int64 { return int64(boolToInt(sm.SwitchInProgress)) })
+	perSystem("beetle_failovers_total", "counter", "Number of master switches since server start.",
+		func(sm *SystemMetrics) int64 { return int64(sm.Failovers) })
+	perSystem("beetle_redis_master_retries_left", "gauge", "Availability checks left before a master switch is initiated.",
+		func(sm *SystemMetrics) int64 { return int64(sm.RetriesLeft) })
+	perSystem("beetle_last_gc_timestamp_seconds", "gauge", "Unix time of the last garbage collection (0 if unknown).",
+		func(sm *SystemMetrics) int64 { return sm.LastGCTimestamp })
+	global("beetle_clients_connected", "gauge", "Number of clients connected via websocket.", int64(m.ConnectedClients))
+	global("beetle_clients_unseen", "gauge", "Number of configured clients which have never been seen.", int64(m.UnseenClients))
+	global("beetle_clients_unresponsive", "gauge", "Number of clients not seen within the client timeout.", int64(m.UnresponsiveClients))
+	global("beetle_websocket_connections", "gauge", "Number of open client websocket connections.", m.WebSocketConnections)
+	global("beetle_websocket_messages_processed_total", "counter", "Number of websocket messages processed.", m.ProcessedMessages)
+}
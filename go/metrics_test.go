@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenderingMetrics(t *testing.T) {
+	m := &Metrics{
+		Systems: []SystemMetrics{
+			{SystemName: "primary", MasterAvailable: true, Failovers: 2, RetriesLeft: 3, LastGCTimestamp: 1600000000},
+			{SystemName: "secondary", SwitchInProgress: true},
+		},
+		ConnectedClients:     4,
+		UnseenClients:        1,
+		WebSocketConnections: 4,
+		ProcessedMessages:    17,
+	}
+	var b bytes.Buffer
+	m.Render(&b)
+	out := b.String()
+	expected := []string{
+		"# TYPE beetle_redis_master_available gauge",
+		`beetle_redis_master_available{system="primary"} 1`,
+		`beetle_redis_master_available{system="secondary"} 0`,
+		`beetle_switch_in_progress{system="secondary"} 1`,
+		"# TYPE beetle_failovers_total counter",
+		`beetle_failovers_total{system="primary"} 2`,
+		`beetle_redis_master_retries_left{system="primary"} 3`,
+		`beetle_last_gc_timestamp_seconds{system="primary"} 1600000000`,
+		"beetle_clients_connected 4",
+		"beetle_clients_unseen 1",
+		"beetle_clients_unresponsive 0",
+		"beetle_websocket_messages_processed_total 17",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics output does not contain %q:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Notification types not covered by history events.
+const (
+	NOTIFICATION_UNKNOWN_CLIENT = "unknown_client"
+	NOTIFICATION_LEADER_CHANGED = "leader_changed"
+	NOTIFICATION_MESSAGE        = "message"
+	NOTIFICATION_DIGEST         = "digest"
+)
+
+// Notification severities, in ascending order.
+const (
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_ERROR    = "error"
+	SEVERITY_CRITICAL = "critical"
+)
+
+var severityLevels = map[string]int{
+	SEVERITY_INFO:     0,
+	SEVERITY_WARNING:  1,
+	SEVERITY_ERROR:    2,
+	SEVERITY_CRITICAL: 3,
+}
+
+// Notification formats understood by /notifications listeners.
+const (
+	NOTIFICATION_FORMAT_JSON = "json"
+	NOTIFICATION_FORMAT_TEXT = "text"
+)
+
+// Notification is sent to all /notifications listeners. Type is one of the
+// history event names or one of the additional notification types above.
+type Notification struct {
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	System    string    `json:"system,omitempty"`
+	OldMaster string    `json:"old_master,omitempty"`
+	NewMaster string    `json:"new_master,omitempty"`
+	ClientId  string    `json:"client_id,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	Time      time.Time `json:"time"`
+	Text      string    `json:"text"`
+	Epoch     string    `json:"epoch,omitempty"`
+	Sequence  uint64    `json:"sequence,omitempty"`
+}
+
+// NewTextNotification wraps a free form text in a notification.
+func NewTextNotification(text string) *Notification {
+	return &Notification{Type: NOTIFICATION_MESSAGE, Severity: SEVERITY_INFO, Time: time.Now(), Text: text}
+}
+
+// ParseNotification parses a notification received from the server. Servers
+// which predate structured notifications send plain text, which is wrapped in
+// a notification of type "message".
+func ParseNotification(s string) *Notification {
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		n := &Notification{}
+		if err := json.Unmarshal([]byte(s), n); err == nil && n.Type != "" {
+			if n.Severity == "" {
+				n.Severity = SEVERITY_INFO
+			}
+			return n
+		}
+	}
+	return NewTextNotification(s)
+}
+
+// Encode converts the notification into the given wire format.
+func (n *Notification) Encode(format string) string {
+	if format == NOTIFICATION_FORMAT_TEXT {
+		return n.Text
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		logError("could not marshal notification: %s", err)
+		return n.Text
+	}
+	return string(b)
+}
+
+// Subject returns a mail subject summarizing the notification.
+func (n *Notification) Subject() string {
+	switch n.Type {
+	case NOTIFICATION_MESSAGE:
+		return "Beetle system notification"
+	case NOTIFICATION_DIGEST:
+		return fmt.Sprintf("Beetle %s: notification digest", strings.ToUpper(n.Severity))
+	}
+	subject := fmt.Sprintf("Beetle %s: %s", strings.ToUpper(n.Severity), strings.Replace(n.Type, "_", " ", -1))
+	if n.System != "" {
+		subject += fmt.Sprintf(" (%s)", n.System)
+	}
+	return subject
+}
+
+// AtLeast checks whether the notification is at least as severe as the given
+// severity. Unknown severities are treated as info.
+func (n *Notification) AtLeast(severity string) bool {
+	return severityLevels[n.Severity] >= severityLevels[severity]
+}
+
+// ValidSeverity checks whether the given string names a known severity.
+func ValidSeverity(severity string) bool {
+	_, ok := severityLevels[severity]
+	return ok
+}
+
+// NotificationFilter selects notifications by minimum severity, type and
+// system. Empty fields match everything.
+type NotificationFilter struct {
+	MinSeverity string
+	Types       StringSet
+	Systems     StringSet
+}
+
+// NewNotificationFilter creates a filter from a minimum severity and comma
+// separated lists of types and systems.
+func NewNotificationFilter(minSeverity string, types string, systems string) (*NotificationFilter, error) {
+	if minSeverity != "" && !ValidSeverity(minSeverity) {
+		return nil, fmt.Errorf("unknown severity: %s", minSeverity)
+	}
+	return &NotificationFilter{MinSeverity: minSeverity, Types: commaSeparatedSet(types), Systems: commaSeparatedSet(systems)}, nil
+}
+
+func commaSeparatedSet(s string) StringSet {
+	set := make(StringSet)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set.Add(v)
+		}
+	}
+	return set
+}
+
+// Accepts checks whether the notification passes the filter. Notifications
+// without a system pass system filters, as they concern all systems.
+func (f *NotificationFilter) Accepts(n *Notification) bool {
+	if f == nil {
+		return true
+	}
+	if f.MinSeverity != "" && !n.AtLeast(f.MinSeverity) {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types.Include(n.Type) {
+		return false
+	}
+	if len(f.Systems) > 0 && n.System != "" && !f.Systems.Include(n.System) {
+		return false
+	}
+	return true
+}
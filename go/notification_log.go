@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// NOTIFICATIONS_LOST is sent to listeners resuming from a sequence number
+// whose successors have already been dropped from the notification log.
+const NOTIFICATIONS_LOST = "notifications_lost"
+
+// NotificationLog keeps the most recent notifications in a ring buffer, so
+// that listeners can catch up on notifications sent while they were
+// disconnected. Notifications are numbered consecutively, starting at 1. As
+// sequence numbers start over when a server is restarted or another server
+// takes over, each log has a unique epoch. The log is only used from the
+// dispatcher and therefore not thread safe.
+type NotificationLog struct {
+	epoch   string
+	buffer  []*Notification
+	lastSeq uint64
+}
+
+// NotificationCursor describes the last notification a listener has seen.
+type NotificationCursor struct {
+	Epoch    string
+	Sequence uint64
+	Time     time.Time
+}
+
+// NewNotificationLog creates a log keeping the given number of notifications.
+func NewNotificationLog(size int) *NotificationLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &NotificationLog{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		buffer: make([]*Notification, size),
+	}
+}
+
+// Epoch returns the epoch of the log.
+func (l *NotificationLog) Epoch() string {
+	return l.epoch
+}
+
+// Capacity returns the number of notifications kept by the log.
+func (l *NotificationLog) Capacity() int {
+	return len(l.buffer)
+}
+
+// Append assigns the next sequence number to the notification and stores it,
+// replacing the oldest notification if the buffer is full.
+func (l *NotificationLog) Append(n *Notification) {
+	l.lastSeq++
+	n.Epoch = l.epoch
+	n.Sequence = l.lastSeq
+	l.buffer[(l.lastSeq-1)%uint64(len(l.buffer))] = n
+}
+
+// oldest returns the sequence number of the oldest notification still kept.
+func (l *NotificationLog) oldest() uint64 {
+	if l.lastSeq < uint64(len(l.buffer)) {
+		return 1
+	}
+	return l.lastSeq - uint64(len(l.buffer)) + 1
+}
+
+// Since returns the notifications a listener has missed, in order. For
+// cursors of the same epoch, these are the notifications following the
+// cursor's sequence number, and the number of notifications which have
+// already been dropped. For cursors of other epochs, they are the
+// notifications sent after the cursor's time.
+func (l *NotificationLog) Since(c *NotificationCursor) ([]*Notification, uint64) {
+	missed := make([]*Notification, 0)
+	if c == nil || l.lastSeq == 0 {
+		return missed, 0
+	}
+	first, lost := l.oldest(), uint64(0)
+	if c.Epoch == l.epoch {
+		if c.Sequence >= l.lastSeq {
+			return missed, 0
+		}
+		if c.Sequence+1 > first {
+			first = c.Sequence + 1
+		} else {
+			lost = first - c.Sequence - 1
+		}
+	}
+	for seq := first; seq <= l.lastSeq; seq++ {
+		n := l.buffer[(seq-1)%uint64(len(l.buffer))]
+		if c.Epoch == l.epoch || n.Time.After(c.Time) {
+			missed = append(missed, n)
+		}
+	}
+	return missed, lost
+}
+
+// ParseNotificationCursor extracts the cursor from the since, epoch and time
+// query parameters of a /notifications request. Returns nil if the listener
+// does not want to resume.
+func ParseNotificationCursor(query url.Values) (*NotificationCursor, error) {
+	since := query.Get("since")
+	if since == "" {
+		return nil, nil
+	}
+	seq, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence number: %s", since)
+	}
+	c := &NotificationCursor{Epoch: query.Get("epoch"), Sequence: seq}
+	if t := query.Get("time"); t != "" {
+		if c.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return nil, fmt.Errorf("invalid time: %s", t)
+		}
+	}
+	return c, nil
+}
+
+// Query adds the cursor to the given query parameters.
+func (c *NotificationCursor) Query(query url.Values) {
+	query.Set("since", strconv.FormatUint(c.Sequence, 10))
+	query.Set("epoch", c.Epoch)
+	query.Set("time", c.Time.Format(time.RFC3339Nano))
+}
+
+// Advance moves the cursor to the given notification, unless it has no
+// sequence number.
+func (c *NotificationCursor) Advance(n *Notification) {
+	if n.Sequence == 0 {
+		return
+	}
+	c.Epoch, c.Sequence, c.Time = n.Epoch, n.Sequence, n.Time
+}
+
+// ReplayNotifications sends the notifications a resuming listener has missed
+// on the given channel, preceded by a notification about lost ones, if any.
+func (s *ServerState) ReplayNotifications(channel StringChannel, cursor *NotificationCursor) {
+	missed, lost := s.notificationLog.Since(cursor)
+	if lost > 0 {
+		text := fmt.Sprintf("%d notifications were dropped from the notification log before they could be replayed", lost)
+		logWarn(text)
+		n := &Notification{Type: NOTIFICATIONS_LOST, Severity: SEVERITY_WARNING, Time: time.Now(), Text: text}
+		missed = append([]*Notification{n}, missed...)
+	}
+	if len(missed) == 0 {
+		return
+	}
+	logInfo("replaying %d notifications to resuming subscriber", len(missed))
+	for _, n := range missed {
+		select {
+		case channel <- n.Encode(NOTIFICATION_FORMAT_JSON):
+		default:
+			logError("notification subscriber channel full, replay incomplete")
+			return
+		}
+	}
+}
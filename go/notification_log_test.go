@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func appendTexts(l *NotificationLog, texts ...string) {
+	for _, text := range texts {
+		l.Append(NewTextNotification(text))
+	}
+}
+
+func notificationTexts(ns []*Notification) []string {
+	texts := make([]string, 0, len(ns))
+	for _, n := range ns {
+		texts = append(texts, n.Text)
+	}
+	return texts
+}
+
+func TestNotificationLogNumbersNotifications(t *testing.T) {
+	l := NewNotificationLog(3)
+	appendTexts(l, "a", "b")
+	missed, lost := l.Since(&NotificationCursor{Epoch: l.Epoch(), Sequence: 0})
+	checkEqual(t, notificationTexts(missed), []string{"a", "b"})
+	checkEqual(t, lost, uint64(0))
+	checkEqual(t, missed[1].Sequence, uint64(2))
+	checkEqual(t, missed[1].Epoch, l.Epoch())
+
+	missed, _ = l.Since(&NotificationCursor{Epoch: l.Epoch(), Sequence: 1})
+	checkEqual(t, notificationTexts(missed), []string{"b"})
+	missed, _ = l.Since(&NotificationCursor{Epoch: l.Epoch(), Sequence: 2})
+	checkEqual(t, len(missed), 0)
+	missed, _ = l.Since(nil)
+	checkEqual(t, len(missed), 0)
+	checkEqual(t, l.Capacity(), 3)
+}
+
+func TestNotificationLogDropsOldestNotifications(t *testing.T) {
+	l := NewNotificationLog(3)
+	appendTexts(l, "a", "b", "c", "d", "e")
+	missed, lost := l.Since(&NotificationCursor{Epoch: l.Epoch(), Sequence: 1})
+	checkEqual(t, notificationTexts(missed), []string{"c", "d", "e"})
+	checkEqual(t, lost, uint64(1))
+	missed, lost = l.Since(&NotificationCursor{Epoch: l.Epoch(), Sequence: 3})
+	checkEqual(t, notificationTexts(missed), []string{"d", "e"})
+	checkEqual(t, lost, uint64(0))
+}
+
+func TestNotificationLogResumesOtherEpochsByTime(t *testing.T) {
+	l := NewNotificationLog(10)
+	now := time.Now()
+	for i, text := range []string{"a", "b", "c"} {
+		n := NewTextNotification(text)
+		n.Time = now.Add(time.Duration(i) * time.Second)
+		l.Append(n)
+	}
+	missed, lost := l.Since(&NotificationCursor{Epoch: "other", Sequence: 17, Time: now})
+	checkEqual(t, notificationTexts(missed), []string{"b", "c"})
+	checkEqual(t, lost, uint64(0))
+}
+
+func TestParseNotificationCursor(t *testing.T) {
+	c, err := ParseNotificationCursor(url.Values{"format": {"json"}})
+	checkEqual(t, c == nil, true)
+	checkEqual(t, err, nil)
+	_, err = ParseNotificationCursor(url.Values{"since": {"x"}})
+	checkEqual(t, err != nil, true)
+
+	cursor := &NotificationCursor{}
+	n := NewTextNotification("a")
+	cursor.Advance(n)
+	checkEqual(t, cursor.Sequence, uint64(0))
+	NewNotificationLog(1).Append(n)
+	cursor.Advance(n)
+	query := url.Values{}
+	cursor.Query(query)
+	c, err = ParseNotificationCursor(query)
+	checkEqual(t, err, nil)
+	checkEqual(t, c.Epoch, n.Epoch)
+	checkEqual(t, c.Sequence, uint64(1))
+	checkEqual(t, c.Time.Equal(n.Time), true)
+}
+
+func TestResumingSubscribersReceiveMissedNotifications(t *testing.T) {
+	s := NewServerState(ServerOptions{Config: &Config{ClientHeartbeat: 60, NotificationBufferSize: 2}})
+	for _, text := range []string{"a", "b", "c"} {
+		s.SendNotification(NewTextNotification(text))
+	}
+	channel := make(chan string, 10)
+	s.ReplayNotifications(channel, &NotificationCursor{Epoch: s.notificationLog.Epoch(), Sequence: 0})
+	checkEqual(t, len(channel), 3)
+	n := ParseNotification(<-channel)
+	checkEqual(t, n.Type, NOTIFICATIONS_LOST)
+	checkEqual(t, n.Sequence, uint64(0))
+	checkEqual(t, ParseNotification(<-channel).Text, "b")
+	checkEqual(t, ParseNotification(<-channel).Text, "c")
+
+	s.ReplayNotifications(channel, nil)
+	checkEqual(t, len(channel), 0)
+}
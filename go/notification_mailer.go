@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"net/smtp"
 	"net/url"
 	"strings"
 	"sync"
@@ -22,13 +21,21 @@ type MailerSettings struct {
 	Sender      string
 	Recipients  []string
 	MailRelay   string
+	Username    string
+	Password    string
+	Auth        string
+	TLS         string
+	TLSCAFile   string
+	HTML        bool
 }
 
 // MailerOptions contain pointers to the initial config and potentially a Consul
-// client.
+// client. DisableMail turns the mailer into a pure notification forwarder,
+// which only delivers to the configured webhooks.
 type MailerOptions struct {
 	Config       *Config
 	ConsulClient *consul.Client
+	DisableMail  bool
 }
 
 // MailerState contains mailer options and state variables.
@@ -40,6 +47,10 @@ type MailerState struct {
 	messages      chan string
 	readerDone    chan error
 	configChanges chan consul.Env
+	mail          *MailSink
+	webhooks      []NotificationSink
+	health        *MailerHealth
+	cursor        *NotificationCursor
 }
 
 // GetConfig returns the client configuration in a thread safe way.
@@ -68,6 +79,12 @@ func (opts *MailerOptions) GetMailerSettings() *MailerSettings {
 		Sender:      opts.Config.MailFrom,
 		Recipients:  strings.Split(opts.Config.MailTo, ","),
 		MailRelay:   opts.Config.MailRelay,
+		Username:    opts.Config.MailRelayUsername,
+		Password:    opts.Config.MailRelayPassword,
+		Auth:        opts.Config.MailRelayAuth,
+		TLS:         opts.Config.MailRelayTLS,
+		TLSCAFile:   opts.Config.MailRelayTLSCAFile,
+		HTML:        opts.Config.MailHTML,
 	}
 }
 
@@ -76,8 +93,12 @@ func (s *MailerState) Connect() (err error) {
 	// copy default dialer to avoid race conditions
 	dialer := *websocket.DefaultDialer
 	dialer.HandshakeTimeout = time.Duration(s.opts.Config.DialTimeout) * time.Second
+	dialer.TLSClientConfig, err = s.GetConfig().ClientTLSConfig()
+	if err != nil {
+		return
+	}
 	logInfo("connecting to %s, timeout: %s", s.url, dialer.HandshakeTimeout)
-	s.ws, _, err = dialer.Dial(s.url, nil)
+	s.ws, err = dialWebSocket(&dialer, s.url)
 	if err != nil {
 		return
 	}
@@ -95,17 +116,27 @@ func (s *MailerState) Close() {
 	}
 }
 
-// SendMail sends a notification mail with a given text as body. It
-// uses the net/smtp.
-func SendMail(text string, opts MailerOptions) error {
+// SendMail sends a notification mail with the notification text as body and a
+// subject derived from type, severity and system. HTML mails include a status
+// snapshot fetched from the configuration server. It uses the net/smtp.
+func SendMail(n *Notification, opts MailerOptions) error {
 	settings := opts.GetMailerSettings()
-	logInfo("sending message: %s using %v", text, settings)
-	to := strings.Join(settings.Recipients, ",")
-	from := settings.Sender
-	subject := "Beetle system notification"
-	body := text + "\n\n" + "SENT: " + time.Now().Format(time.RFC3339)
-	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", to, subject, body)
-	err := smtp.SendMail(settings.MailRelay, nil, from, settings.Recipients, []byte(msg))
+	logInfo("sending message: %s using relay %s (tls: %q, user: %q)", n.Text, settings.MailRelay, settings.TLS, settings.Username)
+	var status *ServerStatus
+	if settings.HTML {
+		var err error
+		status, err = FetchServerStatus(opts.Config)
+		if err != nil {
+			logError("could not include status snapshot: %s", err)
+			status = &ServerStatus{}
+		}
+	}
+	msg, err := BuildMail(n, settings, status, time.Now())
+	if err != nil {
+		err = permanentMailError{err}
+	} else {
+		err = deliverMail(settings, msg)
+	}
 	if err != nil {
 		logError("failed to send mail: %s", err)
 		return err
@@ -114,6 +145,14 @@ func SendMail(text string, opts MailerOptions) error {
 	return nil
 }
 
+// replaceWebhooks swaps in the webhooks of the given config. The old webhooks
+// are closed in the background, as closing waits for their pending deliveries.
+func (s *MailerState) replaceWebhooks(config *Config) {
+	old := s.webhooks
+	s.webhooks = NewWebhookSinks(config)
+	go CloseSinks(old)
+}
+
 // Reader reads notification messages from a websocket and forwards them on an
 // internal channel.
 func (s *MailerState) Reader() {
@@ -133,12 +172,33 @@ func (s *MailerState) Reader() {
 	close(s.readerDone)
 }
 
+// Sinks returns the sinks notifications are currently delivered to.
+func (s *MailerState) Sinks() []NotificationSink {
+	sinks := make([]NotificationSink, 0, len(s.webhooks)+1)
+	if s.mail != nil {
+		sinks = append(sinks, s.mail)
+	}
+	return append(sinks, s.webhooks...)
+}
+
+// Deliver parses the notification and hands it to all sinks.
+func (s *MailerState) Deliver(msg string) {
+	n := ParseNotification(msg)
+	if s.cursor != nil {
+		s.cursor.Advance(n)
+	}
+	for _, sink := range s.Sinks() {
+		sink.Deliver(n)
+	}
+}
+
 // RunMailer starts a reader which listens on a websocket for notification
-// messages and sends notification emails. It exits when a TERM signal has been
+// messages and sends notification emails and webhooks. It exits when a TERM signal has been
 // received or wthe the reader as terminated.
 func (s *MailerState) RunMailer() error {
 	var err error
 	if s.opts.ConsulClient != nil {
+		s.opts.ConsulClient.SetRetryBackoff(s.GetConfig().ReconnectBackoff())
 		s.configChanges, err = s.opts.ConsulClient.WatchConfig()
 		if err != nil {
 			return err
@@ -148,9 +208,13 @@ func (s *MailerState) RunMailer() error {
 	}
 	err = s.Connect()
 	if err != nil {
+		s.health.Connected(false, err)
 		return err
 	}
+	s.health.Connected(true, nil)
 	defer s.Close()
+	s.webhooks = NewWebhookSinks(s.GetConfig())
+	defer func() { CloseSinks(s.webhooks) }()
 	go s.Reader()
 	ticker := time.NewTicker(1 * time.Second)
 	tick := 0
@@ -161,13 +225,17 @@ func (s *MailerState) RunMailer() error {
 				logInfo("received HEARTBEAT from configuration server")
 				continue
 			}
-			SendMail(msg, *s.opts)
+			s.Deliver(msg)
 		case err := <-s.readerDone:
 			// If the reader has terminated, so should we.
+			s.health.Connected(false, err)
 			return err
 		case <-ticker.C:
 			// Give outer loop a chance to detect interrupts.
 			tick++
+			if s.mail != nil {
+				s.mail.Tick(time.Now())
+			}
 			// Send heartbeat to config server.
 			interval := s.GetConfig().ClientHeartbeat
 			if tick%interval == 0 {
@@ -181,30 +249,71 @@ func (s *MailerState) RunMailer() error {
 		case env := <-s.configChanges:
 			if env != nil {
 				newconfig := buildConfig(env)
-				s.SetConfig(newconfig)
+				oldconfig := s.SetConfig(newconfig)
 				logInfo("updated server config from consul: %s", s.GetConfig())
+				if oldconfig.NotificationWebhooks != newconfig.NotificationWebhooks {
+					s.replaceWebhooks(newconfig)
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// waitForReconnect sleeps for the given delay, retrying spooled mails while
+// waiting.
+func waitForReconnect(delay time.Duration, mail *MailSink) {
+	deadline := time.Now().Add(delay)
+	for !interrupted && time.Now().Before(deadline) {
+		wait := time.Until(deadline)
+		if wait > time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+		if mail != nil {
+			mail.Tick(time.Now())
+		}
+	}
+}
+
 // RunNotificationMailer runs a mailer, supervises and restarts it when it
 // exits, until a TERM signal has been received.
 func RunNotificationMailer(o MailerOptions) error {
 	logInfo("notification mailer started with options: %+v\n", o)
+	if o.DisableMail && o.Config.NotificationWebhooks == "" && o.ConsulClient == nil {
+		return fmt.Errorf("no notification webhooks configured")
+	}
+	retry := o.Config.ReconnectBackoff()
+	health := NewMailerHealth()
+	if address := o.Config.MailerHealthAddress; address != "" {
+		go RunMailerHealthServer(address, health)
+	}
+	var mail *MailSink
+	if !o.DisableMail {
+		mail = NewMailSink(&o, health)
+		defer mail.Close()
+	}
+	// The cursor survives reconnects, so that the server can replay the
+	// notifications sent while we were disconnected.
+	cursor := &NotificationCursor{}
 	for !interrupted {
+		started := time.Now()
 		addr := fmt.Sprintf("%s:%d", o.Config.Server, o.Config.Port)
-		u := url.URL{Scheme: "ws", Host: addr, Path: "/notifications"}
-		state := &MailerState{opts: &o, url: u.String(), messages: make(chan string, 100), readerDone: make(chan error, 1)}
+		query := url.Values{"format": {NOTIFICATION_FORMAT_JSON}}
+		if cursor.Sequence > 0 {
+			cursor.Query(query)
+		}
+		u := url.URL{Scheme: o.Config.WebSocketScheme(), Host: addr, Path: "/notifications", RawQuery: query.Encode()}
+		state := &MailerState{opts: &o, url: u.String(), mail: mail, health: health, cursor: cursor, messages: make(chan string, 100), readerDone: make(chan error, 1)}
 		err := state.RunMailer()
 		if err != nil {
 			logError("%s", err)
 			if !interrupted {
-				time.Sleep(1 * time.Second)
+				delay := retry.Failed(started)
+				logInfo("reconnecting in %s", delay)
+				waitForReconnect(delay, mail)
 			}
 		}
-
 	}
 	logInfo("notification mailer terminated")
 	return nil
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/xing/beetle/backoff"
+	"gopkg.in/yaml.v2"
+)
+
+// NotificationSink receives the notifications read from the configuration
+// server. Sinks must not block the mailer for long, as it also has to send
+// heartbeats to the server.
+type NotificationSink interface {
+	Name() string
+	Deliver(n *Notification)
+	Close()
+}
+
+// Webhook payload formats.
+const (
+	WEBHOOK_FORMAT_JSON       = "json"
+	WEBHOOK_FORMAT_SLACK      = "slack"
+	WEBHOOK_FORMAT_MATTERMOST = "mattermost"
+	WEBHOOK_FORMAT_TEMPLATE   = "template"
+)
+
+// Webhook defaults.
+const (
+	WEBHOOK_DEFAULT_RETRIES     = 3
+	WEBHOOK_DEFAULT_RETRY_DELAY = time.Second
+	WEBHOOK_MAX_RETRY_DELAY     = 30 * time.Second
+	WEBHOOK_TIMEOUT             = 10 * time.Second
+	WEBHOOK_QUEUE_SIZE          = 100
+)
+
+// WebhookSpec describes a single webhook, as configured in the
+// notification_webhooks option.
+type WebhookSpec struct {
+	Name        string            `yaml:"name" json:"name"`
+	URL         string            `yaml:"url" json:"url"`
+	Format      string            `yaml:"format" json:"format"`
+	Template    string            `yaml:"template" json:"template"`
+	Headers     map[string]string `yaml:"headers" json:"headers"`
+	Channel     string            `yaml:"channel" json:"channel"`
+	Username    string            `yaml:"username" json:"username"`
+	IconEmoji   string            `yaml:"icon_emoji" json:"icon_emoji"`
+	IconURL     string            `yaml:"icon_url" json:"icon_url"`
+	Include     string            `yaml:"include" json:"include"`
+	Exclude     string            `yaml:"exclude" json:"exclude"`
+	MinSeverity string            `yaml:"min_severity" json:"min_severity"`
+	Types       string            `yaml:"types" json:"types"`
+	Systems     string            `yaml:"systems" json:"systems"`
+	Retries     *int              `yaml:"retries" json:"retries"`
+	RetryDelay  string            `yaml:"retry_delay" json:"retry_delay"`
+}
+
+// ParseWebhookSpecs parses a YAML or JSON list of webhooks.
+func ParseWebhookSpecs(s string) ([]WebhookSpec, error) {
+	var specs []WebhookSpec
+	if strings.TrimSpace(s) == "" {
+		return specs, nil
+	}
+	if err := yaml.Unmarshal([]byte(s), &specs); err != nil {
+		return nil, fmt.Errorf("could not parse notification webhooks: %s", err)
+	}
+	return specs, nil
+}
+
+// WebhookData is passed to webhook templates. Besides the notification
+// fields, templates can use the host name of the mailer and the settings of
+// the webhook.
+type WebhookData struct {
+	Notification
+	Host     string
+	Sink     string
+	Channel  string
+	Username string
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// WebhookSink posts notifications to an HTTP endpoint. Notifications are
+// queued and delivered in order by a separate goroutine, which retries failed
+// deliveries with exponential backoff. Client errors other than 429 are not
+// retried, as they will not go away.
+type WebhookSink struct {
+	spec     WebhookSpec
+	name     string
+	include  *regexp.Regexp
+	exclude  *regexp.Regexp
+	filter   *NotificationFilter
+	template *template.Template
+	retries  int
+	retry    backoff.Backoff
+	client   *http.Client
+	queue    chan *Notification
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewWebhookSink validates the given spec and starts the delivery goroutine.
+func NewWebhookSink(spec WebhookSpec) (*WebhookSink, error) {
+	if spec.URL == "" {
+		return nil, fmt.Errorf("webhook without url")
+	}
+	w := &WebhookSink{
+		spec:    spec,
+		name:    spec.Name,
+		retries: WEBHOOK_DEFAULT_RETRIES,
+		client:  &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		queue:   make(chan *Notification, WEBHOOK_QUEUE_SIZE),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if w.name == "" {
+		w.name = spec.URL
+	}
+	var err error
+	if spec.Include != "" {
+		if w.include, err = regexp.Compile(spec.Include); err != nil {
+			return nil, fmt.Errorf("webhook %s: invalid include pattern: %s", w.name, err)
+		}
+	}
+	if spec.Exclude != "" {
+		if w.exclude, err = regexp.Compile(spec.Exclude); err != nil {
+			return nil, fmt.Errorf("webhook %s: invalid exclude pattern: %s", w.name, err)
+		}
+	}
+	if w.filter, err = NewNotificationFilter(spec.MinSeverity, spec.Types, spec.Systems); err != nil {
+		return nil, fmt.Errorf("webhook %s: %s", w.name, err)
+	}
+	switch spec.Format {
+	case "", WEBHOOK_FORMAT_JSON, WEBHOOK_FORMAT_SLACK, WEBHOOK_FORMAT_MATTERMOST:
+		if spec.Template != "" {
+			return nil, fmt.Errorf("webhook %s: templates require format '%s'", w.name, WEBHOOK_FORMAT_TEMPLATE)
+		}
+	case WEBHOOK_FORMAT_TEMPLATE:
+		if spec.Template == "" {
+			return nil, fmt.Errorf("webhook %s: missing template", w.name)
+		}
+		if w.template, err = template.New(w.name).Funcs(webhookTemplateFuncs).Parse(spec.Template); err != nil {
+			return nil, fmt.Errorf("webhook %s: invalid template: %s", w.name, err)
+		}
+	default:
+		return nil, fmt.Errorf("webhook %s: unknown format: %s", w.name, spec.Format)
+	}
+	if spec.Retries != nil {
+		if *spec.Retries < 0 {
+			return nil, fmt.Errorf("webhook %s: invalid number of retries: %d", w.name, *spec.Retries)
+		}
+		w.retries = *spec.Retries
+	}
+	delay := WEBHOOK_DEFAULT_RETRY_DELAY
+	if spec.RetryDelay != "" {
+		if delay, err = time.ParseDuration(spec.RetryDelay); err != nil || delay <= 0 {
+			return nil, fmt.Errorf("webhook %s: invalid retry delay: %s", w.name, spec.RetryDelay)
+		}
+	}
+	w.retry = backoff.Backoff{Min: delay, Max: WEBHOOK_MAX_RETRY_DELAY}
+	if w.retry.Max < delay {
+		w.retry.Max = delay
+	}
+	go w.run()
+	return w, nil
+}
+
+// Name returns the name of the webhook, or its URL if it has no name.
+func (w *WebhookSink) Name() string {
+	return w.name
+}
+
+// Accepts checks whether the given notification passes the filters of the
+// webhook. The include and exclude patterns are matched against the text.
+func (w *WebhookSink) Accepts(n *Notification) bool {
+	if !w.filter.Accepts(n) {
+		return false
+	}
+	if w.include != nil && !w.include.MatchString(n.Text) {
+		return false
+	}
+	if w.exclude != nil && w.exclude.MatchString(n.Text) {
+		return false
+	}
+	return true
+}
+
+// Deliver queues the notification for delivery, unless it is filtered.
+// Notifications are dropped if the queue is full.
+func (w *WebhookSink) Deliver(n *Notification) {
+	if !w.Accepts(n) {
+		logDebug("webhook %s: skipping notification: %s", w.name, n.Text)
+		return
+	}
+	select {
+	case w.queue <- n:
+	default:
+		logError("webhook %s: queue full, dropping notification: %s", w.name, n.Text)
+	}
+}
+
+// Close stops the delivery goroutine. Queued notifications are still sent,
+// but failed deliveries are no longer retried.
+func (w *WebhookSink) Close() {
+	w.once.Do(func() {
+		close(w.stop)
+		close(w.queue)
+	})
+	<-w.done
+}
+
+func (w *WebhookSink) run() {
+	defer close(w.done)
+	for n := range w.queue {
+		w.send(n)
+	}
+}
+
+// send posts a single notification, retrying as configured.
+func (w *WebhookSink) send(n *Notification) {
+	body, err := w.Payload(n)
+	if err != nil {
+		logError("webhook %s: %s", w.name, err)
+		return
+	}
+	w.retry.Reset()
+	for attempt := 0; ; attempt++ {
+		retryable, err := w.post(body)
+		if err == nil {
+			logInfo("webhook %s: delivered notification", w.name)
+			return
+		}
+		logError("webhook %s: delivery failed: %s", w.name, err)
+		if !retryable || attempt >= w.retries {
+			logError("webhook %s: giving up on notification: %s", w.name, n.Text)
+			return
+		}
+		select {
+		case <-time.After(w.retry.Next()):
+		case <-w.stop:
+			logError("webhook %s: shutting down, giving up on notification: %s", w.name, n.Text)
+			return
+		}
+	}
+}
+
+// post sends the body to the webhook. Returns whether a failure is worth
+// retrying.
+func (w *WebhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.spec.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "beetle/"+BEETLE_VERSION)
+	for k, v := range w.spec.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected response: %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Payload renders the JSON body posted for the given notification. Slack and
+// Mattermost incoming webhooks share the same basic payload.
+func (w *WebhookSink) Payload(n *Notification) ([]byte, error) {
+	data := w.data(n)
+	switch w.spec.Format {
+	case WEBHOOK_FORMAT_SLACK, WEBHOOK_FORMAT_MATTERMOST:
+		payload := map[string]string{"text": n.Text}
+		if w.spec.Channel != "" {
+			payload["channel"] = w.spec.Channel
+		}
+		if w.spec.Username != "" {
+			payload["username"] = w.spec.Username
+		}
+		if w.spec.IconEmoji != "" {
+			payload["icon_emoji"] = w.spec.IconEmoji
+		}
+		if w.spec.IconURL != "" {
+			payload["icon_url"] = w.spec.IconURL
+		}
+		return json.Marshal(payload)
+	case WEBHOOK_FORMAT_TEMPLATE:
+		var buf bytes.Buffer
+		if err := w.template.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("could not render template: %s", err)
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("template did not render valid JSON: %s", buf.String())
+		}
+		return buf.Bytes(), nil
+	default:
+		return json.Marshal(struct {
+			*Notification
+			Host   string `json:"host"`
+			Source string `json:"source"`
+		}{n, data.Host, "beetle"})
+	}
+}
+
+func (w *WebhookSink) data(n *Notification) WebhookData {
+	host, _ := os.Hostname()
+	return WebhookData{
+		Notification: *n,
+		Host:         host,
+		Sink:         w.name,
+		Channel:      w.spec.Channel,
+		Username:     w.spec.Username,
+	}
+}
+
+// MailSink sends notifications via SMTP, unless they are filtered by the
+// configured minimum severity and notification types. Mails are throttled as
+// configured. Mails the relay does not accept are spooled and retried. The
+// sink outlives websocket connections, so that reconnects do not reset the
+// throttle.
+type MailSink struct {
+	opts     *MailerOptions
+	throttle *MailThrottle
+	spool    *MailSpool
+	health   *MailerHealth
+	sendMail func(*Notification) error
+}
+
+// NewMailSink creates a mail sink, loading notifications spooled by previous
+// runs.
+func NewMailSink(opts *MailerOptions, health *MailerHealth) *MailSink {
+	m := &MailSink{
+		opts:     opts,
+		throttle: NewMailThrottle(),
+		spool:    NewMailSpool(opts.Config.MailSpoolDir, time.Duration(opts.Config.MailSpoolMaxAge)*time.Second),
+		health:   health,
+	}
+	m.sendMail = func(n *Notification) error {
+		err := SendMail(n, *m.opts)
+		m.health.MailSent(err)
+		return err
+	}
+	m.spoolChanged()
+	return m
+}
+
+// Name returns "smtp".
+func (m *MailSink) Name() string {
+	return "smtp"
+}
+
+// Accepts checks whether the notification should be mailed.
+func (m *MailSink) Accepts(n *Notification) bool {
+	config := m.opts.Config
+	filter, err := NewNotificationFilter(config.MailMinSeverity, config.MailNotificationTypes, "")
+	if err != nil {
+		logError("invalid mail filter, mailing all notifications: %s", err)
+		return true
+	}
+	return filter.Accepts(n)
+}
+
+// Deliver sends the notification mail, adds it to the digest or suppresses
+// it. The first mail sent after suppressing notifications of the same type
+// mentions how many have been suppressed.
+func (m *MailSink) Deliver(n *Notification) {
+	if !m.Accepts(n) {
+		logInfo("not mailing %s notification: %s", n.Severity, n.Text)
+		return
+	}
+	m.throttle.Configure(m.opts.Config)
+	switch m.throttle.Check(n, time.Now()) {
+	case MAIL_SUPPRESS:
+		logInfo("suppressing mail for notification: %s", n.Text)
+	case MAIL_DIGEST:
+		logInfo("adding notification to digest: %s", n.Text)
+	default:
+		if count := m.throttle.Suppressed(n.Type); count > 0 {
+			c := *n
+			c.Text += fmt.Sprintf("\n\n%d similar notifications have been suppressed since the last mail.", count)
+			n = &c
+		}
+		m.send(n)
+	}
+}
+
+// send mails the notification, or spools it if the relay does not accept it
+// for the time being. While older notifications are spooled, new ones are
+// spooled as well to keep the order, and the spool is retried right away, so
+// that new notifications do not wait for the next scheduled attempt.
+// Notifications the relay refuses permanently are dropped.
+func (m *MailSink) send(n *Notification) {
+	now := time.Now()
+	if m.spool.Size() > 0 {
+		m.spool.Add(n, nil, now)
+		m.spool.Flush(m.sendMail, now)
+	} else if err := m.sendMail(n); err != nil {
+		if IsTransientMailError(err) {
+			m.spool.Add(n, err, now)
+		} else {
+			logError("dropping notification, mail relay refused it permanently: %s: %s", err, n.Text)
+		}
+	}
+	m.spoolChanged()
+}
+
+func (m *MailSink) spoolChanged() {
+	m.health.SpoolChanged(m.spool.Size(), m.spool.Oldest())
+}
+
+// Tick is called every second to send due digests, to retry spooled mails
+// and to expire old deduplication entries.
+func (m *MailSink) Tick(now time.Time) {
+	m.throttle.Configure(m.opts.Config)
+	if m.throttle.DigestDue(now) {
+		m.send(m.throttle.TakeDigest())
+	}
+	if m.spool.Due(now) {
+		m.spool.Flush(m.sendMail, now)
+		m.spoolChanged()
+	}
+	m.throttle.Expire(now)
+}
+
+// Close mails collected notifications, so that they do not get lost on
+// shutdown. If the relay is unavailable, they end up in the spool.
+func (m *MailSink) Close() {
+	if digest := m.throttle.TakeDigest(); digest != nil {
+		m.send(digest)
+	}
+	if m.spool.Size() > 0 {
+		logWarn("mailer terminating with %d spooled notifications", m.spool.Size())
+	}
+}
+
+// NewWebhookSinks creates sinks for all configured webhooks. Invalid webhooks
+// are logged and skipped, so that one broken definition does not silence the
+// others.
+func NewWebhookSinks(config *Config) []NotificationSink {
+	sinks := make([]NotificationSink, 0)
+	specs, err := ParseWebhookSpecs(config.NotificationWebhooks)
+	if err != nil {
+		logError("%s", err)
+		return sinks
+	}
+	for _, spec := range specs {
+		sink, err := NewWebhookSink(spec)
+		if err != nil {
+			logError("%s", err)
+			continue
+		}
+		logInfo("forwarding notifications to webhook %s", sink.Name())
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// CloseSinks closes all given sinks.
+func CloseSinks(sinks []NotificationSink) {
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStandIn records the bodies posted to it and fails the first
+// failures requests with the given status code.
+type webhookStandIn struct {
+	mutex    sync.Mutex
+	server   *httptest.Server
+	failures int
+	status   int
+	requests int
+	bodies   []map[string]interface{}
+	headers  []http.Header
+	received chan struct{}
+}
+
+func newWebhookStandIn(t *testing.T, failures int, status int) *webhookStandIn {
+	h := &webhookStandIn{failures: failures, status: status, received: make(chan struct{}, 100)}
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mutex.Lock()
+		defer func() {
+			h.mutex.Unlock()
+			h.received <- struct{}{}
+		}()
+		h.requests++
+		if h.requests <= h.failures {
+			w.WriteHeader(h.status)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("webhook received invalid JSON: %s", b)
+		}
+		h.bodies = append(h.bodies, body)
+		h.headers = append(h.headers, r.Header)
+	}))
+	return h
+}
+
+func (h *webhookStandIn) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-h.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook received only %d of %d requests", i, n)
+		}
+	}
+}
+
+func TestParseWebhookSpecs(t *testing.T) {
+	specs, err := ParseWebhookSpecs(`[{"name": "chat", "url": "http://localhost/hook", "format": "slack", "retries": 0}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, len(specs), 1)
+	checkEqual(t, specs[0].Name, "chat")
+	checkEqual(t, specs[0].Format, WEBHOOK_FORMAT_SLACK)
+	checkEqual(t, *specs[0].Retries, 0)
+	specs, err = ParseWebhookSpecs("- url: http://localhost/a\n  include: switch\n- url: http://localhost/b\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, len(specs), 2)
+	checkEqual(t, specs[0].Include, "switch")
+	if _, err := ParseWebhookSpecs("url: http://localhost"); err == nil {
+		t.Errorf("expected an error for a webhook which is not in a list")
+	}
+}
+
+func TestNewWebhookSinkValidatesSpec(t *testing.T) {
+	negative := -1
+	invalid := []WebhookSpec{
+		{},
+		{URL: "http://localhost", Format: "xml"},
+		{URL: "http://localhost", Format: WEBHOOK_FORMAT_TEMPLATE},
+		{URL: "http://localhost", Template: `{"a": 1}`},
+		{URL: "http://localhost", Format: WEBHOOK_FORMAT_TEMPLATE, Template: "{{ .Text "},
+		{URL: "http://localhost", Include: "("},
+		{URL: "http://localhost", MinSeverity: "fatal"},
+		{URL: "http://localhost", Retries: &negative},
+		{URL: "http://localhost", RetryDelay: "soon"},
+	}
+	for _, spec := range invalid {
+		if sink, err := NewWebhookSink(spec); err == nil {
+			sink.Close()
+			t.Errorf("expected an error for %+v", spec)
+		}
+	}
+}
+
+func TestWebhookPayloads(t *testing.T) {
+	h := newWebhookStandIn(t, 0, 0)
+	defer h.server.Close()
+	specs := []WebhookSpec{
+		{Name: "json", URL: h.server.URL},
+		{Name: "slack", URL: h.server.URL, Format: WEBHOOK_FORMAT_SLACK, Channel: "#ops", Username: "beetle", IconEmoji: ":beetle:"},
+		{Name: "template", URL: h.server.URL, Format: WEBHOOK_FORMAT_TEMPLATE, Template: `{"message": {{ json .Text }}, "sink": {{ json .Sink }}, "severity": {{ json .Severity }}}`, Headers: map[string]string{"X-Token": "secret"}},
+	}
+	for _, spec := range specs {
+		sink, err := NewWebhookSink(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Deliver(&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, System: "beetle", Text: `master "switched"`})
+		h.wait(t, 1)
+		sink.Close()
+	}
+	checkEqual(t, len(h.bodies), 3)
+	checkEqual(t, h.bodies[0]["text"], `master "switched"`)
+	checkEqual(t, h.bodies[0]["source"], "beetle")
+	checkEqual(t, h.bodies[0]["type"], EVENT_MASTER_SWITCHED)
+	checkEqual(t, h.bodies[0]["system"], "beetle")
+	checkEqual(t, h.bodies[1]["text"], `master "switched"`)
+	checkEqual(t, h.bodies[1]["channel"], "#ops")
+	checkEqual(t, h.bodies[1]["username"], "beetle")
+	checkEqual(t, h.bodies[1]["icon_emoji"], ":beetle:")
+	checkEqual(t, h.bodies[2]["message"], `master "switched"`)
+	checkEqual(t, h.bodies[2]["sink"], "template")
+	checkEqual(t, h.bodies[2]["severity"], SEVERITY_CRITICAL)
+	checkEqual(t, h.headers[2].Get("X-Token"), "secret")
+	checkEqual(t, h.headers[2].Get("Content-Type"), "application/json")
+}
+
+func TestWebhookTemplateMustRenderJSON(t *testing.T) {
+	sink, err := NewWebhookSink(WebhookSpec{URL: "http://localhost", Format: WEBHOOK_FORMAT_TEMPLATE, Template: `{"text": "{{ .Text }}"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if _, err := sink.Payload(NewTextNotification(`a "quoted" text`)); err == nil {
+		t.Errorf("expected an error for a template rendering invalid JSON")
+	}
+}
+
+func TestWebhookFiltering(t *testing.T) {
+	sink, err := NewWebhookSink(WebhookSpec{URL: "http://localhost", Include: "(?i)master", Exclude: "heartbeat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	checkEqual(t, sink.Accepts(NewTextNotification("Setting redis master to 127.0.0.1:7002")), true)
+	checkEqual(t, sink.Accepts(NewTextNotification("Received unknown client heartbeat from master-checker")), false)
+	checkEqual(t, sink.Accepts(NewTextNotification("Redis server 127.0.0.1:7001 not available")), false)
+}
+
+func TestWebhookFilteringByNotificationFields(t *testing.T) {
+	sink, err := NewWebhookSink(WebhookSpec{URL: "http://localhost", MinSeverity: SEVERITY_ERROR, Systems: "beetle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	checkEqual(t, sink.Accepts(&Notification{Severity: SEVERITY_CRITICAL, System: "beetle"}), true)
+	checkEqual(t, sink.Accepts(&Notification{Severity: SEVERITY_CRITICAL, System: "other"}), false)
+	checkEqual(t, sink.Accepts(&Notification{Severity: SEVERITY_WARNING, System: "beetle"}), false)
+	checkEqual(t, sink.Accepts(&Notification{Severity: SEVERITY_ERROR}), true)
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	h := newWebhookStandIn(t, 2, http.StatusBadGateway)
+	defer h.server.Close()
+	retries := 2
+	sink, err := NewWebhookSink(WebhookSpec{URL: h.server.URL, Retries: &retries, RetryDelay: "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Deliver(NewTextNotification("master switched"))
+	h.wait(t, 3)
+	sink.Close()
+	checkEqual(t, h.requests, 3)
+	checkEqual(t, len(h.bodies), 1)
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	h := newWebhookStandIn(t, 1, http.StatusNotFound)
+	defer h.server.Close()
+	sink, err := NewWebhookSink(WebhookSpec{URL: h.server.URL, RetryDelay: "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Deliver(NewTextNotification("master switched"))
+	h.wait(t, 1)
+	sink.Close()
+	checkEqual(t, h.requests, 1)
+	checkEqual(t, len(h.bodies), 0)
+}
+
+func TestNewWebhookSinksSkipsInvalidWebhooks(t *testing.T) {
+	config := &Config{NotificationWebhooks: "- url: http://localhost/a\n- format: slack\n"}
+	sinks := NewWebhookSinks(config)
+	defer CloseSinks(sinks)
+	checkEqual(t, len(sinks), 1)
+	checkEqual(t, sinks[0].Name(), "http://localhost/a")
+}
+
+func TestForwarderOnlyDeliversToWebhooks(t *testing.T) {
+	s := &MailerState{opts: &MailerOptions{Config: &Config{}, DisableMail: true}}
+	checkEqual(t, len(s.Sinks()), 0)
+	s.mail = NewMailSink(s.opts, NewMailerHealth())
+	checkEqual(t, s.Sinks()[0].Name(), "smtp")
+}
+
+// slowClosingSink blocks closing until released.
+type slowClosingSink struct {
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (b *slowClosingSink) Name() string            { return "slow" }
+func (b *slowClosingSink) Deliver(n *Notification) {}
+func (b *slowClosingSink) Close() {
+	<-b.release
+	close(b.closed)
+}
+
+func TestReplacingWebhooksDoesNotWaitForOldOnes(t *testing.T) {
+	old := &slowClosingSink{release: make(chan struct{}), closed: make(chan struct{})}
+	s := &MailerState{opts: &MailerOptions{Config: &Config{}}, webhooks: []NotificationSink{old}}
+	s.replaceWebhooks(&Config{NotificationWebhooks: "- url: http://localhost/a\n"})
+	defer CloseSinks(s.webhooks)
+	checkEqual(t, len(s.webhooks), 1)
+	checkEqual(t, s.webhooks[0].Name(), "http://localhost/a")
+	close(old.release)
+	select {
+	case <-old.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("old webhook was not closed")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseNotification(t *testing.T) {
+	n := &Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, System: "beetle", OldMaster: "127.0.0.1:7001", NewMaster: "127.0.0.1:7002", Token: "3", Text: "switched"}
+	parsed := ParseNotification(n.Encode(NOTIFICATION_FORMAT_JSON))
+	checkEqual(t, *parsed, *n)
+	checkEqual(t, n.Encode(NOTIFICATION_FORMAT_TEXT), "switched")
+
+	legacy := ParseNotification("Redis master '127.0.0.1:7001' not available")
+	checkEqual(t, legacy.Type, NOTIFICATION_MESSAGE)
+	checkEqual(t, legacy.Severity, SEVERITY_INFO)
+	checkEqual(t, legacy.Text, "Redis master '127.0.0.1:7001' not available")
+
+	checkEqual(t, ParseNotification(`{"text": "no type"}`).Text, `{"text": "no type"}`)
+}
+
+func TestNotificationSubject(t *testing.T) {
+	n := &Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, System: "beetle"}
+	checkEqual(t, n.Subject(), "Beetle CRITICAL: master switched (beetle)")
+	n = &Notification{Type: NOTIFICATION_LEADER_CHANGED, Severity: SEVERITY_WARNING}
+	checkEqual(t, n.Subject(), "Beetle WARNING: leader changed")
+	checkEqual(t, NewTextNotification("hello").Subject(), "Beetle system notification")
+}
+
+func TestNotificationFilter(t *testing.T) {
+	if _, err := NewNotificationFilter("fatal", "", ""); err == nil {
+		t.Errorf("expected an error for an unknown severity")
+	}
+	f, err := NewNotificationFilter(SEVERITY_WARNING, "master_switched, unknown_client", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, f.Accepts(&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL}), true)
+	checkEqual(t, f.Accepts(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_INFO}), false)
+	checkEqual(t, f.Accepts(&Notification{Type: EVENT_MASTER_UNAVAILABLE, Severity: SEVERITY_ERROR}), false)
+	var none *NotificationFilter
+	checkEqual(t, none.Accepts(NewTextNotification("anything")), true)
+}
+
+func TestMailSinkFiltersNotifications(t *testing.T) {
+	sink := &MailSink{opts: &MailerOptions{Config: &Config{MailMinSeverity: SEVERITY_ERROR, MailNotificationTypes: "master_unavailable,master_switched"}}}
+	checkEqual(t, sink.Accepts(&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL}), true)
+	checkEqual(t, sink.Accepts(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_CRITICAL}), false)
+	checkEqual(t, sink.Accepts(&Notification{Type: EVENT_MASTER_UNAVAILABLE, Severity: SEVERITY_INFO}), false)
+}
+
+func TestFailoverNotificationsCarrySystemAndToken(t *testing.T) {
+	config := Config{
+		ClientTimeout: 1,
+		RedisServers:  "beetle/127.0.0.1:1,127.0.0.1:2",
+	}
+	s := NewServerState(ServerOptions{Config: &config})
+	fs := s.failovers["beetle"]
+	fs.currentToken = "42"
+	channel := make(StringChannel, 10)
+	s.AddNotification(channel)
+	fs.SendNotification(&Notification{Type: EVENT_MASTER_UNAVAILABLE, Severity: SEVERITY_ERROR, Text: "gone"})
+	n := ParseNotification(<-channel)
+	checkEqual(t, n.Type, EVENT_MASTER_UNAVAILABLE)
+	checkEqual(t, n.System, "beetle")
+	checkEqual(t, n.Token, "42")
+	checkEqual(t, n.Time.IsZero(), false)
+}
+
+func TestNotificationWriterConvertsForTextListeners(t *testing.T) {
+	s := NewServerState(ServerOptions{Config: &Config{ClientHeartbeat: 60}})
+	for _, format := range []string{NOTIFICATION_FORMAT_JSON, NOTIFICATION_FORMAT_TEXT} {
+		input := make(chan string, 1)
+		upgrader := websocket.Upgrader{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer ws.Close()
+			s.notificationWriter(ws, input, format)
+		}))
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input <- (&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, Text: "switched"}).Encode(NOTIFICATION_FORMAT_JSON)
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format == NOTIFICATION_FORMAT_TEXT {
+			checkEqual(t, string(data), "switched")
+		} else {
+			checkEqual(t, ParseNotification(string(data)).Type, EVENT_MASTER_SWITCHED)
+		}
+		close(input)
+		ws.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PlannedSwitchResult is sent to the dispatcher when a background step of a
+// planned switch has completed: either a check of the replication lag of the
+// target, or the final promotion of the target.
+type PlannedSwitchResult struct {
+	system     string
+	target     *RedisShim // The target of the planned switch, lag results are discarded if it has been aborted meanwhile.
+	lag        int64      // Replication lag of the target.
+	err        error      // Error determining the lag or promoting the target.
+	promotion  bool       // Whether the result belongs to the promotion of the target.
+	offsetInfo string     // Replication offset of the target before its promotion.
+	demoteErr  error      // Error turning the old master into a slave of the target.
+}
+
+// PlannedSwitchInProgress checks whether a planned master switch is in progress.
+func (s *FailoverState) PlannedSwitchInProgress() bool {
+	return s.plannedTarget != nil
+}
+
+// StartPlannedSwitch initiates a handover of the master role to a slave of the
+// current master, while the current master is still available. If no target
+// is given, the new master is selected as for a regular switch. The switch
+// proceeds in three steps: waiting for the target to catch up with the
+// master, running the usual vote with all clients and finally promoting the
+// target and demoting the old master.
+func (s *FailoverState) StartPlannedSwitch(target string) error {
+	if s.WatcherPaused() {
+		return errors.New("a master switch is already in progress")
+	}
+	// the cached redis info is good enough, as the target has to catch up
+	// with the master before anything is changed
+	if !s.MasterIsAvailable() {
+		return fmt.Errorf("redis master '%s' is not available", s.currentMaster.server)
+	}
+	slaves := s.redis.SlavesOf(s.currentMaster)
+	var newMaster *RedisShim
+	if target == "" {
+		newMaster = s.SelectNewMaster(slaves)
+	} else {
+		for _, slave := range slaves {
+			if slave.server == target {
+				newMaster = slave
+			}
+		}
+	}
+	if newMaster == nil {
+		if target != "" {
+			return fmt.Errorf("'%s' is not an available slave of '%s'", target, s.currentMaster.server)
+		}
+		return fmt.Errorf("no available slave of '%s'", s.currentMaster.server)
+	}
+	s.PauseWatcher()
+	s.plannedTarget = newMaster
+	s.catchingUp = true
+	s.plannedDeadline = time.Now().Add(time.Duration(s.GetConfig().PlannedSwitchTimeout) * time.Second)
+	msg := fmt.Sprintf("Planned switch of redis master from '%s' to '%s' initiated", s.currentMaster.server, newMaster.server)
+	logWarn(msg)
+	s.SendNotification(&Notification{Type: EVENT_PLANNED_SWITCH_STARTED, Severity: SEVERITY_WARNING, OldMaster: s.currentMaster.server, NewMaster: newMaster.server, Text: msg})
+	s.RecordEvent(HistoryEvent{Event: EVENT_PLANNED_SWITCH_STARTED, NewMaster: newMaster.server})
+	s.StartCatchUpCheck()
+	return nil
+}
+
+// StartCatchUpCheck determines the replication lag of the target of a planned
+// switch in the background, unless a check is already running. It is called
+// every second while waiting for the target to catch up. The result is
+// delivered to the dispatcher on the planned switch channel.
+func (s *FailoverState) StartCatchUpCheck() {
+	if s.checkingCatchUp {
+		return
+	}
+	s.checkingCatchUp = true
+	master, target, results := s.currentMaster, s.plannedTarget, s.server.plannedSwitchChannel
+	system := s.system
+	go func() {
+		lag, err := ReplicationLag(master, target)
+		results <- &PlannedSwitchResult{system: system, target: target, lag: lag, err: err}
+	}()
+}
+
+// CheckPlannedSwitchCatchUp handles the replication lag of the target of a
+// planned switch. Once the replication offsets match, it starts the vote.
+// Gives up when the configured planned switch timeout has been exceeded.
+func (s *FailoverState) CheckPlannedSwitchCatchUp(lag int64, err error) {
+	if err == nil && lag <= 0 {
+		logInfo("Planned master '%s' has caught up with '%s'", s.plannedTarget.server, s.currentMaster.server)
+		s.catchingUp = false
+		if len(s.ClientIds()) == 0 {
+			s.SwitchMaster()
+		} else {
+			s.StartInvalidation()
+		}
+		return
+	}
+	if err != nil {
+		logWarn("Could not determine replication lag of '%s': %s", s.plannedTarget.server, err)
+	} else {
+		logInfo("Planned master '%s' lags %d bytes behind '%s'", s.plannedTarget.server, lag, s.currentMaster.server)
+	}
+	if time.Now().After(s.plannedDeadline) {
+		s.AbortPlannedSwitch(fmt.Sprintf("'%s' did not catch up with '%s' in time", s.plannedTarget.server, s.currentMaster.server))
+	}
+}
+
+// AbortPlannedSwitch gives up on a planned switch, sends a notification and
+// resumes watching the current master. A switch cannot be aborted once the
+// target is being promoted.
+func (s *FailoverState) AbortPlannedSwitch(reason string) {
+	if s.promoting {
+		logWarn("Cannot abort planned switch to '%s' (%s): promotion in progress", s.plannedTarget.server, reason)
+		return
+	}
+	msg := fmt.Sprintf("Planned switch of redis master to '%s' aborted: %s", s.plannedTarget.server, reason)
+	logError(msg)
+	s.SendNotification(&Notification{Type: EVENT_SWITCH_ABORTED, Severity: SEVERITY_ERROR, OldMaster: s.currentMaster.server, NewMaster: s.plannedTarget.server, Text: msg})
+	s.RecordEvent(HistoryEvent{Event: EVENT_SWITCH_ABORTED, NewMaster: s.plannedTarget.server, Details: msg})
+	s.plannedTarget = nil
+	s.catchingUp = false
+	s.StartWatcher()
+}
+
+// plannedSwitchFinalCatchUpTimeout limits the time spent waiting for the last
+// writes to arrive at the new master after all clients have been invalidated.
+const plannedSwitchFinalCatchUpTimeout = 5 * time.Second
+
+// CompletePlannedSwitch is called after a successful vote during a planned
+// switch. Since clients have stopped writing to the old master, it waits a
+// short time for the remaining writes to be replicated, then promotes the
+// target and turns the old master into a slave of the new master. All of this
+// happens in the background, the result is handled by FinishPlannedSwitch.
+func (s *FailoverState) CompletePlannedSwitch() {
+	s.catchingUp = false
+	s.promoting = true
+	oldMaster, newMaster, results := s.currentMaster, s.plannedTarget, s.server.plannedSwitchChannel
+	system := s.system
+	go func() {
+		res := &PlannedSwitchResult{system: system, target: newMaster, promotion: true}
+		deadline := time.Now().Add(plannedSwitchFinalCatchUpTimeout)
+		for {
+			lag, err := ReplicationLag(oldMaster, newMaster)
+			if err == nil && lag <= 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				logWarn("Promoting '%s' although it has not fully caught up with '%s' (lag: %d, error: %v)", newMaster.server, oldMaster.server, lag, err)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		res.offsetInfo = "replication offset: unknown"
+		if offset, err := newMaster.ReplicationOffset(); err == nil {
+			res.offsetInfo = fmt.Sprintf("replication offset: %d", offset)
+		}
+		if res.err = newMaster.MakeMaster(); res.err == nil {
+			res.demoteErr = oldMaster.RedisMakeSlave(newMaster.host, newMaster.port)
+		}
+		results <- res
+	}()
+}
+
+// FinishPlannedSwitch applies the result of the promotion of the target of a
+// planned switch, sends notifications and resumes watching the master.
+func (s *FailoverState) FinishPlannedSwitch(res *PlannedSwitchResult) {
+	oldMaster, newMaster := s.currentMaster, res.target
+	s.plannedTarget = nil
+	s.promoting = false
+	if res.err != nil {
+		msg := fmt.Sprintf("Planned switch of redis master to '%s' failed, keeping '%s': %s", newMaster.server, oldMaster.server, res.err)
+		logError(msg)
+		s.SendNotification(&Notification{Type: EVENT_SWITCH_ABORTED, Severity: SEVERITY_ERROR, OldMaster: oldMaster.server, NewMaster: newMaster.server, Text: msg})
+		s.RecordEvent(HistoryEvent{Event: EVENT_SWITCH_ABORTED, NewMaster: newMaster.server, Details: msg})
+	} else {
+		msg := fmt.Sprintf("Setting redis master to '%s' (was '%s', planned switch, %s)", newMaster.server, oldMaster.server, res.offsetInfo)
+		logWarn(msg)
+		s.SendNotification(&Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, OldMaster: oldMaster.server, NewMaster: newMaster.server, Text: msg})
+		s.currentMaster = newMaster
+		s.switchCount++
+		s.server.UpdateMasterFile()
+		s.server.PublishSwitchMaster(s.system, oldMaster.server, newMaster.server)
+		s.RecordEvent(HistoryEvent{Event: EVENT_MASTER_SWITCHED, Master: oldMaster.server, NewMaster: newMaster.server, Details: msg})
+		if res.demoteErr != nil {
+			msg := fmt.Sprintf("Could not turn old redis master '%s' into a slave of '%s': %s", oldMaster.server, newMaster.server, res.demoteErr)
+			logError(msg)
+			s.SendNotification(&Notification{Type: NOTIFICATION_MESSAGE, Severity: SEVERITY_ERROR, OldMaster: oldMaster.server, NewMaster: newMaster.server, Text: msg})
+		}
+	}
+	s.PublishMaster(s.currentMaster.server)
+	s.StartWatcher()
+}
+
+// handlePlannedSwitchResult applies the result of a background step of a
+// planned switch.
+func (s *ServerState) handlePlannedSwitchResult(res *PlannedSwitchResult) {
+	fs := s.failovers[res.system]
+	if fs == nil {
+		return
+	}
+	if res.promotion {
+		fs.FinishPlannedSwitch(res)
+		return
+	}
+	fs.checkingCatchUp = false
+	if !fs.catchingUp || fs.plannedTarget != res.target {
+		logDebug("discarding replication lag of '%s', planned switch is no longer waiting for it", res.target.server)
+		return
+	}
+	fs.CheckPlannedSwitchCatchUp(res.lag, res.err)
+}
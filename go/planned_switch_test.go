@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newPlannedSwitchTestState() (*ServerState, *FailoverState) {
+	s := NewServerState(serverTestOptions)
+	fs := s.failovers["beetle"]
+	fs.currentMaster = NewRedisShim("127.0.0.1:7001")
+	fs.plannedTarget = NewRedisShim("127.0.0.1:7002")
+	fs.PauseWatcher()
+	return s, fs
+}
+
+func TestPlannedSwitchCatchUpIsCheckedInTheBackground(t *testing.T) {
+	s, fs := newPlannedSwitchTestState()
+	fs.catchingUp = true
+	fs.plannedDeadline = time.Now().Add(-time.Second)
+	fs.StartCatchUpCheck()
+	checkEqual(t, fs.checkingCatchUp, true)
+	var res *PlannedSwitchResult
+	select {
+	case res = <-s.plannedSwitchChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replication lag was not reported")
+	}
+	checkEqual(t, res.promotion, false)
+	s.handlePlannedSwitchResult(res)
+	checkEqual(t, fs.checkingCatchUp, false)
+	checkEqual(t, fs.PlannedSwitchInProgress(), false)
+	checkEqual(t, fs.WatcherPaused(), false)
+}
+
+func TestPlannedSwitchCannotBeAbortedDuringPromotion(t *testing.T) {
+	s, fs := newPlannedSwitchTestState()
+	target := fs.plannedTarget
+	fs.CompletePlannedSwitch()
+	fs.AbortPlannedSwitch("lost leadership")
+	checkEqual(t, fs.PlannedSwitchInProgress(), true)
+
+	s.handlePlannedSwitchResult(&PlannedSwitchResult{system: "beetle", target: target, promotion: true, err: errors.New("connection refused")})
+	checkEqual(t, fs.PlannedSwitchInProgress(), false)
+	checkEqual(t, fs.currentMaster.server, "127.0.0.1:7001")
+	checkEqual(t, fs.WatcherPaused(), false)
+	checkEqual(t, s.history.Recent("beetle", 1)[0].Event, EVENT_SWITCH_ABORTED)
+}
+
+func TestFinishPlannedSwitchReportsFailedDemotion(t *testing.T) {
+	s, fs := newPlannedSwitchTestState()
+	channel := make(chan string, 10)
+	s.AddNotification(channel)
+	target := fs.plannedTarget
+	fs.promoting = true
+	fs.FinishPlannedSwitch(&PlannedSwitchResult{system: "beetle", target: target, promotion: true, demoteErr: errors.New("connection refused")})
+	checkEqual(t, fs.currentMaster.server, "127.0.0.1:7002")
+	checkEqual(t, ParseNotification(<-channel).Type, EVENT_MASTER_SWITCHED)
+	n := ParseNotification(<-channel)
+	checkEqual(t, n.Severity, SEVERITY_ERROR)
+	checkEqual(t, n.OldMaster, "127.0.0.1:7001")
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
@@ -24,8 +23,18 @@ func RedisMastersFromMasterFile(path string) map[string]string {
 	return UnmarshalMasterFileContent(s)
 }
 
-// UnmarshalMasterFileContent parses masterfile content.
+// UnmarshalMasterFileContent parses masterfile content. Besides the legacy
+// text format, the structured JSON and YAML formats are recognized.
 func UnmarshalMasterFileContent(s string) map[string]string {
+	if IsStructuredMasterFileContent(s) {
+		return ParseMasterFile(s).Masters()
+	}
+	return unmarshalLegacyMasterFileContent(s)
+}
+
+// unmarshalLegacyMasterFileContent parses lines of the form system/host:port,
+// or a single host:port line for the system named "system".
+func unmarshalLegacyMasterFileContent(s string) map[string]string {
 	m := make(map[string]string, 0)
 	for _, line := range strings.Split(s, "\n") {
 		if line == "" {
@@ -71,25 +80,12 @@ func ReadRedisMasterFile(path string) string {
 	return strings.TrimRight(string(b), "\n")
 }
 
-// WriteRedisMasterFile writes given string into file at given path, creating it
-// if necessary. Returns an error if the file cannot be created.
+// WriteRedisMasterFile atomically writes given string into file at given path,
+// creating it if necessary. Returns an error if the file cannot be written.
+// See UpdateRedisMasterFile for keeping the previous content and change hooks.
 func WriteRedisMasterFile(path string, content string) error {
-	trimmed := strings.TrimRight(content, "\n")
-	escaped := strings.Replace(trimmed, "\n", "\\n", -1)
-	logInfo("writing '%s' to redis master file '%s'", escaped, path)
-	f, err := os.Create(path)
-	if err != nil {
-		logError("could not create master file '%s': %s", path, err)
-		return err
-	}
-	defer f.Close()
-
-	_, err = io.Copy(f, strings.NewReader(trimmed))
-	if err != nil {
-		logError("could not write master file '%s': %s", path, err)
-		return err
-	}
-	return nil
+	_, err := UpdateRedisMasterFile(path, content, MasterFileOptions{})
+	return err
 }
 
 // VerifyMasterFileString checks that the given path does not look like a
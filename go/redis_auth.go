@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// RedisConnectionOptions holds the credentials and TLS settings used when
+// connecting to a redis server.
+type RedisConnectionOptions struct {
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+}
+
+var (
+	redisOptionsMutex   sync.Mutex
+	redisDefaultOptions RedisConnectionOptions                    // Settings from the configuration.
+	redisServerOptions  = make(map[string]RedisConnectionOptions) // Credentials given in server specs (host:port).
+)
+
+// ConfigureRedisConnections sets up credentials and TLS for all redis
+// connections created afterwards. Existing connections are not affected.
+func ConfigureRedisConnections(c *Config) error {
+	options := RedisConnectionOptions{Username: c.RedisUsername}
+	var err error
+	if options.Password, err = resolveSecret(c.RedisPassword); err != nil {
+		return err
+	}
+	if options.Password == "" && c.RedisPasswordFile != "" {
+		if options.Password, err = resolveSecret("file:" + c.RedisPasswordFile); err != nil {
+			return err
+		}
+	}
+	if options.TLSConfig, err = c.RedisTLSConfig(); err != nil {
+		return err
+	}
+	redisOptionsMutex.Lock()
+	redisDefaultOptions = options
+	redisOptionsMutex.Unlock()
+	// Register the credentials given in the server specs, so that commands
+	// which only read host:port from the master file can use them as well.
+	for _, set := range c.FailoverSets() {
+		for _, spec := range strings.Split(set.spec, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			if _, err := ParseRedisServerSpec(spec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RedisTLSConfig creates the TLS configuration for redis connections. Returns
+// nil if TLS is disabled. As for the ruby client, certificate verification can
+// be disabled by setting OPENSSL_SSL_VERIFY_NONE=1 in the environment.
+func (c *Config) RedisTLSConfig() (*tls.Config, error) {
+	if !c.RedisTLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.RedisTLSCAFile != "" {
+		pool, err := loadCertPool(c.RedisTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if c.RedisTLSCertFile != "" || c.RedisTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.RedisTLSCertFile, c.RedisTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load redis client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if os.Getenv("OPENSSL_SSL_VERIFY_NONE") == "1" {
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// resolveSecret returns the given value, unless it references an environment
+// variable ("env:NAME") or a file ("file:/path/to/secret").
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("could not read secret: %s", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return value, nil
+}
+
+// ParseRedisServerSpec splits a redis server spec of the form
+// [[username]:password@]host:port into the server (host:port) and the
+// credentials. A spec of the form password@host:port is accepted as well. The
+// password may reference a secret as described for resolveSecret, but then the
+// leading colon is required (":env:NAME@host:port"). Credentials are remembered and used for all connections to
+// the server created afterwards, so that only host:port needs to be passed
+// around (and written to the master file).
+func ParseRedisServerSpec(spec string) (string, error) {
+	i := strings.LastIndex(spec, "@")
+	if i < 0 {
+		return spec, nil
+	}
+	userinfo, server := spec[:i], spec[i+1:]
+	var options RedisConnectionOptions
+	if j := strings.Index(userinfo, ":"); j >= 0 {
+		options.Username, options.Password = userinfo[:j], userinfo[j+1:]
+	} else {
+		options.Password = userinfo
+	}
+	var err error
+	if options.Password, err = resolveSecret(options.Password); err != nil {
+		return server, fmt.Errorf("redis server %s: %s", server, err)
+	}
+	redisOptionsMutex.Lock()
+	defer redisOptionsMutex.Unlock()
+	redisServerOptions[server] = options
+	return server, nil
+}
+
+// MaskRedisCredentials replaces passwords in a list of redis server specs.
+func MaskRedisCredentials(specs string) string {
+	fields := strings.FieldsFunc(specs, func(r rune) bool { return r == ',' || r == '\n' || r == ' ' })
+	for _, f := range fields {
+		if i := strings.LastIndex(f, "@"); i >= 0 {
+			masked := "********"
+			if j := strings.Index(f[:i], ":"); j >= 0 {
+				masked = f[:j+1] + masked
+			}
+			specs = strings.Replace(specs, f, masked+f[i:], 1)
+		}
+	}
+	return specs
+}
+
+// redisConnectionOptions returns the options to use for the given server.
+func redisConnectionOptions(server string) RedisConnectionOptions {
+	redisOptionsMutex.Lock()
+	defer redisOptionsMutex.Unlock()
+	options := redisDefaultOptions
+	if o, ok := redisServerOptions[server]; ok {
+		options.Username, options.Password = o.Username, o.Password
+	}
+	return options
+}
+
+// NewRedisClient creates a redis client for the given server (host:port) and
+// database, using the configured credentials and TLS settings.
+func NewRedisClient(server string, db int) *redis.Client {
+	options := redisConnectionOptions(server)
+	ro := &redis.Options{Addr: server, DB: db}
+	if options.Username == "" && options.TLSConfig == nil {
+		ro.Password = options.Password
+		return redis.NewClient(ro)
+	}
+	ro.Dialer = options.dialer(server, 5*time.Second)
+	if options.Username == "" {
+		// the client library sends a plain AUTH after dialing
+		ro.Password = options.Password
+	}
+	return redis.NewClient(ro)
+}
+
+// dialer returns a function establishing a connection to the given server,
+// which negotiates TLS and authenticates with username and password (which
+// the redis client library doesn't support), if configured.
+func (o RedisConnectionOptions) dialer(server string, timeout time.Duration) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", server, timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		if o.TLSConfig != nil {
+			config := o.TLSConfig.Clone()
+			if config.ServerName == "" {
+				config.ServerName = strings.Split(server, ":")[0]
+			}
+			tlsConn := tls.Client(conn, config)
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("TLS handshake with %s failed: %s", server, err)
+			}
+			conn = tlsConn
+		}
+		if o.Username != "" {
+			if err = redisAuth(conn, o.Username, o.Password); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("could not authenticate with %s: %s", server, err)
+			}
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// redisAuth sends AUTH username password and checks the reply.
+func redisAuth(conn net.Conn, username, password string) error {
+	cmd := fmt.Sprintf("*3\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(username), username, len(password), password)
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return err
+	}
+	// read the reply byte by byte to avoid consuming data meant for the
+	// client library
+	var reply []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		reply = append(reply, b[0])
+	}
+	line := strings.TrimSpace(string(reply))
+	if line != "+OK" {
+		return fmt.Errorf("%s", strings.TrimPrefix(line, "-"))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAuthRedis answers AUTH and PING, accepting only the given credentials,
+// and records all AUTH commands received.
+type fakeAuthRedis struct {
+	listener net.Listener
+	username string
+	password string
+	mutex    sync.Mutex
+	auths    [][]string
+}
+
+func newFakeAuthRedis(t *testing.T, username, password string) *fakeAuthRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeAuthRedis{listener: l, username: username, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeAuthRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			f.mutex.Lock()
+			f.auths = append(f.auths, args[1:])
+			f.mutex.Unlock()
+			user, pass := "default", args[len(args)-1]
+			if len(args) == 3 {
+				user = args[1]
+			}
+			authenticated = user == f.username && pass == f.password
+			if authenticated {
+				conn.Write([]byte("+OK\r\n"))
+			} else {
+				conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+			}
+		case "PING":
+			if authenticated {
+				conn.Write([]byte("+PONG\r\n"))
+			} else {
+				conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			}
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func (f *fakeAuthRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func TestParseRedisServerSpec(t *testing.T) {
+	os.Setenv("BEETLE_TEST_REDIS_PASSWORD", "from-env")
+	defer os.Unsetenv("BEETLE_TEST_REDIS_PASSWORD")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		spec, server, username, password string
+	}{
+		{"10.0.0.1:6379", "10.0.0.1:6379", "", ""},
+		{"secret@10.0.0.2:6379", "10.0.0.2:6379", "", "secret"},
+		{":env:BEETLE_TEST_REDIS_PASSWORD@10.0.0.7:6379", "10.0.0.7:6379", "", "from-env"},
+		{"beetle:secret@10.0.0.3:6379", "10.0.0.3:6379", "beetle", "secret"},
+		{"beetle:env:BEETLE_TEST_REDIS_PASSWORD@10.0.0.4:6379", "10.0.0.4:6379", "beetle", "from-env"},
+		{"beetle:file:" + secretFile + "@10.0.0.5:6379", "10.0.0.5:6379", "beetle", "from-file"},
+	}
+	for _, c := range cases {
+		server, err := ParseRedisServerSpec(c.spec)
+		if err != nil {
+			t.Errorf("could not parse %s: %s", c.spec, err)
+			continue
+		}
+		checkEqual(t, server, c.server)
+		options := redisConnectionOptions(server)
+		checkEqual(t, options.Username, c.username)
+		checkEqual(t, options.Password, c.password)
+	}
+	if _, err := ParseRedisServerSpec(":env:BEETLE_TEST_UNSET_VARIABLE@10.0.0.6:6379"); err == nil {
+		t.Errorf("expected an error for a missing environment variable")
+	}
+}
+
+func TestConfigureRedisConnectionsRegistersServerCredentials(t *testing.T) {
+	config := &Config{
+		RedisServers:  "primary/beetle:secret@10.0.1.1:6379,10.0.1.2:6379\nsecondary/other@10.0.1.3:6379",
+		RedisPassword: "global",
+	}
+	if err := ConfigureRedisConnections(config); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureRedisConnections(&Config{})
+	options := redisConnectionOptions("10.0.1.1:6379")
+	checkEqual(t, options.Username, "beetle")
+	checkEqual(t, options.Password, "secret")
+	checkEqual(t, redisConnectionOptions("10.0.1.2:6379").Password, "global")
+	checkEqual(t, redisConnectionOptions("10.0.1.3:6379").Password, "other")
+}
+
+func TestMaskRedisCredentials(t *testing.T) {
+	specs := "primary/beetle:secret@r1:6379,other@r2:6379\nsecondary/r3:6379"
+	checkEqual(t, MaskRedisCredentials(specs), "primary/beetle:********@r1:6379,********@r2:6379\nsecondary/r3:6379")
+}
+
+func TestNewRedisClientAuthenticatesWithUsername(t *testing.T) {
+	f := newFakeAuthRedis(t, "beetle", "sesame")
+	defer f.listener.Close()
+	if _, err := ParseRedisServerSpec("beetle:sesame@" + f.addr()); err != nil {
+		t.Fatal(err)
+	}
+	client := NewRedisClient(f.addr(), 0)
+	defer client.Close()
+	if err := client.Ping().Err(); err != nil {
+		t.Fatalf("ping failed: %s", err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	checkEqual(t, f.auths, [][]string{{"beetle", "sesame"}})
+}
+
+func TestNewRedisClientRejectsWrongPassword(t *testing.T) {
+	f := newFakeAuthRedis(t, "beetle", "sesame")
+	defer f.listener.Close()
+	if _, err := ParseRedisServerSpec("beetle:wrong@" + f.addr()); err != nil {
+		t.Fatal(err)
+	}
+	client := NewRedisClient(f.addr(), 0)
+	defer client.Close()
+	err := client.Ping().Err()
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected authentication to fail, got: %v", err)
+	}
+}
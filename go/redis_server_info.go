@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	//	"github.com/davecgh/go-spew/spew"
 	"gopkg.in/redis.v5"
@@ -33,21 +37,36 @@ func (shims RedisShims) Servers() []string {
 // RedisServerInfo contans a list slice of RedisShim objects and a lookup index
 // on server strings (host:port format).
 type RedisServerInfo struct {
-	servers    string
-	instances  RedisShims
-	serverInfo map[string]RedisShims
+	servers     string
+	instances   RedisShims
+	serverInfo  map[string]RedisShims
+	replication map[string]map[string]string // INFO replication output per server, collected by the last refresh.
+	timeout     time.Duration                // Time to wait for a single server to answer during a refresh.
 }
 
+// DefaultProbeTimeout is the time to wait for a redis server to answer INFO,
+// unless set explicitly.
+const DefaultProbeTimeout = 5 * time.Second
+
+// RedisProbe holds the INFO replication output of every server, as collected
+// by RedisServerInfo.Probe. Servers which could not be reached have an empty
+// map.
+type RedisProbe map[string]map[string]string
+
 // NewRedisServerInfo creates a new RedisServerInfo from a comma separated list
 // of servers (host:port format).
 func NewRedisServerInfo(servers string) *RedisServerInfo {
-	si := &RedisServerInfo{servers: servers}
+	si := &RedisServerInfo{servers: servers, timeout: DefaultProbeTimeout}
 	si.instances = make(RedisShims, 0)
 	if servers != "" {
 		serverList := regexp.MustCompile(" *, *").Split(servers, -1)
 		for _, s := range serverList {
-			logInfo("adding redis server: %s", s)
-			si.instances = append(si.instances, NewRedisShim(s))
+			server, err := ParseRedisServerSpec(s)
+			if err != nil {
+				logError("%s", err)
+			}
+			logInfo("adding redis server: %s", server)
+			si.instances = append(si.instances, NewRedisShim(server))
 		}
 	}
 	si.Reset()
@@ -66,16 +85,47 @@ func (si *RedisServerInfo) Reset() {
 	m[SLAVE] = make(RedisShims, 0)
 	m[UNKNOWN] = make(RedisShims, 0)
 	si.serverInfo = m
+	si.replication = make(map[string]map[string]string)
 }
 
 // Refresh contacts all redis servers and determines their current role.
 func (si *RedisServerInfo) Refresh() {
-	logDebug("refreshing server info")
+	si.Apply(si.Probe())
+}
+
+// Probe contacts all redis servers concurrently and collects their
+// replication info. Servers not answering within the timeout are considered
+// unreachable. Probe doesn't modify the cached information and can be called
+// from any go routine.
+func (si *RedisServerInfo) Probe() RedisProbe {
+	type reply struct {
+		server string
+		info   map[string]string
+	}
+	logDebug("probing redis servers: %v", si.instances.Servers())
+	replies := make(chan reply, len(si.instances))
+	for _, ri := range si.instances {
+		go func(ri *RedisShim) {
+			replies <- reply{server: ri.server, info: ri.InfoWithTimeout(si.timeout)}
+		}(ri)
+	}
+	probe := make(RedisProbe, len(si.instances))
+	for range si.instances {
+		r := <-replies
+		probe[r.server] = r.info
+	}
+	return probe
+}
+
+// Apply replaces the cached information with the results of a probe.
+func (si *RedisServerInfo) Apply(probe RedisProbe) {
 	si.Reset()
 	for _, ri := range si.instances {
-		role := ri.Role()
+		info := probe[ri.server]
+		role := roleFromInfo(info)
 		logDebug("determined %s to be a '%s'", ri.server, role)
 		si.serverInfo[role] = append(si.serverInfo[role], ri)
+		si.replication[ri.server] = info
 	}
 	// spew.Dump(si)
 }
@@ -90,6 +140,17 @@ func (si *RedisServerInfo) Find(server string) *redis.Client {
 	return nil
 }
 
+// Instance returns the shim of a configured server, or nil if the server is
+// not configured.
+func (si *RedisServerInfo) Instance(server string) *RedisShim {
+	for _, r := range si.instances {
+		if r.server == server {
+			return r
+		}
+	}
+	return nil
+}
+
 // Masters returns all shims with role 'master'.
 func (si *RedisServerInfo) Masters() RedisShims {
 	return si.serverInfo[MASTER]
@@ -124,6 +185,95 @@ func (si *RedisServerInfo) SlavesOf(master *RedisShim) RedisShims {
 	return slaves
 }
 
+// ReplicaInfo summarizes the replication state of a slave.
+type ReplicaInfo struct {
+	Offset          int64 // Replication offset (slave_repl_offset).
+	LinkUp          bool  // Whether the link to the master is up.
+	LinkDownSeconds int   // Seconds since the link went down or, if it is up, since the last I/O.
+}
+
+// ReplicaInfo returns the replication state of the given slave, as reported
+// by the last refresh. The second return value is false if no usable
+// information is available.
+func (si *RedisServerInfo) ReplicaInfo(r *RedisShim) (ReplicaInfo, bool) {
+	ri, err := parseReplicaInfo(si.replication[r.server])
+	return ri, err == nil
+}
+
+// parseReplicaInfo extracts the replication state of a slave from the output
+// of INFO replication. Slaves which have never been connected to their master
+// report a negative link down time and are rejected.
+func parseReplicaInfo(info map[string]string) (ReplicaInfo, error) {
+	if info["role"] != SLAVE {
+		return ReplicaInfo{}, fmt.Errorf("not a slave")
+	}
+	offset, err := strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+	if err != nil {
+		return ReplicaInfo{}, fmt.Errorf("invalid replication offset: '%s'", info["slave_repl_offset"])
+	}
+	ri := ReplicaInfo{Offset: offset, LinkUp: info["master_link_status"] == "up"}
+	key := "master_link_down_since_seconds"
+	if ri.LinkUp {
+		key = "master_last_io_seconds_ago"
+	}
+	ri.LinkDownSeconds, err = strconv.Atoi(info[key])
+	if err != nil || ri.LinkDownSeconds < 0 {
+		return ReplicaInfo{}, fmt.Errorf("invalid %s: '%s'", key, info[key])
+	}
+	return ri, nil
+}
+
+// replicationOffset extracts the replication offset from the output of INFO
+// replication: the master_repl_offset for masters and the slave_repl_offset
+// for slaves, which must be connected to their master.
+func replicationOffset(info map[string]string) (int64, error) {
+	if info["role"] != SLAVE {
+		v, ok := info["master_repl_offset"]
+		if !ok {
+			return 0, fmt.Errorf("no replication offset available")
+		}
+		return strconv.ParseInt(v, 10, 64)
+	}
+	ri, err := parseReplicaInfo(info)
+	if err != nil {
+		return 0, err
+	}
+	if !ri.LinkUp {
+		return 0, fmt.Errorf("replication link is down")
+	}
+	return ri.Offset, nil
+}
+
+// BestReplica selects the most up-to-date slave from the given candidates,
+// skipping slaves which have not heard from their master for more than
+// maxLinkDown seconds or for which no usable replication info is available. Slaves
+// with equal offsets are returned in the order of the candidates list. Returns
+// nil if no candidate qualifies.
+func (si *RedisServerInfo) BestReplica(candidates RedisShims, maxLinkDown int) *RedisShim {
+	qualified := make(RedisShims, 0, len(candidates))
+	offsets := make(map[string]int64)
+	for _, r := range candidates {
+		ri, err := parseReplicaInfo(si.replication[r.server])
+		if err != nil {
+			logWarn("Skipping slave '%s': no usable replication info: %s", r.server, err)
+			continue
+		}
+		if ri.LinkDownSeconds > maxLinkDown {
+			logWarn("Skipping slave '%s': no contact with master for %d seconds", r.server, ri.LinkDownSeconds)
+			continue
+		}
+		qualified = append(qualified, r)
+		offsets[r.server] = ri.Offset
+	}
+	if len(qualified) == 0 {
+		return nil
+	}
+	sort.SliceStable(qualified, func(i, j int) bool {
+		return offsets[qualified[i].server] > offsets[qualified[j].server]
+	})
+	return qualified[0]
+}
+
 // AutoDetectMaster returns the current master, if it is reachable.
 func (si *RedisServerInfo) AutoDetectMaster() *RedisShim {
 	if !si.MasterAndSlavesReachable() {
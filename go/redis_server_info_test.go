@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBestReplicaPrefersHighestOffset(t *testing.T) {
+	si := NewRedisServerInfo("127.0.0.1:7101,127.0.0.1:7102,127.0.0.1:7103,127.0.0.1:7104")
+	a, b, c, d := si.instances[0], si.instances[1], si.instances[2], si.instances[3]
+	si.replication[a.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "100", "master_link_status": "down", "master_link_down_since_seconds": "20"}
+	si.replication[b.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "300", "master_link_status": "down", "master_link_down_since_seconds": "25"}
+	si.replication[c.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "500", "master_link_status": "down", "master_link_down_since_seconds": "4000"}
+	si.replication[d.server] = map[string]string{"role": MASTER}
+
+	best := si.BestReplica(RedisShims{a, b, c, d}, 300)
+	if best != b {
+		t.Errorf("expected %s to be selected, got %+v", b.server, best)
+	}
+	if best := si.BestReplica(RedisShims{a, c}, 10); best != nil {
+		t.Errorf("expected no replica to qualify, got %s", best.server)
+	}
+	ri, ok := si.ReplicaInfo(b)
+	checkEqual(t, ok, true)
+	checkEqual(t, ri, ReplicaInfo{Offset: 300, LinkUp: false, LinkDownSeconds: 25})
+}
+
+func TestBestReplicaKeepsOrderForEqualOffsets(t *testing.T) {
+	si := NewRedisServerInfo("127.0.0.1:7101,127.0.0.1:7102")
+	a, b := si.instances[0], si.instances[1]
+	si.replication[a.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "100", "master_link_status": "up", "master_last_io_seconds_ago": "1"}
+	si.replication[b.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "100", "master_link_status": "up", "master_last_io_seconds_ago": "0"}
+	if best := si.BestReplica(RedisShims{a, b}, 300); best != a {
+		t.Errorf("expected %s to be selected, got %+v", a.server, best)
+	}
+}
+
+func TestBestReplicaRejectsSlavesWhichNeverConnected(t *testing.T) {
+	si := NewRedisServerInfo("127.0.0.1:7101,127.0.0.1:7102")
+	a, b := si.instances[0], si.instances[1]
+	si.replication[a.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "900", "master_link_status": "down", "master_link_down_since_seconds": "-1"}
+	si.replication[b.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "100", "master_link_status": "down", "master_link_down_since_seconds": "30"}
+	if best := si.BestReplica(RedisShims{a, b}, 300); best != b {
+		t.Errorf("expected %s to be selected, got %+v", b.server, best)
+	}
+	_, ok := si.ReplicaInfo(a)
+	checkEqual(t, ok, false)
+	_, err := replicationOffset(si.replication[a.server])
+	checkEqual(t, err != nil, true)
+}
+
+func TestSelectNewMasterAllowsLinkDownSinceMasterBecameUnavailable(t *testing.T) {
+	s := NewServerState(ServerOptions{Config: &Config{ClientTimeout: 1, RedisServers: "beetle/127.0.0.1:7001,127.0.0.1:7002", ReplicaMaxLinkDown: 10, RedisMasterRetryInterval: 5}})
+	fs := s.failovers["beetle"]
+	fs.currentMaster = fs.redis.instances[0]
+	slave := fs.redis.instances[1]
+	fs.redis.replication[slave.server] = map[string]string{"role": SLAVE, "slave_repl_offset": "100", "master_link_status": "down", "master_link_down_since_seconds": "60"}
+	if best := fs.SelectNewMaster(RedisShims{slave}); best != nil {
+		t.Errorf("expected no slave to qualify while the master is available, got %s", best.server)
+	}
+	// the master became unavailable 50 seconds ago, which is when the slave
+	// lost contact with it
+	fs.masterUnavailableSince = time.Now().Add(-50 * time.Second)
+	if best := fs.SelectNewMaster(RedisShims{slave}); best != slave {
+		t.Errorf("expected %s to be selected, got %+v", slave.server, best)
+	}
+	fs.redis.replication[slave.server]["master_link_down_since_seconds"] = "120"
+	if best := fs.SelectNewMaster(RedisShims{slave}); best != nil {
+		t.Errorf("expected no slave to qualify, got %s", best.server)
+	}
+}
+
+func TestProbeGivesUpOnHangingServers(t *testing.T) {
+	// a server accepting connections, but never answering
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 100)
+	go func() {
+		defer close(accepted)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		l.Close()
+		for conn := range accepted {
+			conn.Close()
+		}
+	}()
+	si := NewRedisServerInfo(l.Addr().String() + "," + l.Addr().String())
+	si.timeout = 100 * time.Millisecond
+	start := time.Now()
+	probe := si.Probe()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probing took %s, expected the servers to be probed in parallel with a timeout", elapsed)
+	}
+	checkEqual(t, len(probe[l.Addr().String()]), 0)
+	si.Apply(probe)
+	checkEqual(t, len(si.Unknowns()), 2)
+	checkEqual(t, len(si.Masters()), 0)
+}
+
+func TestApplyKeepsInstanceOrder(t *testing.T) {
+	si := NewRedisServerInfo("127.0.0.1:7101,127.0.0.1:7102,127.0.0.1:7103")
+	si.Apply(RedisProbe{
+		"127.0.0.1:7101": {"role": SLAVE},
+		"127.0.0.1:7102": {"role": MASTER},
+		"127.0.0.1:7103": {"role": SLAVE},
+	})
+	checkEqual(t, si.Masters().Servers(), []string{"127.0.0.1:7102"})
+	checkEqual(t, si.Slaves().Servers(), []string{"127.0.0.1:7101", "127.0.0.1:7103"})
+	checkEqual(t, si.replication["127.0.0.1:7101"]["role"], SLAVE)
+}
+
+func TestRefreshResultsOfReplacedConfigurationsAreDiscarded(t *testing.T) {
+	s := NewServerState(serverTestOptions)
+	fs := s.failovers["beetle"]
+	stale := fs.redis
+	fs.refreshing = true
+	fs.redis = s.newRedisServerInfo("127.0.0.1:7101,127.0.0.1:7102")
+	fs.currentMaster = NewRedisShim("127.0.0.1:7101")
+	s.handleRefreshResult(&RefreshResult{system: "beetle", info: stale, probe: RedisProbe{"127.0.0.1:7001": {"role": MASTER}}})
+	checkEqual(t, fs.refreshing, true)
+	checkEqual(t, len(fs.redis.Masters()), 0)
+	s.handleRefreshResult(&RefreshResult{system: "beetle", info: fs.redis, probe: RedisProbe{"127.0.0.1:7101": {"role": MASTER}}})
+	checkEqual(t, fs.refreshing, false)
+	checkEqual(t, fs.redis.Masters().Servers(), []string{"127.0.0.1:7101"})
+}
@@ -39,7 +39,7 @@ func NewRedisShim(server string) *RedisShim {
 }
 
 func redisInstanceFromServerString(server string) *redis.Client {
-	return redis.NewClient(&redis.Options{Addr: server})
+	return NewRedisClient(server, 0)
 }
 
 func dumpMap(m map[string]string) {
@@ -74,10 +74,33 @@ func (ri *RedisShim) Info() (m map[string]string) {
 	return
 }
 
+// InfoWithTimeout works like Info, but gives up after the given timeout,
+// returning an empty map. A timeout of zero means no timeout.
+func (ri *RedisShim) InfoWithTimeout(timeout time.Duration) map[string]string {
+	if timeout <= 0 {
+		return ri.Info()
+	}
+	c := make(chan map[string]string, 1)
+	go func() {
+		c <- ri.Info()
+	}()
+	select {
+	case m := <-c:
+		return m
+	case <-time.After(timeout):
+		logError("could not obtain redis info from %s: no answer within %s", ri.server, timeout)
+		return make(map[string]string)
+	}
+}
+
 // Role returns the role of the redis server ('master' or 'söave'), or 'unknown'
 // if the server cannot be reached.
 func (ri *RedisShim) Role() string {
-	info := ri.Info()
+	return roleFromInfo(ri.Info())
+}
+
+// roleFromInfo extracts the role from the output of the INFO command.
+func roleFromInfo(info map[string]string) string {
 	if len(info) == 0 {
 		return UNKNOWN
 	}
@@ -139,6 +162,31 @@ func (ri *RedisShim) RedisMakeSlave(host string, port int) error {
 	return err
 }
 
+// ReplicationOffset queries the current replication offset of the redis
+// server: the master_repl_offset for masters and the slave_repl_offset for
+// slaves.
+func (ri *RedisShim) ReplicationOffset() (int64, error) {
+	offset, err := replicationOffset(ri.Info())
+	if err != nil {
+		return 0, fmt.Errorf("could not determine replication offset of %s: %s", ri.server, err)
+	}
+	return offset, nil
+}
+
+// ReplicationLag returns the number of bytes the given slave lags behind the
+// master.
+func ReplicationLag(master, slave *RedisShim) (int64, error) {
+	masterOffset, err := master.ReplicationOffset()
+	if err != nil {
+		return 0, err
+	}
+	slaveOffset, err := slave.ReplicationOffset()
+	if err != nil {
+		return 0, err
+	}
+	return masterOffset - slaveOffset, nil
+}
+
 // Close closses the redis connection.
 func (ri *RedisShim) Close() {
 	ri.redis.Close()
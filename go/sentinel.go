@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SentinelMaster describes a failover set the way redis sentinel reports a
+// monitored master.
+type SentinelMaster struct {
+	Name      string
+	Master    string   // host:port of the current master
+	Available bool     // whether the current master is reachable
+	Slaves    []string // host:port of available slaves
+}
+
+// SentinelServer implements a read-only subset of the redis sentinel protocol
+// on top of the failover sets managed by the configuration server:
+//
+//	PING
+//	SENTINEL get-master-addr-by-name <system>
+//	SENTINEL masters
+//	SENTINEL master <system>
+//	SENTINEL replicas|slaves <system>
+//	SUBSCRIBE/PSUBSCRIBE (+switch-master is published on every master switch)
+type SentinelServer struct {
+	masters     func() []SentinelMaster // Provides the current state of all failover sets.
+	listener    net.Listener
+	mutex       sync.Mutex
+	subscribers map[*sentinelConn]bool
+}
+
+// sentinelConn holds the state of a single client connection. All output is
+// sent through the out channel and written by a dedicated goroutine, so that
+// published messages never block the publisher.
+type sentinelConn struct {
+	conn     net.Conn
+	out      chan []byte
+	channels StringSet
+	patterns StringSet
+}
+
+// respSimple, respError and respNilArray are used to select the RESP encoding
+// of a reply. Plain strings are encoded as bulk strings, nil as null bulk
+// string.
+type respSimple string
+type respError string
+type respNilArray struct{}
+
+func encodeRESP(buf *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("$-1\r\n")
+	case respNilArray:
+		buf.WriteString("*-1\r\n")
+	case respSimple:
+		fmt.Fprintf(buf, "+%s\r\n", x)
+	case respError:
+		fmt.Fprintf(buf, "-%s\r\n", x)
+	case int:
+		fmt.Fprintf(buf, ":%d\r\n", x)
+	case string:
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(x), x)
+	case []interface{}:
+		fmt.Fprintf(buf, "*%d\r\n", len(x))
+		for _, e := range x {
+			encodeRESP(buf, e)
+		}
+	default:
+		panic(fmt.Sprintf("cannot encode %T as RESP", v))
+	}
+}
+
+// readRESPCommand reads a command either in RESP array format or as an
+// inline command (space separated words terminated by a newline).
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid multibulk length: %s", line)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected bulk string, got: %s", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length: %s", line)
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func splitHostPort(server string) (string, string) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return server, ""
+	}
+	return host, port
+}
+
+// NewSentinelServer creates a sentinel server which obtains failover set
+// information from the given provider.
+func NewSentinelServer(masters func() []SentinelMaster) *SentinelServer {
+	return &SentinelServer{masters: masters, subscribers: make(map[*sentinelConn]bool)}
+}
+
+// Listen starts listening on the given address (host:port).
+func (s *SentinelServer) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	logInfo("Starting sentinel server on %s", l.Addr())
+	return nil
+}
+
+// Serve accepts connections until the listener gets closed.
+func (s *SentinelServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logError("sentinel server: accept failed: %s", err)
+			}
+			return
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Close stops accepting new connections.
+func (s *SentinelServer) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *SentinelServer) handleConnection(conn net.Conn) {
+	c := &sentinelConn{conn: conn, out: make(chan []byte, 100), channels: make(StringSet), patterns: make(StringSet)}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		failed := false
+		for data := range c.out {
+			if failed {
+				continue
+			}
+			if _, err := conn.Write(data); err != nil {
+				logDebug("sentinel server: write failed: %s", err)
+				// closing the connection terminates the reader
+				failed = true
+				conn.Close()
+			}
+		}
+	}()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.subscribers, c)
+		s.mutex.Unlock()
+		close(c.out)
+		<-writerDone
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				logDebug("sentinel server: could not read command: %s", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			c.reply(respSimple("OK"))
+			return
+		}
+		s.dispatch(c, args)
+	}
+}
+
+func (c *sentinelConn) reply(values ...interface{}) {
+	var buf bytes.Buffer
+	for _, v := range values {
+		encodeRESP(&buf, v)
+	}
+	c.out <- buf.Bytes()
+}
+
+func (c *sentinelConn) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (s *SentinelServer) dispatch(c *sentinelConn, args []string) {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "PING":
+		if c.subscriptions() > 0 {
+			c.reply([]interface{}{"pong", ""})
+		} else {
+			c.reply(respSimple("PONG"))
+		}
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		// Replies are sent after releasing the mutex, as a client which does
+		// not read would otherwise block publishing to all subscribers.
+		replies := make([]interface{}, 0, len(args)-1)
+		s.mutex.Lock()
+		for _, name := range args[1:] {
+			kind := "subscribe"
+			if cmd == "PSUBSCRIBE" {
+				kind = "psubscribe"
+				c.patterns.Add(name)
+			} else {
+				c.channels.Add(name)
+			}
+			s.subscribers[c] = true
+			replies = append(replies, []interface{}{kind, name, c.subscriptions()})
+		}
+		s.mutex.Unlock()
+		c.reply(replies...)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		s.mutex.Lock()
+		set, kind := c.channels, "unsubscribe"
+		if cmd == "PUNSUBSCRIBE" {
+			set, kind = c.patterns, "punsubscribe"
+		}
+		names := args[1:]
+		if len(names) == 0 {
+			names = set.Keys()
+		}
+		replies := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			delete(set, name)
+			replies = append(replies, []interface{}{kind, name, c.subscriptions()})
+		}
+		if c.subscriptions() == 0 {
+			delete(s.subscribers, c)
+		}
+		s.mutex.Unlock()
+		c.reply(replies...)
+	case "SENTINEL":
+		if c.subscriptions() > 0 {
+			c.reply(respError("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context"))
+			return
+		}
+		c.reply(s.sentinelCommand(args[1:]))
+	default:
+		c.reply(respError(fmt.Sprintf("ERR unknown command '%s'", args[0])))
+	}
+}
+
+func (s *SentinelServer) findMaster(name string) *SentinelMaster {
+	for _, m := range s.masters() {
+		if m.Name == name {
+			return &m
+		}
+	}
+	return nil
+}
+
+func masterFields(m *SentinelMaster) []interface{} {
+	host, port := splitHostPort(m.Master)
+	flags := "master"
+	if !m.Available {
+		flags = "master,s_down,o_down"
+	}
+	return []interface{}{
+		"name", m.Name,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"num-slaves", strconv.Itoa(len(m.Slaves)),
+	}
+}
+
+func slaveFields(m *SentinelMaster, slave string) []interface{} {
+	host, port := splitHostPort(slave)
+	masterHost, masterPort := splitHostPort(m.Master)
+	return []interface{}{
+		"name", slave,
+		"ip", host,
+		"port", port,
+		"flags", "slave",
+		"master-host", masterHost,
+		"master-port", masterPort,
+	}
+}
+
+func (s *SentinelServer) sentinelCommand(args []string) interface{} {
+	if len(args) == 0 {
+		return respError("ERR wrong number of arguments for 'sentinel' command")
+	}
+	sub := strings.ToLower(args[0])
+	switch sub {
+	case "masters":
+		res := make([]interface{}, 0)
+		for _, m := range s.masters() {
+			res = append(res, masterFields(&m))
+		}
+		return res
+	case "get-master-addr-by-name", "master", "replicas", "slaves":
+		if len(args) != 2 {
+			return respError(fmt.Sprintf("ERR wrong number of arguments for 'sentinel %s' command", sub))
+		}
+		m := s.findMaster(args[1])
+		if m == nil {
+			if sub == "get-master-addr-by-name" {
+				return respNilArray{}
+			}
+			return respError("ERR No such master with that name")
+		}
+		switch sub {
+		case "get-master-addr-by-name":
+			host, port := splitHostPort(m.Master)
+			return []interface{}{host, port}
+		case "master":
+			return masterFields(m)
+		default:
+			res := make([]interface{}, 0, len(m.Slaves))
+			for _, slave := range m.Slaves {
+				res = append(res, slaveFields(m, slave))
+			}
+			return res
+		}
+	default:
+		return respError(fmt.Sprintf("ERR unknown sentinel subcommand '%s'", args[0]))
+	}
+}
+
+// Publish sends a message to all clients subscribed to the given channel,
+// either directly or via a matching pattern. Messages are dropped for clients
+// which do not keep up reading.
+func (s *SentinelServer) Publish(channel, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.subscribers {
+		var buf bytes.Buffer
+		if c.channels.Include(channel) {
+			encodeRESP(&buf, []interface{}{"message", channel, message})
+		}
+		for pattern := range c.patterns {
+			if matched, _ := path.Match(pattern, channel); matched {
+				encodeRESP(&buf, []interface{}{"pmessage", pattern, channel, message})
+			}
+		}
+		if buf.Len() == 0 {
+			continue
+		}
+		select {
+		case c.out <- buf.Bytes():
+		default:
+			logError("sentinel server: dropping message for slow subscriber %s", c.conn.RemoteAddr())
+		}
+	}
+}
+
+// SentinelMasters returns the current state of all failover sets in a form
+// suitable for the sentinel server. Must be called on the dispatcher thread.
+func (s *ServerState) SentinelMasters() []SentinelMaster {
+	res := make([]SentinelMaster, 0, len(s.systemNames))
+	for _, system := range s.systemNames {
+		fs := s.failovers[system]
+		if fs == nil || fs.currentMaster == nil {
+			continue
+		}
+		res = append(res, SentinelMaster{
+			Name:      system,
+			Master:    fs.currentMaster.server,
+			Available: fs.MasterIsAvailable(),
+			Slaves:    fs.redis.SlavesOf(fs.currentMaster).Servers(),
+		})
+	}
+	return res
+}
+
+// SentinelMastersFromDispatcher retrieves the state of all failover sets from
+// the dispatcher thread.
+func (s *ServerState) SentinelMastersFromDispatcher() []SentinelMaster {
+	var res []SentinelMaster
+	s.Evaluate(func() {
+		res = s.SentinelMasters()
+	})
+	return res
+}
+
+// PublishSwitchMaster notifies sentinel subscribers about a master switch, if
+// the sentinel server has been enabled.
+func (s *ServerState) PublishSwitchMaster(system, oldMaster, newMaster string) {
+	if s.sentinel != nil {
+		s.sentinel.PublishSwitchMaster(system, oldMaster, newMaster)
+	}
+}
+
+// PublishSwitchMaster publishes a +switch-master event in the format used by
+// redis sentinel: <master name> <old ip> <old port> <new ip> <new port>.
+func (s *SentinelServer) PublishSwitchMaster(system, oldMaster, newMaster string) {
+	oldHost, oldPort := splitHostPort(oldMaster)
+	newHost, newPort := splitHostPort(newMaster)
+	s.Publish("+switch-master", strings.Join([]string{system, oldHost, oldPort, newHost, newPort}, " "))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTestSentinel(t *testing.T) (*SentinelServer, net.Conn, *bufio.Reader) {
+	s := NewSentinelServer(func() []SentinelMaster {
+		return []SentinelMaster{{Name: "primary", Master: "10.0.0.1:6379", Available: true, Slaves: []string{"10.0.0.2:6379"}}}
+	})
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("could not start sentinel server: %s", err)
+	}
+	go s.Serve()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to sentinel server: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return s, conn, bufio.NewReader(conn)
+}
+
+func expectReply(t *testing.T, r *bufio.Reader, expected string) {
+	buf := make([]byte, len(expected))
+	if n, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("could not read reply: %s (got %q)", err, string(buf[:n]))
+	}
+	checkEqual(t, string(buf), expected)
+}
+
+func TestSentinelGetMasterAddrByName(t *testing.T) {
+	s, conn, r := startTestSentinel(t)
+	defer s.Close()
+	defer conn.Close()
+	conn.Write([]byte("*3\r\n$8\r\nSENTINEL\r\n$23\r\nget-master-addr-by-name\r\n$7\r\nprimary\r\n"))
+	expectReply(t, r, "*2\r\n$8\r\n10.0.0.1\r\n$4\r\n6379\r\n")
+	conn.Write([]byte("SENTINEL get-master-addr-by-name unknown\r\n"))
+	expectReply(t, r, "*-1\r\n")
+	conn.Write([]byte("SENTINEL replicas primary\r\n"))
+	expectReply(t, r, "*1\r\n*12\r\n$4\r\nname\r\n$13\r\n10.0.0.2:6379\r\n$2\r\nip\r\n$8\r\n10.0.0.2\r\n$4\r\nport\r\n$4\r\n6379\r\n$5\r\nflags\r\n$5\r\nslave\r\n$11\r\nmaster-host\r\n$8\r\n10.0.0.1\r\n$11\r\nmaster-port\r\n$4\r\n6379\r\n")
+}
+
+func TestSentinelPublishesSwitchMaster(t *testing.T) {
+	s, conn, r := startTestSentinel(t)
+	defer s.Close()
+	defer conn.Close()
+	conn.Write([]byte("SUBSCRIBE +switch-master\r\n"))
+	expectReply(t, r, "*3\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n:1\r\n")
+	s.PublishSwitchMaster("primary", "10.0.0.1:6379", "10.0.0.2:6379")
+	expectReply(t, r, "*3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$35\r\nprimary 10.0.0.1 6379 10.0.0.2 6379\r\n")
+}
+
+func TestSentinelPublishDoesNotBlockOnSubscribersWhichDoNotRead(t *testing.T) {
+	s, conn, _ := startTestSentinel(t)
+	defer s.Close()
+	defer conn.Close()
+	// Flood the server with subscriptions without ever reading the replies.
+	go func() {
+		command := []byte("SUBSCRIBE +switch-master +sdown +odown +failover-end\r\n")
+		for i := 0; i < 100000; i++ {
+			if _, err := conn.Write(command); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			s.PublishSwitchMaster("primary", "10.0.0.1:6379", "10.0.0.2:6379")
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(2 * time.Second):
+		t.Fatal("publishing blocked on a subscriber which does not read")
+	}
+}
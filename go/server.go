@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
@@ -47,15 +48,23 @@ func waitForInterrupt() {
 // RunConfigurationServer implements the main server loop.
 func RunConfigurationServer(o ServerOptions) error {
 	logInfo("server started with options: %+v\n", o)
+	if err := o.Config.CheckClientIds(); err != nil {
+		return err
+	}
 	state := NewServerState(o)
 	state.Initialize()
 	// start threads
+	state.StartStateWriter()
 	go state.dispatcher()
+	if state.elector != nil {
+		go state.runLeaderElection()
+	}
 	if Verbose {
 		go state.statsReporter()
 	}
 	if state.opts.ConsulClient != nil {
 		var err error
+		state.opts.ConsulClient.SetRetryBackoff(state.GetConfig().ReconnectBackoff())
 		state.configChanges, err = state.opts.ConsulClient.WatchConfig()
 		if err != nil {
 			return err
@@ -64,7 +73,18 @@ func RunConfigurationServer(o ServerOptions) error {
 		state.configChanges = make(chan consul.Env)
 	}
 
-	srv := state.setupClientHandler(state.GetConfig().Port)
+	srv, err := state.setupClientHandler(state.GetConfig().Port)
+	if err != nil {
+		return err
+	}
+	if port := state.GetConfig().SentinelPort; port != 0 {
+		state.sentinel = NewSentinelServer(state.SentinelMastersFromDispatcher)
+		if err := state.sentinel.Listen(fmt.Sprintf(":%d", port)); err != nil {
+			return err
+		}
+		go state.sentinel.Serve()
+		defer state.sentinel.Close()
+	}
 	go state.runClientHandler(srv)
 	waitForInterrupt()
 	state.shutdownClientHandler(srv, 3*time.Second)
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"sort"
@@ -30,20 +32,42 @@ type ServerOptions struct {
 type ServerState struct {
 	opts                    *ServerOptions            // Options passed to the constructor.
 	mutex                   sync.Mutex                // Mutex for changing opts.Config.
-	clientIds               StringSet                 // The list of clients we know and which take part in master election.
+	clientIds               StringSet                 // The list of clients we know and which take part in master election of any system.
+	defaultClientIds        StringSet                 // Clients taking part in elections of systems without own client ids.
+	systemClientIds         map[string]StringSet      // Clients taking part in elections, per system.
+	approvedClientIds       map[string]StringSet      // Clients approved by operators, per system (ALL_SYSTEMS for all systems).
+	retiredClientIds        StringSet                 // Clients retired by operators or for being unseen for too long.
+	clientRegistrations     TimeSet                   // When clients were last approved or retired.
+	keptLastClients         StringSet                 // Unseen clients not retired as the last client of a system, which operators have been told about.
 	clientChannels          ChannelMap                // Channels we use to communicate with client websocket goroutines.
 	notificationChannels    ChannelSet                // Channels we use to communicate with notifier websockets goroutines.
+	notificationLog         *NotificationLog          // Recent notifications, replayed to resuming notifier websockets.
 	unknownClientIds        StringList                // List of clients we have seen, but don't know.
 	clientsLastSeen         TimeSet                   // For any client we have seen, the time when we've last seen him.
 	wsChannel               chan *WsMsg               // Channel used by websocket go routines to send messages to dispatcher go routine.
 	upgrader                websocket.Upgrader        // Upgrader to use for turning a http connection into a webscoket connection.
 	timerChannel            chan string               // Channel used to send an abort message (containing the name of failoverset) to the dispatcher go routine.
+	refreshChannel          chan *RefreshResult       // Channel used to deliver results of background redis refreshes to the dispatcher go routine.
+	plannedSwitchChannel    chan *PlannedSwitchResult // Channel used to deliver results of background steps of planned switches to the dispatcher go routine.
 	waitGroup               sync.WaitGroup            // Used to organize the shutdown process.
 	configChanges           chan consul.Env           // Environment changes from consul arrive on this channel.
 	failoverConfidenceLevel float64                   // Failover confidence level, normalized to the interval [0,1.0]
-	systemNames             StringList                // All system names. Firste on is used for saving server state.
+	systemConfidenceLevels  map[string]float64        // Failover confidence levels per system, normalized to the interval [0,1.0]
+	systemNames             StringList                // All system names.
 	failovers               map[string]*FailoverState // Maps system name to failover state.
 	cmdChannel              chan command              // Channel for messages to perform state access/changing in the dispatcher thread, passed as closures.
+	sentinel                *SentinelServer           // Optional server answering redis sentinel queries.
+	history                 *FailoverHistory          // Record of significant failover events.
+	stateStore              StateStore                // Persists state across restarts.
+	stateSaves              chan *PersistentState     // Snapshots of the state to be persisted by the state writer go routine.
+	elector                 LeaderElector             // Elects the leader among several servers, nil if there's only one server.
+	leaderMutex             sync.Mutex                // Mutex for accessing leader and leaderAddress.
+	leader                  bool                      // Whether this server is the leader. Only the leader watches redis and runs elections.
+	leaderAddress           string                    // Advertised address of the current leader.
+	connMutex               sync.Mutex                // Mutex for accessing connections.
+	connections             map[*websocket.Conn]bool  // Open websocket connections, closed when losing leadership.
+	followTick              int                       // Counts ticks between updates of a follower's view.
+	following               bool                      // Whether a follower is loading the state of the leader in the background.
 }
 
 // String constants used as message identifiers.
@@ -80,17 +104,20 @@ const (
 
 // MsgBody facilitates JSON conversion for messages sent btween client and server.
 type MsgBody struct {
-	System string `json:"system,omitempty"`
-	Name   string `json:"name"`
-	Id     string `json:"id,omitempty"`
-	Token  string `json:"token,omitempty"`
-	Server string `json:"server,omitempty"`
+	System  string `json:"system,omitempty"`
+	Name    string `json:"name"`
+	Id      string `json:"id,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Server  string `json:"server,omitempty"`
+	Planned bool   `json:"planned,omitempty"`
+	Mac     string `json:"mac,omitempty"`
 }
 
 // WsMsg bundles a MsgBody and a string channel.
 type WsMsg struct {
 	body    MsgBody
 	channel chan string
+	cursor  *NotificationCursor
 }
 
 type command struct {
@@ -122,16 +149,7 @@ func (s *ServerState) SetConfig(config *Config) *Config {
 }
 
 func (s *ServerState) determineFailoverConfidenceLevel() {
-	config := s.GetConfig()
-	level, err := strconv.Atoi(config.ConfidenceLevel)
-	if err != nil {
-		level = 100
-	} else if level < 0 {
-		level = 0
-	} else if level > 100 {
-		level = 100
-	}
-	s.failoverConfidenceLevel = float64(level) / 100.0
+	s.failoverConfidenceLevel, s.systemConfidenceLevels = s.GetConfig().SystemConfidenceLevels()
 }
 
 // FailoverStatus
@@ -142,6 +160,12 @@ type FailoverStatus struct {
 	RedisMasterAvailable   bool     `json:"redis_master_available"`
 	RedisSlavesAvailable   []string `json:"redis_slaves_available"`
 	SwitchInProgress       bool     `json:"switch_in_progress"`
+	PlannedSwitchTarget    string   `json:"planned_switch_target,omitempty"`
+	SplitBrain             bool     `json:"split_brain"`
+	ClientIds              []string `json:"client_ids"`
+	ConfidenceLevel        int      `json:"confidence_level"`
+	VotesReceived          []string `json:"votes_received,omitempty"`
+	RogueMasters           []string `json:"rogue_masters,omitempty"`
 	GCInfo                 *GCInfo  `json:"lastgc"`
 }
 
@@ -152,8 +176,14 @@ type ServerStatus struct {
 	UnknownClientIds     []string         `json:"unknown_client_ids"`
 	UnresponsiveClients  []string         `json:"unresponsive_clients"`
 	UnseenClientIds      []string         `json:"unseen_client_ids"`
+	ApprovedClientIds    []string         `json:"approved_client_ids"`
+	RetiredClientIds     []string         `json:"retired_client_ids"`
 	Systems              []FailoverStatus `json:"redis_systems"`
 	NotificationChannels int              `json:"notification_channels"`
+	AdminTokenRequired   bool             `json:"admin_token_required"`
+	Leader               bool             `json:"leader"`
+	LeaderAddress        string           `json:"leader_address,omitempty"`
+	RecentHistory        []HistoryEvent   `json:"-"`
 }
 
 // TextMessage template for error pages with automatic redirects
@@ -184,25 +214,55 @@ func (s *ServerState) GetStatus() *ServerStatus {
 
 	for _, system := range keys {
 		rs := s.failovers[system]
+		plannedTarget := ""
+		if rs.PlannedSwitchInProgress() {
+			plannedTarget = rs.plannedTarget.server
+		}
+		clientIds := rs.ClientIds()
+		var votes []string
+		if rs.pinging {
+			received := rs.clientPongIdsReceived.Intersect(rs.ClientIds())
+			votes = received.Keys()
+		} else if rs.invalidating {
+			received := rs.clientInvalidatedIdsReceived.Intersect(rs.ClientIds())
+			votes = received.Keys()
+		}
+		master, masterAvailable := "", false
+		if rs.currentMaster != nil {
+			master, masterAvailable = rs.currentMaster.server, rs.MasterIsAvailable()
+		}
 		failoverStats = append(failoverStats, FailoverStatus{
 			SystemName:             system,
 			ConfiguredRedisServers: rs.redis.instances.Servers(),
-			RedisMaster:            rs.currentMaster.server,
-			RedisMasterAvailable:   rs.MasterIsAvailable(),
+			RedisMaster:            master,
+			RedisMasterAvailable:   masterAvailable,
 			RedisSlavesAvailable:   rs.redis.Slaves().Servers(),
 			SwitchInProgress:       rs.WatcherPaused(),
+			PlannedSwitchTarget:    plannedTarget,
+			SplitBrain:             rs.SplitBrained(),
+			ClientIds:              clientIds.Keys(),
+			ConfidenceLevel:        int(math.Round(rs.ConfidenceLevel() * 100)),
+			VotesReceived:          votes,
+			RogueMasters:           rs.rogueMasters,
 			GCInfo:                 rs.gcInfo,
 		})
 	}
 
+	leader, leaderAddress := s.Leadership()
 	return &ServerStatus{
 		BeetleVersion:        BEETLE_VERSION,
 		ConfiguredClientIds:  s.clientIds.Keys(),
 		UnknownClientIds:     s.UnknownClientIds(),
 		UnresponsiveClients:  s.UnresponsiveClients(),
 		UnseenClientIds:      s.UnseenClientIds(),
+		ApprovedClientIds:    s.ApprovedClientIds(),
+		RetiredClientIds:     s.RetiredClientIds(),
 		Systems:              failoverStats,
 		NotificationChannels: len(s.notificationChannels),
+		AdminTokenRequired:   s.AdminTokenRequired(),
+		Leader:               leader,
+		LeaderAddress:        leaderAddress,
+		RecentHistory:        s.history.Recent("", 20),
 	}
 }
 
@@ -309,6 +369,7 @@ func (s *ServerState) ClientTimeout() time.Duration {
 
 // SendToWebSockets sends a message to all registered clients channels.
 func (s *ServerState) SendToWebSockets(msg *MsgBody) (err error) {
+	msg.Sign(s.GetConfig().SharedSecret)
 	data, err := json.Marshal(msg)
 	if err != nil {
 		logError("Could not marshal message")
@@ -326,11 +387,18 @@ func (s *ServerState) SendToWebSockets(msg *MsgBody) (err error) {
 }
 
 // SendNotification sends a notifcation on all registered notifcation channels.
-func (s *ServerState) SendNotification(text string) (err error) {
+// Notifications are sent as JSON, the notification writers convert them for
+// legacy text listeners.
+func (s *ServerState) SendNotification(n *Notification) (err error) {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	s.notificationLog.Append(n)
+	data := n.Encode(NOTIFICATION_FORMAT_JSON)
 	logInfo("Sending notification to %d subscribers", len(s.notificationChannels))
 	for c := range s.notificationChannels {
 		select {
-		case c <- text:
+		case c <- data:
 		default:
 			err = errChannelBlocked
 		}
@@ -350,18 +418,43 @@ func (s *ServerState) dispatcher() {
 		case system := <-s.timerChannel:
 			fs := s.failovers[system]
 			fs.CancelInvalidation()
+		case res := <-s.refreshChannel:
+			s.handleRefreshResult(res)
+		case res := <-s.plannedSwitchChannel:
+			s.handlePlannedSwitchResult(res)
 		case <-ticker.C:
+			if !s.IsLeader() {
+				s.followerTick()
+				continue
+			}
+			refreshed := false
 			for _, fs := range s.failovers {
+				if fs.catchingUp {
+					fs.StartCatchUpCheck()
+				}
 				fs.watchTick = (fs.watchTick + 1) % s.GetConfig().RedisMasterRetryInterval
 				if fs.watchTick == 0 {
-					fs.CheckRedisAvailability()
-					s.ForgetOldUnknownClientIds()
-					s.ForgetOldLastSeenEntries()
+					fs.StartRefresh()
+					refreshed = true
+				}
+			}
+			if refreshed {
+				s.ForgetOldUnknownClientIds()
+				s.ForgetOldLastSeenEntries()
+				if !s.VoteInProgress() {
+					s.RetireUnseenClients(s.GetConfig().ClientRetirementDays, "automatic retirement")
 				}
 			}
 		case env := <-s.configChanges:
 			newconfig := buildConfig(env)
+			if err := newconfig.CheckClientIds(); err != nil {
+				logError("ignoring server config from consul: %s", err)
+				continue
+			}
 			s.SetConfig(newconfig)
+			if err := ConfigureRedisConnections(newconfig); err != nil {
+				logError("could not update redis connection settings: %s", err)
+			}
 			s.determineFailoverConfidenceLevel()
 			s.updateClientIds()
 			s.updateFailoverSets()
@@ -370,6 +463,35 @@ func (s *ServerState) dispatcher() {
 	}
 }
 
+// followerTick periodically updates the view of a follower.
+func (s *ServerState) followerTick() {
+	s.followTick = (s.followTick + 1) % s.GetConfig().RedisMasterRetryInterval
+	if s.followTick == 0 {
+		for _, fs := range s.failovers {
+			fs.StartRefresh()
+		}
+		s.StartFollowLeader()
+	}
+}
+
+// handleRefreshResult applies the result of a background refresh. The leader
+// then checks the availability of the master.
+func (s *ServerState) handleRefreshResult(res *RefreshResult) {
+	fs := s.failovers[res.system]
+	if fs == nil {
+		return
+	}
+	if fs.redis != res.info {
+		logDebug("discarding refresh result for replaced redis configuration of system %s", res.system)
+		return
+	}
+	fs.refreshing = false
+	fs.redis.Apply(res.probe)
+	if s.IsLeader() {
+		fs.CheckRedisAvailability()
+	}
+}
+
 func (s *ServerState) handleWebSocketMsg(msg *WsMsg) {
 	logDebug("dipatcher received %+v", msg.body)
 	switch msg.body.Name {
@@ -384,6 +506,7 @@ func (s *ServerState) handleWebSocketMsg(msg *WsMsg) {
 	case START_NOTIFY:
 		logDebug("Adding notification %s", msg.body.Id)
 		s.AddNotification(msg.channel)
+		s.ReplayNotifications(msg.channel, msg.cursor)
 	case STOP_NOTIFY:
 		logDebug("Removing notification %s", msg.body.Id)
 		s.RemoveNotification(msg.channel)
@@ -400,13 +523,20 @@ func (s *ServerState) handleWebSocketMsg(msg *WsMsg) {
 }
 
 func (s *ServerState) updateClientIds() {
+	s.defaultClientIds, s.systemClientIds = s.GetConfig().SystemClientIds()
+	s.applyClientRegistrations()
 	s.clientIds = make(StringSet)
-	for _, id := range strings.Split(s.GetConfig().ClientIds, ",") {
-		if id != "" {
+	for id := range s.defaultClientIds {
+		s.clientIds.Add(id)
+	}
+	for _, ids := range s.systemClientIds {
+		for id := range ids {
 			s.clientIds.Add(id)
-			s.unknownClientIds.Remove(id)
 		}
 	}
+	for id := range s.clientIds {
+		s.unknownClientIds.Remove(id)
+	}
 }
 
 // NewServerState creates partially initialized ServerState.
@@ -417,15 +547,27 @@ func NewServerState(o ServerOptions) *ServerState {
 	s.upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
 	}
 	s.wsChannel = make(chan *WsMsg, 10000)
 	s.cmdChannel = make(chan command, 1000)
+	s.timerChannel = make(chan string, 100)
+	s.refreshChannel = make(chan *RefreshResult, 100)
+	s.plannedSwitchChannel = make(chan *PlannedSwitchResult, 100)
 	s.unknownClientIds = make(StringList, 0)
+	s.notificationLog = NewNotificationLog(s.GetConfig().NotificationBufferSize)
 	s.updateClientIds()
 	s.clientsLastSeen = make(TimeSet)
 	s.failovers = make(map[string]*FailoverState)
 	s.systemNames = make(StringList, 0)
+	if path := s.GetConfig().HistoryFile; path != "" {
+		s.history = NewFailoverHistory(&FileHistoryStore{path: path})
+	} else {
+		s.history = NewFailoverHistory(NewRedisHistoryStore(s))
+	}
+	s.stateStore = NewStateStore(s)
+	s.connections = make(map[*websocket.Conn]bool)
+	s.elector = NewLeaderElector(s)
+	s.leader = s.elector == nil
 	s.updateFailoverSets()
 	return s
 }
@@ -446,8 +588,11 @@ func (s *ServerState) updateFailoverSets() {
 		existing := s.failovers[fs.name]
 		if existing != nil {
 			if existing.redis.servers != fs.spec {
-				existing.redis = NewRedisServerInfo(fs.spec)
-				existing.redis.Refresh()
+				existing.redis = s.newRedisServerInfo(fs.spec)
+				// results of a running refresh are discarded, as they
+				// belong to the replaced configuration
+				existing.refreshing = false
+				existing.StartRefresh()
 			}
 			continue
 		}
@@ -457,7 +602,7 @@ func (s *ServerState) updateFailoverSets() {
 			system:                       fs.name,
 			currentTokenInt:              initalTokenInt,
 			currentToken:                 strconv.Itoa(initalTokenInt),
-			redis:                        NewRedisServerInfo(fs.spec),
+			redis:                        s.newRedisServerInfo(fs.spec),
 			clientPongIdsReceived:        make(StringSet),
 			clientInvalidatedIdsReceived: make(StringSet),
 		}
@@ -466,71 +611,145 @@ func (s *ServerState) updateFailoverSets() {
 	}
 }
 
-// SaveState stores some aspects of the server state to the current redis master
-// to avoid re-sending notifications on restart. As of now, the state only
-// consists of the last seen info. It uses the redis master of the first
-// failover set.
+// newRedisServerInfo creates a RedisServerInfo which waits at most DialTimeout
+// seconds for each server to answer.
+func (s *ServerState) newRedisServerInfo(servers string) *RedisServerInfo {
+	si := NewRedisServerInfo(servers)
+	si.timeout = time.Duration(s.GetConfig().DialTimeout) * time.Second
+	return si
+}
+
+// SaveState persists the client last seen info and the current token and
+// master of every system to avoid re-sending notifications and to resume
+// correctly after a restart. The state is written by the state writer, if it
+// has been started.
 func (s *ServerState) SaveState() {
-	fs := s.failovers[s.systemNames[0]]
-	if fs.currentMaster == nil {
-		logError("could not save state because no redis master is available")
+	if !s.IsLeader() {
+		// the state belongs to the leader
 		return
 	}
-	lastSeen := make([]string, 0)
+	state := NewPersistentState()
 	for id, t := range s.clientsLastSeen {
-		lastSeen = append(lastSeen, fmt.Sprintf("%s:%d", id, t.UnixNano()))
+		state.ClientsLastSeen[id] = t
 	}
-	lastSeenStr := strings.Join(lastSeen, ",")
-	_, err := fs.currentMaster.redis.Set("beetle:clients-last-seen", lastSeenStr, 0).Result()
-	if err != nil {
-		logError("could not save clients last seen info to redis")
+	s.saveClientRegistrations(state)
+	for system, fs := range s.failovers {
+		state.Tokens[system] = fs.currentTokenInt
+		if fs.currentMaster != nil {
+			state.Masters[system] = fs.currentMaster.server
+		}
+	}
+	if s.stateSaves == nil {
+		s.writeState(state)
+		return
+	}
+	// only the most recent snapshot needs to be written, so a pending one
+	// gets replaced instead of blocking the dispatcher
+	for {
+		select {
+		case s.stateSaves <- state:
+			return
+		default:
+			select {
+			case <-s.stateSaves:
+			default:
+			}
+		}
 	}
-	logDebug("saved last seen info to redis: %s", lastSeenStr)
 }
 
-// LoadState loads previously saved state from current redis master.
-func (s *ServerState) LoadState() {
-	if len(s.systemNames) == 0 {
+func (s *ServerState) writeState(state *PersistentState) {
+	if err := s.stateStore.Save(state); err != nil {
+		logError("could not save state: %s", err)
 		return
 	}
-	fs := s.failovers[s.systemNames[0]]
-	if fs.currentMaster == nil {
-		logError("could not restore state because we have no redis master")
-		return
+	logDebug("saved state: %+v", state)
+}
+
+// StartStateWriter starts a go routine persisting the state, so that the
+// dispatcher does not block on slow or unreachable state stores. Without it,
+// the state is saved synchronously.
+func (s *ServerState) StartStateWriter() {
+	s.stateSaves = make(chan *PersistentState, 1)
+	go func() {
+		for state := range s.stateSaves {
+			s.writeState(state)
+		}
+	}()
+}
+
+// stateSources returns the redis servers of every system the state can be
+// loaded from, in order of preference: the current master, other masters and
+// slaves.
+func (s *ServerState) stateSources() map[string]RedisShims {
+	sources := make(map[string]RedisShims)
+	for system, fs := range s.failovers {
+		candidates := make(RedisShims, 0)
+		if fs.currentMaster != nil {
+			candidates = append(candidates, fs.currentMaster)
+		}
+		candidates = append(candidates, fs.redis.Masters()...)
+		candidates = append(candidates, fs.redis.Slaves()...)
+		sources[system] = candidates
 	}
-	v, err := fs.currentMaster.redis.Get("beetle:clients-last-seen").Result()
+	return sources
+}
+
+// LoadState loads and restores previously saved state. Returns the loaded
+// state, or nil if it could not be loaded.
+func (s *ServerState) LoadState() *PersistentState {
+	return s.RestoreState(s.stateStore.Load(s.stateSources()))
+}
+
+// RestoreState restores client last seen info, client registrations and
+// tokens from a loaded state. Tokens never go backwards, so that clients do
+// not ignore messages of the restarted server. Returns the state, or nil if it
+// could not be loaded.
+func (s *ServerState) RestoreState(state *PersistentState, err error) *PersistentState {
 	if err != nil {
-		logError("could not load last seen info from redis")
+		logError("could not restore state: %s", err)
+		return nil
 	}
-	for _, x := range strings.Split(v, ",") {
-		if x != "" {
-			parts := strings.Split(x, ":")
-			id, t := parts[0], parts[1]
-			i, err := strconv.Atoi(t)
-			if err != nil {
-				logError("could not recreate timestamp for id '%s': %s", id, t)
-			} else {
-				s.clientsLastSeen[id] = time.Unix(0, int64(i))
-			}
+	for id, t := range state.ClientsLastSeen {
+		s.clientsLastSeen[id] = t
+	}
+	s.restoreClientRegistrations(state)
+	for system, token := range state.Tokens {
+		if fs := s.failovers[system]; fs != nil && token > fs.currentTokenInt {
+			fs.currentTokenInt = token
+			fs.currentToken = strconv.Itoa(token)
 		}
 	}
-	logInfo("restored client last seen info from redis: %v", s.clientsLastSeen)
+	logInfo("restored state: %+v", state)
+	return state
 }
 
-func (s *ServerState) setupClientHandler(webSocketPort int) *http.Server {
+func (s *ServerState) setupClientHandler(webSocketPort int) (*http.Server, error) {
+	tlsConfig, err := s.GetConfig().ServerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.dispatchRequest)
-	logInfo("Starting web socket server on port %d", webSocketPort)
+	logInfo("Starting web socket server on port %d (TLS: %v)", webSocketPort, tlsConfig != nil)
 	webSocketSpec := ":" + strconv.Itoa(webSocketPort)
 	return &http.Server{
-		Addr:    webSocketSpec,
-		Handler: mux,
-	}
+		Addr:      webSocketSpec,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}, nil
 }
 
 func (s *ServerState) runClientHandler(srv *http.Server) {
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logError("starting websocket server failed")
+	var err error
+	if srv.TLSConfig != nil {
+		// certificates have already been loaded into the TLS config
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logError("starting websocket server failed: %s", err)
 	}
 }
 
@@ -547,6 +766,19 @@ func (s *ServerState) shutdownClientHandler(srv *http.Server, timeout time.Durat
 
 func (s *ServerState) serveNotifications(w http.ResponseWriter, r *http.Request) {
 	logDebug("received notification request")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = s.GetConfig().NotificationFormat
+	}
+	if format != NOTIFICATION_FORMAT_JSON && format != NOTIFICATION_FORMAT_TEXT {
+		http.Error(w, "unknown notification format: "+format, http.StatusBadRequest)
+		return
+	}
+	cursor, err := ParseNotificationCursor(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); !ok {
@@ -555,14 +787,22 @@ func (s *ServerState) serveNotifications(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	defer ws.Close()
-	s.notificationReader(ws)
+	s.addConnection(ws)
+	defer s.removeConnection(ws)
+	s.notificationReader(ws, format, cursor)
 }
 
-func (s *ServerState) notificationReader(ws *websocket.Conn) {
-	var dispatcherInput = make(chan string, 1000)
+// NOTIFICATION_CHANNEL_SIZE is the number of live notifications buffered for
+// a notification listener.
+const NOTIFICATION_CHANNEL_SIZE = 1000
+
+func (s *ServerState) notificationReader(ws *websocket.Conn, format string, cursor *NotificationCursor) {
+	// resuming listeners need room for a full replay of the notification log,
+	// preceded by a notification about lost ones
+	var dispatcherInput = make(chan string, NOTIFICATION_CHANNEL_SIZE+s.notificationLog.Capacity()+1)
 	// channel dispatcher_input will be closed by dispatcher, to avoid sending on a closed channel
-	s.wsChannel <- &WsMsg{body: MsgBody{Name: START_NOTIFY}, channel: dispatcherInput}
-	go s.notificationWriter(ws, dispatcherInput)
+	s.wsChannel <- &WsMsg{body: MsgBody{Name: START_NOTIFY}, channel: dispatcherInput, cursor: cursor}
+	go s.notificationWriter(ws, dispatcherInput, format)
 	for !interrupted {
 		ws.SetReadDeadline(time.Now().Add(WEBSOCKET_READ_TIMEOUT))
 		msgType, bytes, err := ws.ReadMessage()
@@ -584,7 +824,7 @@ func (s *ServerState) notificationReader(ws *websocket.Conn) {
 	s.wsChannel <- &WsMsg{body: MsgBody{Name: STOP_NOTIFY}, channel: dispatcherInput}
 }
 
-func (s *ServerState) notificationWriter(ws *websocket.Conn, inputFromDispatcher chan string) {
+func (s *ServerState) notificationWriter(ws *websocket.Conn, inputFromDispatcher chan string, format string) {
 	s.waitGroup.Add(1)
 	defer s.waitGroup.Done()
 	ticker := time.NewTicker(1 * time.Second)
@@ -596,6 +836,9 @@ func (s *ServerState) notificationWriter(ws *websocket.Conn, inputFromDispatcher
 				logInfo("Terminating notification websocket writer")
 				return
 			}
+			if format == NOTIFICATION_FORMAT_TEXT {
+				data = ParseNotification(data).Text
+			}
 			ws.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
 			err := ws.WriteMessage(websocket.TextMessage, []byte(data))
 			if err != nil {
@@ -631,7 +874,13 @@ func (s *ServerState) serveWs(w http.ResponseWriter, r *http.Request) {
 	defer (func() {
 		atomic.AddInt64(&wsConnections, -1)
 	})()
-	s.wsReader(ws)
+	s.addConnection(ws)
+	defer s.removeConnection(ws)
+	var peerCert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		peerCert = r.TLS.PeerCertificates[0]
+	}
+	s.wsReader(ws, peerCert)
 }
 
 func (s *ServerState) serveGCStats(w http.ResponseWriter, r *http.Request) {
@@ -661,6 +910,9 @@ func (s *ServerState) serveGCStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ServerState) dispatchRequest(w http.ResponseWriter, r *http.Request) {
+	if s.redirectToLeader(w, r) {
+		return
+	}
 	switch r.URL.Path {
 	case "/", "/.html":
 		w.Header().Set("Content-Type", "text/html")
@@ -683,10 +935,24 @@ func (s *ServerState) dispatchRequest(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "%s", string(b))
 	case "/.txt":
 		w.Header().Set("Content-Type", "text/plain")
-		fmt.Fprintf(w, "Not yet implemented")
+		fmt.Fprint(w, s.GetStatusFromDispatcher().Text())
+	case "/history.json":
+		s.serveHistory(w, r)
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.GetMetricsFromDispatcher().Render(w)
 	case "/initiate_master_switch":
 		w.Header().Set("Content-Type", "text/html")
 		s.initiateMasterSwitch(w, r)
+	case "/fence_rogue_masters":
+		w.Header().Set("Content-Type", "text/html")
+		s.fenceRogueMasters(w, r)
+	case "/approve_client":
+		w.Header().Set("Content-Type", "text/html")
+		s.changeClientRegistration(w, r, "approve")
+	case "/retire_client":
+		w.Header().Set("Content-Type", "text/html")
+		s.changeClientRegistration(w, r, "retire")
 	case "/brokers":
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintf(w, "[]")
@@ -697,10 +963,32 @@ func (s *ServerState) dispatchRequest(w http.ResponseWriter, r *http.Request) {
 	case "/gcstats":
 		s.serveGCStats(w, r)
 	default:
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			s.serveAdminAPI(w, r)
+			return
+		}
 		http.NotFound(w, r)
 	}
 }
 
+func (s *ServerState) serveHistory(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = MaxHistoryEvents
+	}
+	var events []HistoryEvent
+	s.Evaluate(func() {
+		events = s.history.Recent(r.URL.Query().Get("system"), limit)
+	})
+	b, err := json.Marshal(events)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", string(b))
+}
+
 func renderErrorTemplate(w http.ResponseWriter, code int, msg string) {
 	tmpl, err := template.New("message.html").Parse(messageTemplate)
 	if err != nil {
@@ -720,26 +1008,47 @@ func renderErrorTemplate(w http.ResponseWriter, code int, msg string) {
 }
 
 func (s *ServerState) initiateMasterSwitch(w http.ResponseWriter, r *http.Request) {
-	system := r.URL.Query().Get("system_name")
-	if system == "" {
-		renderErrorTemplate(w, 400, "Missing parameter: system_name")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderErrorTemplate(w, 405, "Master switches must be initiated using POST")
 		return
 	}
-	fs := s.failovers[system]
-	if fs == nil {
-		renderErrorTemplate(w, 400, fmt.Sprintf("Master switch not possible for unknown system: '%s'", system))
+	if !s.AuthorizeAdminRequest(r) {
+		renderErrorTemplate(w, 401, "Invalid admin token")
 		return
 	}
-	var initiated bool
-	s.Evaluate(func() { initiated = fs.InitiateMasterSwitch() })
-	if initiated {
-		renderErrorTemplate(w, 201, "Master switch initiated")
+	system := r.FormValue("system_name")
+	if system == "" {
+		renderErrorTemplate(w, 400, "Missing parameter: system_name")
+		return
+	}
+	planned, _ := strconv.ParseBool(r.FormValue("planned"))
+	res, code := s.RequestMasterSwitch(system, r.FormValue("server"), planned, "status page: "+r.RemoteAddr)
+	if res.Error != "" {
+		renderErrorTemplate(w, code, res.Error)
 	} else {
-		renderErrorTemplate(w, 200, "No master switch necessary")
+		renderErrorTemplate(w, code, res.Message)
 	}
 }
 
-func (s *ServerState) wsReader(ws *websocket.Conn) {
+// authenticateMsg checks that a message has been signed with the shared secret
+// (if configured), that it has been sent with the client id the connection
+// was established with and that the client certificate (if presented) has been
+// issued for that id.
+func (s *ServerState) authenticateMsg(body *MsgBody, connectionId string, peerCert *x509.Certificate) error {
+	if !body.Authentic(s.GetConfig().SharedSecret) {
+		return fmt.Errorf("invalid message signature for client id '%s'", body.Id)
+	}
+	if connectionId != "" && body.Id != connectionId {
+		return fmt.Errorf("client id '%s' does not match connection client id '%s'", body.Id, connectionId)
+	}
+	if peerCert != nil && !CertificateMatchesId(peerCert, body.Id) {
+		return fmt.Errorf("client certificate '%s' has not been issued for client id '%s'", peerCert.Subject.CommonName, body.Id)
+	}
+	return nil
+}
+
+func (s *ServerState) wsReader(ws *websocket.Conn, peerCert *x509.Certificate) {
 	var dispatcherInput = make(chan string, 1000)
 	// channel will be closed by dispatcher, to avoid sending on a closed channel
 
@@ -760,6 +1069,10 @@ func (s *ServerState) wsReader(ws *websocket.Conn) {
 			logError("wsReader: could not parse msg, error=%s: %s", err, string(bytes))
 			break
 		}
+		if err = s.authenticateMsg(&body, channelName, peerCert); err != nil {
+			logError("wsReader: rejecting connection: %s", err)
+			break
+		}
 		if !writerStarted {
 			channelName = body.Id
 			logInfo("starting web socket writer for client %s", body.Id)
@@ -802,34 +1115,59 @@ func (s *ServerState) wsWriter(clientID string, ws *websocket.Conn, inputFromDis
 }
 
 // Initialize completes the state initialization by checking redis connectivity
-// and loading saved state.
+// and loading saved state. With leader election enabled, the server starts as
+// a follower.
 func (s *ServerState) Initialize() {
 	config := s.GetConfig()
 	websocket.DefaultDialer.HandshakeTimeout = time.Duration(config.DialTimeout) * time.Second
 	VerifyMasterFileString(config.RedisMasterFile)
+	for _, fs := range s.failovers {
+		fs.CheckRedisConfiguration()
+	}
+	for _, fs := range s.failovers {
+		fs.redis.Refresh()
+	}
+	if !s.IsLeader() {
+		s.FollowLeader()
+		return
+	}
+	if err := s.initializeLeader(s.LoadState()); err != nil {
+		logError("%s", err)
+		os.Exit(1)
+	}
+}
+
+// initializeLeader determines the current masters, using the given restored
+// state or the master file, and the cached redis information. Returns an
+// error without changing anything if the master of a system cannot be
+// determined.
+func (s *ServerState) initializeLeader(state *PersistentState) error {
+	config := s.GetConfig()
 	var masters map[string]string
-	if MasterFileExists(config.RedisMasterFile) {
+	switch {
+	case s.elector != nil && state != nil:
+		// our master file is stale if another server was the leader before
+		masters = state.Masters
+	case MasterFileExists(config.RedisMasterFile):
 		masters = RedisMastersFromMasterFile(config.RedisMasterFile)
-	} else if s.opts.ConsulClient != nil {
-		kv, err := s.opts.ConsulClient.GetState()
-		if err != nil {
-			logError("Could not load state from consul: %s", err)
-		}
-		masters = UnmarshalMasterFileContent(kv["redis_master_file_content"])
+	case state != nil:
+		masters = state.Masters
 	}
 	for system, fs := range s.failovers {
-		fs.CheckRedisConfiguration()
-		fs.redis.Refresh()
-		fs.DetermineInitialMaster(masters)
-		if fs.currentMaster == nil {
-			logError("Could not determine initial master for system: %s", system)
-			os.Exit(1)
+		if masters[system] == "" && fs.redis.AutoDetectMaster() == nil {
+			return fmt.Errorf("could not determine initial master for system: %s", system)
 		}
 	}
+	for _, fs := range s.failovers {
+		fs.releaseMaster()
+		fs.DetermineInitialMaster(masters)
+	}
 	s.UpdateMasterFile()
-	s.LoadState()
+	s.SaveState()
+	s.history.Load()
 	s.ForgetOldUnknownClientIds()
 	s.ForgetOldLastSeenEntries()
+	return nil
 }
 
 // Pong handles a client's reply to the PING message.
@@ -847,6 +1185,7 @@ func (s *ServerState) Pong(msg MsgBody) {
 	level, enough := fs.ReceivedEnoughClientPongIds()
 	if fs.pinging && enough {
 		logInfo("Received a sufficient number of pong ids!. Confidence level: %f.", level)
+		fs.RecordEvent(HistoryEvent{Event: EVENT_PONG_QUORUM_REACHED, ClientIds: fs.clientPongIdsReceived.Keys()})
 		fs.StopPinging()
 		fs.InvalidateCurrentMaster()
 	}
@@ -860,9 +1199,9 @@ func (s *ServerState) ClientStarted(msg MsgBody) {
 	} else {
 		s.AddUnknownClientId(msg.Id)
 		if !seen {
-			msg := fmt.Sprintf("Received client_started message from unknown id '%s'", msg.Id)
-			logError(msg)
-			s.SendNotification(msg)
+			text := fmt.Sprintf("Received client_started message from unknown id '%s'", msg.Id)
+			logError(text)
+			s.SendNotification(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, ClientId: msg.Id, Text: text})
 		}
 	}
 }
@@ -875,9 +1214,9 @@ func (s *ServerState) Heartbeat(msg MsgBody) {
 	} else {
 		s.AddUnknownClientId(msg.Id)
 		if !seen {
-			msg := fmt.Sprintf("Received heartbeat message from unknown id '%s'", msg.Id)
-			logError(msg)
-			s.SendNotification(msg)
+			text := fmt.Sprintf("Received heartbeat message from unknown id '%s'", msg.Id)
+			logError(text)
+			s.SendNotification(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, ClientId: msg.Id, Text: text})
 		}
 	}
 }
@@ -894,6 +1233,7 @@ func (s *ServerState) ClientInvalidated(msg MsgBody) {
 	level, enough := fs.ReceivedEnoughClientInvalidatedIds()
 	if fs.invalidating && enough {
 		logInfo("Received a sufficient number of client invalidated ids! Confidence level: %f.", level)
+		fs.RecordEvent(HistoryEvent{Event: EVENT_INVALIDATED_QUORUM_REACHED, ClientIds: fs.clientInvalidatedIdsReceived.Keys()})
 		fs.StopInvalidating()
 		fs.SwitchMaster()
 	}
@@ -929,13 +1269,25 @@ func (s *ServerState) ForgetOldUnknownClientIds() {
 	s.unknownClientIds = newUnknown
 }
 
-// ForgetOldLastSeenEntries removes entries from the set of unknown client ids
-// from which we haven't heard for at least 24 hours.
+// VoteInProgress checks whether any system is waiting for its clients to
+// answer. Clients must not be retired while they are voting.
+func (s *ServerState) VoteInProgress() bool {
+	for _, fs := range s.failovers {
+		if fs.pinging || fs.invalidating {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetOldLastSeenEntries removes last seen entries older than a day, except
+// for configured clients, which are needed to retire clients unseen for a long
+// time.
 func (s *ServerState) ForgetOldLastSeenEntries() {
 	threshold := time.Now().Add(-24 * time.Hour)
 	newLastSeen := make(TimeSet)
 	for id, t := range s.clientsLastSeen {
-		if t.After(threshold) {
+		if t.After(threshold) || s.clientIds.Include(id) {
 			newLastSeen[id] = t
 		}
 	}
@@ -952,17 +1304,18 @@ func (s *ServerState) ClientSeen(id string) bool {
 
 // UpdateMasterFile writes the known masters information to the redis master file.
 func (s *ServerState) UpdateMasterFile() {
-	path := s.GetConfig().RedisMasterFile
-	systems := make(map[string]string, 0)
+	config := s.GetConfig()
+	mf := NewMasterFile()
 	for _, fs := range s.failovers {
 		if fs.currentMaster == nil {
-			systems[fs.system] = ""
+			mf.Set(fs.system, "", fs.currentToken)
 		} else {
-			systems[fs.system] = fs.currentMaster.server
+			mf.Set(fs.system, fs.currentMaster.server, fs.currentToken)
 		}
 	}
-	content := MarshalMasterFileContent(systems)
-	WriteRedisMasterFile(path, content)
+	WriteMasterFile(config.RedisMasterFile, mf, config)
+	// consul always gets the legacy format, which all consumers understand
+	content := MarshalMasterFileContent(mf.Masters())
 	if s.opts.ConsulClient != nil {
 		err := s.opts.ConsulClient.UpdateState("redis_master_file_content", content)
 		if err != nil {
@@ -981,7 +1334,7 @@ func (s *ServerState) ValidatePongClientId(id string) bool {
 	s.AddUnknownClientId(id)
 	msg := fmt.Sprintf("Received pong message from unknown client id '%s'", id)
 	logError(msg)
-	s.SendNotification(msg)
+	s.SendNotification(&Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, ClientId: id, Text: msg})
 	return false
 }
 
@@ -168,3 +168,36 @@ func TestUnknownClientIdsSorting(t *testing.T) {
 	actual := s.UnknownClientIds()
 	checkEqual(t, actual, expected)
 }
+
+func TestQuorumIsComputedPerSystem(t *testing.T) {
+	o := serverTestOptions
+	config := *o.Config
+	config.RedisServers = "primary/127.0.0.1:7001,127.0.0.1:7002\nsecondary/127.0.0.1:7003,127.0.0.1:7004"
+	config.ClientIds = "primary/c1,c2;secondary/c3"
+	config.ConfidenceLevel = "primary/50"
+	o.Config = &config
+	s := NewServerState(o)
+	primary, secondary := s.failovers["primary"], s.failovers["secondary"]
+	checkEqual(t, s.clientIds.Keys(), []string{"c1", "c2", "c3"})
+
+	primary.clientPongIdsReceived = make(StringSet)
+	primary.clientPongIdsReceived.Add("c1")
+	primary.clientPongIdsReceived.Add("c3")
+	level, enough := primary.ReceivedEnoughClientPongIds()
+	checkEqual(t, level, 0.5)
+	checkEqual(t, enough, true)
+
+	secondary.clientInvalidatedIdsReceived = make(StringSet)
+	secondary.clientInvalidatedIdsReceived.Add("c1")
+	_, enough = secondary.ReceivedEnoughClientInvalidatedIds()
+	checkEqual(t, enough, false)
+	secondary.clientInvalidatedIdsReceived.Add("c3")
+	_, enough = secondary.ReceivedEnoughClientInvalidatedIds()
+	checkEqual(t, enough, true)
+
+	status := s.GetStatus()
+	checkEqual(t, status.Systems[0].ClientIds, []string{"c1", "c2"})
+	checkEqual(t, status.Systems[0].ConfidenceLevel, 50)
+	checkEqual(t, status.Systems[1].ClientIds, []string{"c3"})
+	checkEqual(t, status.Systems[1].ConfidenceLevel, 100)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLS modes for the mail relay. Without a mode, STARTTLS is used if the relay
+// offers it, like net/smtp.SendMail does.
+const (
+	MAIL_TLS_STARTTLS = "starttls"
+	MAIL_TLS_IMPLICIT = "tls"
+	MAIL_TLS_NONE     = "none"
+)
+
+// SMTP authentication mechanisms.
+const (
+	MAIL_AUTH_PLAIN   = "plain"
+	MAIL_AUTH_LOGIN   = "login"
+	MAIL_AUTH_CRAMMD5 = "cram-md5"
+)
+
+// MAIL_TIMEOUT limits the time spent talking to the mail relay.
+const MAIL_TIMEOUT = 30 * time.Second
+
+// tlsConfig returns the TLS configuration used to talk to the mail relay.
+func (s *MailerSettings) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(s.MailRelay)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if s.TLSCAFile != "" {
+		pool, err := loadCertPool(s.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// auth returns the SMTP authentication to use, or nil if no username has been
+// configured.
+func (s *MailerSettings) auth() (smtp.Auth, error) {
+	if s.Username == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(s.MailRelay)
+	if err != nil {
+		return nil, err
+	}
+	password, err := resolveSecret(s.Password)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(s.Auth) {
+	case "", MAIL_AUTH_PLAIN:
+		return smtp.PlainAuth("", s.Username, password, host), nil
+	case MAIL_AUTH_LOGIN:
+		return &loginAuth{username: s.Username, password: password, host: host}, nil
+	case MAIL_AUTH_CRAMMD5:
+		return smtp.CRAMMD5Auth(s.Username, password), nil
+	}
+	return nil, fmt.Errorf("unsupported SMTP authentication mechanism: %s", s.Auth)
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp does not provide.
+// Like smtp.PlainAuth, it refuses to send credentials over unencrypted
+// connections, except to localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	local := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !local {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %s", fromServer)
+}
+
+// permanentMailError marks errors which retrying cannot fix, like invalid
+// mailer settings or mails which cannot be built.
+type permanentMailError struct {
+	error
+}
+
+func (e permanentMailError) Unwrap() error {
+	return e.error
+}
+
+// IsTransientMailError checks whether sending a mail might succeed later.
+// Network errors and 4xx replies of the mail relay are transient, 5xx replies
+// and errors caused by the mailer settings or the mail itself are permanent.
+func IsTransientMailError(err error) bool {
+	var permanent permanentMailError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code < 500
+	}
+	return true
+}
+
+// IsMailRelayReply checks whether the error is a reply of the mail relay,
+// which concerns the mail being sent rather than the relay's availability.
+func IsMailRelayReply(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply)
+}
+
+// deliverMail sends the message to all recipients using the mail relay.
+func deliverMail(s *MailerSettings, msg []byte) error {
+	auth, err := s.auth()
+	if err != nil {
+		return permanentMailError{err}
+	}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return permanentMailError{err}
+	}
+	host, _, _ := net.SplitHostPort(s.MailRelay)
+	dialer := &net.Dialer{Timeout: time.Duration(s.DialTimeout) * time.Second}
+	var conn net.Conn
+	switch strings.ToLower(s.TLS) {
+	case "", MAIL_TLS_STARTTLS, MAIL_TLS_NONE:
+		conn, err = dialer.Dial("tcp", s.MailRelay)
+	case MAIL_TLS_IMPLICIT:
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.MailRelay, tlsConfig)
+	default:
+		return permanentMailError{fmt.Errorf("unsupported mail relay TLS mode: %s", s.TLS)}
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(MAIL_TIMEOUT))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if mode := strings.ToLower(s.TLS); mode != MAIL_TLS_IMPLICIT && mode != MAIL_TLS_NONE {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if mode == MAIL_TLS_STARTTLS {
+			return permanentMailError{errors.New("mail relay does not support STARTTLS")}
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return permanentMailError{errors.New("mail relay does not support authentication")}
+		}
+		if err = c.Auth(auth); err != nil {
+			if IsMailRelayReply(err) {
+				return err
+			}
+			// the credentials were refused by the auth mechanism itself
+			return permanentMailError{err}
+		}
+	}
+	if err = c.Mail(envelopeAddress(s.Sender)); err != nil {
+		return err
+	}
+	for _, rcpt := range s.Recipients {
+		if err = c.Rcpt(envelopeAddress(rcpt)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// envelopeAddress extracts the bare address from addresses like
+// "Beetle <beetle@example.com>".
+func envelopeAddress(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return strings.TrimSpace(s)
+}
+
+// BuildMail renders the mail for a notification, with RFC 5322 headers and a
+// quoted-printable text body. If a status is given, the mail becomes a
+// multipart/alternative mail with an HTML part showing the status of the
+// affected system, or of all systems if the notification does not concern a
+// single one.
+func BuildMail(n *Notification, s *MailerSettings, status *ServerStatus, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", s.Sender)
+	header("To", strings.Join(s.Recipients, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", n.Subject()))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", newMessageId(s.Sender, now))
+	header("MIME-Version", "1.0")
+	header("X-Beetle-Notification-Type", n.Type)
+	header("X-Beetle-Severity", n.Severity)
+	if n.System != "" {
+		header("X-Beetle-System", n.System)
+	}
+	text := n.Text + "\n\nSENT: " + now.Format(time.RFC3339) + "\n"
+	if status == nil {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	html, err := renderMailHTML(n, status, now)
+	if err != nil {
+		return nil, err
+	}
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{{"text/plain", text}, {"text/html", html}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// newMessageId creates a unique message id in the domain of the sender, or of
+// the local host if the sender has no domain.
+func newMessageId(sender string, now time.Time) string {
+	domain := ""
+	sender = envelopeAddress(sender)
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		domain = sender[i+1:]
+	}
+	if domain == "" {
+		domain, _ = os.Hostname()
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", now.UnixNano(), hex.EncodeToString(b), domain)
+}
+
+var mailHTMLTemplate = template.Must(template.New("mail").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Subject}}</title></head>
+<body style="font-family: sans-serif">
+<h2>{{.Subject}}</h2>
+<pre>{{.Notification.Text}}</pre>
+{{range .Systems}}
+<h3>System {{.SystemName}}</h3>
+<table cellpadding="4" style="border-collapse: collapse" border="1">
+<tr><td>Redis master</td><td>{{.RedisMaster}}</td></tr>
+<tr><td>Master available</td><td>{{.RedisMasterAvailable}}</td></tr>
+<tr><td>Available slaves</td><td>{{range $i, $s := .RedisSlavesAvailable}}{{if $i}}, {{end}}{{$s}}{{end}}</td></tr>
+<tr><td>Configured servers</td><td>{{range $i, $s := .ConfiguredRedisServers}}{{if $i}}, {{end}}{{$s}}{{end}}</td></tr>
+<tr><td>Switch in progress</td><td>{{.SwitchInProgress}}</td></tr>
+<tr><td>Split brain</td><td>{{.SplitBrain}}</td></tr>
+<tr><td>Client ids</td><td>{{range $i, $s := .ClientIds}}{{if $i}}, {{end}}{{$s}}{{end}}</td></tr>
+<tr><td>Confidence level</td><td>{{.ConfidenceLevel}}%</td></tr>
+</table>
+{{else}}
+<p>No status available.</p>
+{{end}}
+<p style="color: gray">Beetle {{.BeetleVersion}}, sent {{.Sent}}</p>
+</body>
+</html>
+`))
+
+func renderMailHTML(n *Notification, status *ServerStatus, now time.Time) (string, error) {
+	systems := status.Systems
+	if n.System != "" {
+		systems = nil
+		if fs := status.GetFailoverStatus(n.System); fs != nil {
+			systems = []FailoverStatus{*fs}
+		}
+	}
+	var buf bytes.Buffer
+	err := mailHTMLTemplate.Execute(&buf, map[string]interface{}{
+		"Subject":       n.Subject(),
+		"Notification":  n,
+		"Systems":       systems,
+		"BeetleVersion": status.BeetleVersion,
+		"Sent":          now.Format(time.RFC3339),
+	})
+	return buf.String(), err
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server supporting STARTTLS, implicit TLS and the
+// PLAIN, LOGIN and CRAM-MD5 authentication mechanisms. It records all mails
+// received.
+type fakeSMTP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	starttls  bool
+	username  string
+	password  string
+	mutex     sync.Mutex
+	mails     []fakeMail
+}
+
+type fakeMail struct {
+	from      string
+	to        []string
+	data      string
+	tls       bool
+	mechanism string
+}
+
+// newFakeSMTP starts the server. Returns the server and the path of a CA file
+// for verifying its certificate.
+func newFakeSMTP(t *testing.T, implicitTLS bool, starttls bool, username, password string) (*fakeSMTP, string) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{
+		tlsConfig: &tls.Config{Certificates: ts.TLS.Certificates},
+		starttls:  starttls,
+		username:  username,
+		password:  password,
+	}
+	var err error
+	if implicitTLS {
+		f.listener, err = tls.Listen("tcp", "127.0.0.1:0", f.tlsConfig)
+	} else {
+		f.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, implicitTLS)
+		}
+	}()
+	return f, caFile
+}
+
+func (f *fakeSMTP) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeSMTP) received() []fakeMail {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]fakeMail{}, f.mails...)
+}
+
+func (f *fakeSMTP) serve(conn net.Conn, secure bool) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			tp.PrintfLine("%s", l)
+		}
+	}
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	current := fakeMail{}
+	reply("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			lines := []string{"250-fake"}
+			if f.starttls && !secure {
+				lines = append(lines, "250-STARTTLS")
+			}
+			if f.username != "" {
+				lines = append(lines, "250-AUTH PLAIN LOGIN CRAM-MD5")
+			}
+			reply(append(lines, "250 8BITMIME")...)
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			args := strings.Fields(line)
+			mechanism := strings.ToUpper(args[1])
+			var user, pass string
+			switch mechanism {
+			case "PLAIN":
+				parts := strings.Split(decode(args[2]), "\x00")
+				user, pass = parts[1], parts[2]
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				l, _ := tp.ReadLine()
+				user = decode(l)
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				l, _ = tp.ReadLine()
+				pass = decode(l)
+			case "CRAM-MD5":
+				challenge := "<1234@fake>"
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+				l, _ := tp.ReadLine()
+				parts := strings.Fields(decode(l))
+				mac := hmac.New(md5.New, []byte(f.password))
+				mac.Write([]byte(challenge))
+				user = parts[0]
+				if hex.EncodeToString(mac.Sum(nil)) == parts[1] {
+					pass = f.password
+				}
+			}
+			if user == f.username && pass == f.password {
+				current.mechanism = mechanism
+				reply("235 authenticated")
+			} else {
+				reply("535 authentication failed")
+			}
+		case "MAIL":
+			if f.username != "" && current.mechanism == "" {
+				reply("530 authentication required")
+				continue
+			}
+			current.from = angleAddress(line)
+			reply("250 ok")
+		case "RCPT":
+			current.to = append(current.to, angleAddress(line))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			current.data = strings.Join(lines, "\n")
+			current.tls = secure
+			f.mutex.Lock()
+			f.mails = append(f.mails, current)
+			f.mutex.Unlock()
+			current = fakeMail{mechanism: current.mechanism}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// angleAddress extracts the address from MAIL FROM and RCPT TO commands.
+func angleAddress(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func testMailerSettings(relay string) *MailerSettings {
+	return &MailerSettings{
+		DialTimeout: 5,
+		Sender:      "Beetle <beetle@example.com>",
+		Recipients:  []string{"ops@example.com", "dev@example.com"},
+		MailRelay:   relay,
+	}
+}
+
+func TestBuildMailHeaders(t *testing.T) {
+	n := &Notification{Type: EVENT_MASTER_SWITCHED, Severity: SEVERITY_CRITICAL, System: "beetle", Text: "Setting redis master to '127.0.0.1:7002' (was '127.0.0.1:7001')"}
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	b, err := BuildMail(n, testMailerSettings("localhost:25"), nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, msg.Header.Get("From"), "Beetle <beetle@example.com>")
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 {
+		t.Errorf("unexpected To header: %s (%v)", msg.Header.Get("To"), err)
+	}
+	checkEqual(t, msg.Header.Get("Subject"), "Beetle CRITICAL: master switched (beetle)")
+	date, err := msg.Header.Date()
+	if err != nil || !date.Equal(now) {
+		t.Errorf("unexpected Date header: %s (%v)", msg.Header.Get("Date"), err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("unexpected Message-ID: %s", id)
+	}
+	checkEqual(t, msg.Header.Get("X-Beetle-Severity"), SEVERITY_CRITICAL)
+	checkEqual(t, msg.Header.Get("Content-Transfer-Encoding"), "quoted-printable")
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if !strings.HasPrefix(string(body), n.Text+"\r\n\r\nSENT: 2021-03-04T05:06:07Z") {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestBuildMailEncodesNonASCIISubjects(t *testing.T) {
+	n := &Notification{Type: NOTIFICATION_UNKNOWN_CLIENT, Severity: SEVERITY_WARNING, System: "käfer", Text: "unknown"}
+	b, err := BuildMail(n, testMailerSettings("localhost:25"), nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := mail.ReadMessage(strings.NewReader(string(b)))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, subject, "Beetle WARNING: unknown client (käfer)")
+}
+
+func TestBuildMailWithHTMLStatusSnapshot(t *testing.T) {
+	n := &Notification{Type: EVENT_MASTER_UNAVAILABLE, Severity: SEVERITY_ERROR, System: "beetle", Text: "Redis master '127.0.0.1:7001' not available"}
+	status := &ServerStatus{BeetleVersion: "1.2.3", Systems: []FailoverStatus{
+		{SystemName: "beetle", RedisMaster: "127.0.0.1:7001", RedisSlavesAvailable: []string{"127.0.0.1:7002"}, ConfidenceLevel: 100},
+		{SystemName: "other", RedisMaster: "127.0.0.1:7003"},
+	}}
+	b, err := BuildMail(n, testMailerSettings("localhost:25"), status, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := mail.ReadMessage(strings.NewReader(string(b)))
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, mediaType, "multipart/alternative")
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	var html string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(p)
+		types = append(types, strings.Split(p.Header.Get("Content-Type"), ";")[0])
+		html = string(body)
+	}
+	checkEqual(t, types, []string{"text/plain", "text/html"})
+	for _, s := range []string{"System beetle", "127.0.0.1:7002", "&#39;127.0.0.1:7001&#39; not available", "100%"} {
+		if !strings.Contains(html, s) {
+			t.Errorf("expected HTML part to contain %q:\n%s", s, html)
+		}
+	}
+	if strings.Contains(html, "System other") {
+		t.Errorf("expected HTML part to only show the affected system:\n%s", html)
+	}
+}
+
+func TestDeliverMail(t *testing.T) {
+	cases := []struct {
+		name        string
+		implicitTLS bool
+		starttls    bool
+		mode        string
+		auth        string
+		mechanism   string
+		tls         bool
+	}{
+		{"plain relay", false, false, "", "", "", false},
+		{"opportunistic STARTTLS", false, true, "", "", "", true},
+		{"STARTTLS with PLAIN", false, true, MAIL_TLS_STARTTLS, MAIL_AUTH_PLAIN, "PLAIN", true},
+		{"STARTTLS with LOGIN", false, true, MAIL_TLS_STARTTLS, MAIL_AUTH_LOGIN, "LOGIN", true},
+		{"STARTTLS with CRAM-MD5", false, true, MAIL_TLS_STARTTLS, MAIL_AUTH_CRAMMD5, "CRAM-MD5", true},
+		{"implicit TLS with LOGIN", true, false, MAIL_TLS_IMPLICIT, MAIL_AUTH_LOGIN, "LOGIN", true},
+		{"no TLS", false, true, MAIL_TLS_NONE, "", "", false},
+	}
+	for _, c := range cases {
+		username := ""
+		if c.auth != "" {
+			username = "beetle"
+		}
+		f, caFile := newFakeSMTP(t, c.implicitTLS, c.starttls, username, "secret")
+		s := testMailerSettings(f.addr())
+		s.TLS, s.TLSCAFile, s.Auth, s.Username, s.Password = c.mode, caFile, c.auth, username, "secret"
+		if err := deliverMail(s, []byte("Subject: test\r\n\r\nhello\r\n")); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			f.listener.Close()
+			continue
+		}
+		mails := f.received()
+		f.listener.Close()
+		if len(mails) != 1 {
+			t.Errorf("%s: expected 1 mail, got %d", c.name, len(mails))
+			continue
+		}
+		checkEqual(t, mails[0].from, "beetle@example.com")
+		checkEqual(t, mails[0].to, []string{"ops@example.com", "dev@example.com"})
+		checkEqual(t, mails[0].mechanism, c.mechanism)
+		checkEqual(t, mails[0].tls, c.tls)
+		if !strings.Contains(mails[0].data, "hello") {
+			t.Errorf("%s: unexpected data: %q", c.name, mails[0].data)
+		}
+	}
+}
+
+func TestDeliverMailFailures(t *testing.T) {
+	f, caFile := newFakeSMTP(t, false, false, "beetle", "secret")
+	defer f.listener.Close()
+	s := testMailerSettings(f.addr())
+	s.TLSCAFile, s.Username, s.Password = caFile, "beetle", "wrong"
+	if err := deliverMail(s, []byte("hello\r\n")); err == nil {
+		t.Errorf("expected authentication to fail")
+	}
+	s.Password = "secret"
+	s.TLS = MAIL_TLS_STARTTLS
+	if err := deliverMail(s, []byte("hello\r\n")); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("expected missing STARTTLS support to fail, got %v", err)
+	}
+	s.TLS = "ssl"
+	if err := deliverMail(s, []byte("hello\r\n")); err == nil {
+		t.Errorf("expected an error for an unknown TLS mode")
+	}
+	s.TLS, s.Auth = "", "digest-md5"
+	if err := deliverMail(s, []byte("hello\r\n")); err == nil {
+		t.Errorf("expected an error for an unknown authentication mechanism")
+	}
+	checkEqual(t, len(f.received()), 0)
+}
+
+func TestSendMailUsesConfiguredRelay(t *testing.T) {
+	f, caFile := newFakeSMTP(t, false, true, "beetle", "secret")
+	defer f.listener.Close()
+	t.Setenv("BEETLE_TEST_MAIL_PASSWORD", "secret")
+	config := &Config{
+		Server:             "127.0.0.1",
+		Port:               1,
+		DialTimeout:        1,
+		MailFrom:           "beetle@example.com",
+		MailTo:             "ops@example.com",
+		MailRelay:          f.addr(),
+		MailRelayUsername:  "beetle",
+		MailRelayPassword:  "env:BEETLE_TEST_MAIL_PASSWORD",
+		MailRelayAuth:      MAIL_AUTH_CRAMMD5,
+		MailRelayTLS:       MAIL_TLS_STARTTLS,
+		MailRelayTLSCAFile: caFile,
+		MailHTML:           true,
+	}
+	if err := SendMail(NewTextNotification("test mail"), MailerOptions{Config: config}); err != nil {
+		t.Fatal(err)
+	}
+	mails := f.received()
+	checkEqual(t, len(mails), 1)
+	checkEqual(t, mails[0].mechanism, "CRAM-MD5")
+	checkEqual(t, mails[0].tls, true)
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(mails[0].data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, msg.Header.Get("Subject"), "Beetle system notification")
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/alternative") {
+		t.Errorf("expected an HTML mail, got %s", msg.Header.Get("Content-Type"))
+	}
+}
+
+func TestConfigStringMasksMailRelayPassword(t *testing.T) {
+	c := &Config{MailRelayPassword: "s3cr3t-pw"}
+	if strings.Contains(c.String(), "s3cr3t-pw") {
+		t.Errorf("expected mail relay password to be masked")
+	}
+	c.MailRelayPassword = "env:MAIL_PASSWORD"
+	if !strings.Contains(c.String(), "env:MAIL_PASSWORD") {
+		t.Errorf("expected secret reference to be shown")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RogueMasters returns all servers of the failover set which claim to be
+// master according to the cached redis information, except the current master.
+func (s *FailoverState) RogueMasters() RedisShims {
+	rogues := make(RedisShims, 0)
+	if s.currentMaster == nil {
+		return rogues
+	}
+	for _, r := range s.redis.Masters() {
+		if r.server != s.currentMaster.server {
+			rogues = append(rogues, r)
+		}
+	}
+	return rogues
+}
+
+// SplitBrained checks whether rogue masters have been detected which have not
+// been demoted yet.
+func (s *FailoverState) SplitBrained() bool {
+	return len(s.rogueMasters) > 0
+}
+
+// CheckSplitBrain looks for servers claiming to be master besides the current
+// master, for example an old master which has come back after a switch. Rogue
+// masters are demoted to slaves of the current master, unless fencing requires
+// operator confirmation. Operators are only notified when the set of rogue
+// masters changes; failed automatic demotions are retried quietly on every
+// check.
+func (s *FailoverState) CheckSplitBrain() {
+	rogues := s.RogueMasters().Servers()
+	if len(rogues) == 0 {
+		if s.SplitBrained() {
+			logInfo("Split brain of system '%s' has been resolved", s.system)
+		}
+		s.rogueMasters = nil
+		return
+	}
+	changed := strings.Join(rogues, ",") != strings.Join(s.rogueMasters, ",")
+	s.rogueMasters = StringList(rogues)
+	if changed {
+		msg := fmt.Sprintf("Split brain detected for system '%s': redis servers %s claim to be master, but current master is '%s'",
+			s.system, strings.Join(rogues, ", "), s.currentMaster.server)
+		if s.GetConfig().ConfirmFencing {
+			msg += ". Waiting for operator confirmation to demote them."
+		}
+		logError(msg)
+		s.SendNotification(&Notification{Type: EVENT_SPLIT_BRAIN_DETECTED, Severity: SEVERITY_CRITICAL, Text: msg})
+		s.RecordEvent(HistoryEvent{Event: EVENT_SPLIT_BRAIN_DETECTED, Details: msg})
+	}
+	if !s.GetConfig().ConfirmFencing {
+		s.FenceRogueMasters("automatic fencing")
+	}
+}
+
+// FenceRogueMasters demotes all detected rogue masters to slaves of the current
+// master. Returns the list of demoted servers and an error if some of them
+// could not be demoted, which remain flagged as rogue masters. Note that the
+// SLAVEOF commands are sent from the dispatcher, so a rogue master which does
+// not answer delays it by up to the redis connection timeouts.
+func (s *FailoverState) FenceRogueMasters(requester string) ([]string, error) {
+	fenced := make([]string, 0)
+	failed := make(StringList, 0)
+	for _, server := range s.rogueMasters {
+		var rogue *RedisShim
+		for _, r := range s.redis.instances {
+			if r.server == server {
+				rogue = r
+			}
+		}
+		if rogue == nil {
+			continue
+		}
+		if err := rogue.RedisMakeSlave(s.currentMaster.host, s.currentMaster.port); err != nil {
+			failed = append(failed, server)
+			continue
+		}
+		msg := fmt.Sprintf("Demoted rogue redis master '%s' to slave of '%s'", server, s.currentMaster.server)
+		logWarn(msg)
+		s.SendNotification(&Notification{Type: EVENT_ROGUE_MASTER_FENCED, Severity: SEVERITY_WARNING, OldMaster: server, NewMaster: s.currentMaster.server, Text: msg})
+		s.RecordEvent(HistoryEvent{Event: EVENT_ROGUE_MASTER_FENCED, NewMaster: s.currentMaster.server, Requester: requester, Details: msg})
+		fenced = append(fenced, server)
+	}
+	s.rogueMasters = failed
+	if len(failed) > 0 {
+		return fenced, fmt.Errorf("could not demote rogue masters: %s", strings.Join(failed, ", "))
+	}
+	return fenced, nil
+}
+
+// FencingResult is returned by the admin API when fencing has been requested.
+type FencingResult struct {
+	System  string   `json:"system"`
+	Master  string   `json:"master,omitempty"`
+	Fenced  []string `json:"fenced"`
+	Message string   `json:"message,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// RequestFencing demotes the rogue masters of the given system on the
+// dispatcher thread, after an operator has confirmed it. Returns the result
+// and the HTTP status code to use for the response.
+func (s *ServerState) RequestFencing(system string, requester string) (*FencingResult, int) {
+	res := &FencingResult{System: system, Fenced: []string{}}
+	fs := s.failovers[system]
+	if fs == nil {
+		res.Error = fmt.Sprintf("Fencing not possible for unknown system: '%s'", system)
+		return res, http.StatusNotFound
+	}
+	var err error
+	s.Evaluate(func() {
+		if fs.currentMaster != nil {
+			res.Master = fs.currentMaster.server
+		}
+		res.Fenced, err = fs.FenceRogueMasters(requester)
+	})
+	if err != nil {
+		res.Error = err.Error()
+		return res, http.StatusInternalServerError
+	}
+	if len(res.Fenced) == 0 {
+		res.Message = "No rogue masters to demote"
+		return res, http.StatusOK
+	}
+	res.Message = fmt.Sprintf("Demoted rogue masters: %s", strings.Join(res.Fenced, ", "))
+	return res, http.StatusOK
+}
+
+func (s *ServerState) fenceRogueMasters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderErrorTemplate(w, 405, "Rogue masters must be demoted using POST")
+		return
+	}
+	if !s.AuthorizeAdminRequest(r) {
+		renderErrorTemplate(w, 401, "Invalid admin token")
+		return
+	}
+	system := r.FormValue("system_name")
+	if system == "" {
+		renderErrorTemplate(w, 400, "Missing parameter: system_name")
+		return
+	}
+	res, code := s.RequestFencing(system, "status page: "+r.RemoteAddr)
+	if res.Error != "" {
+		renderErrorTemplate(w, code, res.Error)
+	} else {
+		renderErrorTemplate(w, code, res.Message)
+	}
+}
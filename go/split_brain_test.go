@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newSplitBrainTestServer creates a server with a failover set whose servers
+// both claim to be master. Nothing listens on the configured ports, so
+// demoting the rogue master fails.
+func newSplitBrainTestServer(t *testing.T, confirm bool) (*ServerState, *FailoverState) {
+	config := Config{
+		ClientTimeout:  1,
+		RedisServers:   "beetle/127.0.0.1:1,127.0.0.1:2",
+		ConfirmFencing: confirm,
+	}
+	s := NewServerState(ServerOptions{Config: &config})
+	fs := s.failovers["beetle"]
+	fs.redis.serverInfo[MASTER] = RedisShims{fs.redis.instances[0], fs.redis.instances[1]}
+	fs.currentMaster = fs.redis.instances[0]
+	return s, fs
+}
+
+func TestCheckSplitBrainWaitsForConfirmation(t *testing.T) {
+	s, fs := newSplitBrainTestServer(t, true)
+	checkEqual(t, fs.RogueMasters().Servers(), []string{"127.0.0.1:2"})
+	fs.CheckSplitBrain()
+	checkEqual(t, fs.SplitBrained(), true)
+	checkEqual(t, []string(fs.rogueMasters), []string{"127.0.0.1:2"})
+
+	status := s.GetStatus()
+	checkEqual(t, status.Systems[0].SplitBrain, true)
+	checkEqual(t, status.Systems[0].RogueMasters, []string{"127.0.0.1:2"})
+	events := s.history.Recent("beetle", 10)
+	checkEqual(t, len(events), 1)
+	checkEqual(t, events[0].Event, EVENT_SPLIT_BRAIN_DETECTED)
+
+	// no further notification while waiting for the operator
+	fs.CheckSplitBrain()
+	checkEqual(t, len(s.history.Recent("beetle", 10)), 1)
+
+	// the split brain is over once the rogue master has been demoted
+	fs.redis.serverInfo[MASTER] = RedisShims{fs.currentMaster}
+	fs.CheckSplitBrain()
+	checkEqual(t, fs.SplitBrained(), false)
+	checkEqual(t, s.GetStatus().Systems[0].SplitBrain, false)
+}
+
+func TestCheckSplitBrainFencesAutomatically(t *testing.T) {
+	s, fs := newSplitBrainTestServer(t, false)
+	fs.CheckSplitBrain()
+	// fencing failed, as the rogue master is not reachable
+	checkEqual(t, []string(fs.rogueMasters), []string{"127.0.0.1:2"})
+	events := s.history.Recent("beetle", 10)
+	checkEqual(t, len(events), 1)
+	checkEqual(t, events[0].Event, EVENT_SPLIT_BRAIN_DETECTED)
+
+	// failed demotions are retried without further notifications
+	fs.CheckSplitBrain()
+	checkEqual(t, []string(fs.rogueMasters), []string{"127.0.0.1:2"})
+	checkEqual(t, len(s.history.Recent("beetle", 10)), 1)
+}
+
+func TestFenceRogueMastersWithoutRogues(t *testing.T) {
+	_, fs := newSplitBrainTestServer(t, true)
+	fenced, err := fs.FenceRogueMasters("test")
+	checkEqual(t, err, nil)
+	checkEqual(t, len(fenced), 0)
+}
+
+func TestAdminAPIFencing(t *testing.T) {
+	s := newAdminTestServer("sesame")
+	w := httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("POST", "/api/systems/beetle/fence", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/api/systems/unknown/fence", nil)
+	r.Header.Set("Authorization", "Bearer sesame")
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for unknown system, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.dispatchRequest(w, httptest.NewRequest("GET", "/fence_rogue_masters?system_name=beetle", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for HTML fencing, got %d", w.Code)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xing/beetle/consul"
+)
+
+// PersistentState holds the parts of the server state which must survive a
+// restart or relocation of the configuration server.
+type PersistentState struct {
+	ClientsLastSeen map[string]time.Time `json:"clients_last_seen"`
+	Tokens          map[string]int       `json:"tokens"`
+	Masters         map[string]string    `json:"masters"`
+	ApprovedClients map[string][]string  `json:"approved_clients,omitempty"` // Client ids approved by operators, per system.
+	RetiredClients  []string             `json:"retired_clients,omitempty"`  // Client ids retired by operators.
+	Registrations   map[string]time.Time `json:"registrations,omitempty"`    // When clients were last approved or retired.
+}
+
+// NewPersistentState creates an empty state.
+func NewPersistentState() *PersistentState {
+	return &PersistentState{
+		ClientsLastSeen: make(map[string]time.Time),
+		Tokens:          make(map[string]int),
+		Masters:         make(map[string]string),
+		ApprovedClients: make(map[string][]string),
+		Registrations:   make(map[string]time.Time),
+	}
+}
+
+// Merge adds the information from another state, keeping the most recent last
+// seen times and the highest tokens. Masters are not merged, as a state only
+// knows the master of a system reliably if it was read from the system's own
+// servers. For client approvals and retirements, the most recent registration
+// of each client wins.
+func (ps *PersistentState) Merge(other *PersistentState) {
+	for id, t := range other.ClientsLastSeen {
+		if t.After(ps.ClientsLastSeen[id]) {
+			ps.ClientsLastSeen[id] = t
+		}
+	}
+	for system, token := range other.Tokens {
+		if token > ps.Tokens[system] {
+			ps.Tokens[system] = token
+		}
+	}
+	ps.mergeClientRegistrations(other)
+}
+
+// mergeClientRegistrations takes over the approvals and retirements of clients
+// which have been registered more recently in the other state. Registrations
+// of states saved by earlier versions have no time and are combined.
+func (ps *PersistentState) mergeClientRegistrations(other *PersistentState) {
+	if ps.ApprovedClients == nil {
+		ps.ApprovedClients = make(map[string][]string)
+	}
+	if ps.Registrations == nil {
+		ps.Registrations = make(map[string]time.Time)
+	}
+	ids := make(StringSet)
+	for _, approved := range other.ApprovedClients {
+		for _, id := range approved {
+			ids.Add(id)
+		}
+	}
+	for _, id := range other.RetiredClients {
+		ids.Add(id)
+	}
+	for id := range other.Registrations {
+		ids.Add(id)
+	}
+	for id := range ids {
+		mine, theirs := ps.Registrations[id], other.Registrations[id]
+		if mine.After(theirs) {
+			continue
+		}
+		if theirs.After(mine) {
+			ps.removeClientRegistration(id)
+			ps.Registrations[id] = theirs
+		}
+		for system, approved := range other.ApprovedClients {
+			if containsString(approved, id) {
+				ps.ApprovedClients[system] = unionStrings(ps.ApprovedClients[system], []string{id})
+			}
+		}
+		if containsString(other.RetiredClients, id) {
+			ps.RetiredClients = unionStrings(ps.RetiredClients, []string{id})
+		}
+	}
+}
+
+// removeClientRegistration removes all approvals and the retirement of the
+// given client.
+func (ps *PersistentState) removeClientRegistration(id string) {
+	for system, approved := range ps.ApprovedClients {
+		if remaining := withoutString(approved, id); len(remaining) > 0 {
+			ps.ApprovedClients[system] = remaining
+		} else {
+			delete(ps.ApprovedClients, system)
+		}
+	}
+	ps.RetiredClients = withoutString(ps.RetiredClients, id)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutString returns a copy of the list without the given string.
+func withoutString(list []string, s string) []string {
+	res := make([]string, 0, len(list))
+	for _, x := range list {
+		if x != s {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// unionStrings returns the sorted union of two string lists.
+func unionStrings(a []string, b []string) []string {
+	set := make(StringSet)
+	for _, x := range a {
+		set.Add(x)
+	}
+	for _, x := range b {
+		set.Add(x)
+	}
+	return set.Keys()
+}
+
+// StateStore persists server state.
+type StateStore interface {
+	// Save persists the given state.
+	Save(state *PersistentState) error
+	// Load retrieves the last saved state. Stores keeping the state on redis
+	// read it from the given servers of each system, in order of preference.
+	Load(sources map[string]RedisShims) (*PersistentState, error)
+}
+
+// NewStateStore creates the state store selected in the configuration. When no
+// store has been configured, redis is used, as earlier versions kept the client
+// last seen info there.
+func NewStateStore(s *ServerState) StateStore {
+	kind := s.GetConfig().StateStore
+	if kind == "" {
+		kind = "redis"
+	}
+	switch kind {
+	case "consul":
+		if s.opts.ConsulClient != nil {
+			return &ConsulStateStore{client: s.opts.ConsulClient}
+		}
+		logError("consul state store configured, but no consul url given: using redis")
+	case "redis":
+	default:
+		logError("unknown state store '%s': using redis", kind)
+	}
+	return &RedisStateStore{}
+}
+
+const (
+	// RedisStateKey is the name of the redis key holding the JSON encoded
+	// server state.
+	RedisStateKey = "beetle:server-state"
+	// RedisLastSeenKey holds the client last seen info in the format used by
+	// earlier versions, which only stored the last seen info.
+	RedisLastSeenKey = "beetle:clients-last-seen"
+)
+
+// RedisStateStore saves the state on the current redis master of every
+// system. On load, the state is read from the master of every system or, if
+// the master has not been determined yet, from any reachable server of the
+// system.
+type RedisStateStore struct {
+	mutex   sync.Mutex            // Mutex for accessing clients.
+	clients map[string]*RedisShim // Connections to the masters the state was last saved on.
+}
+
+// Save writes the state to the masters recorded in the state. It does not
+// access the server state and can therefore be called off the dispatcher.
+func (rs *RedisStateStore) Save(state *PersistentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	masters := make(map[string]*RedisShim)
+	for _, master := range state.Masters {
+		if r := rs.clients[master]; r != nil {
+			masters[master] = r
+		} else if masters[master] == nil {
+			masters[master] = NewRedisShim(master)
+		}
+	}
+	for server, r := range rs.clients {
+		if masters[server] == nil {
+			r.redis.Close()
+		}
+	}
+	rs.clients = masters
+	saved := 0
+	for server, r := range masters {
+		if err = r.redis.Set(RedisStateKey, string(data), 0).Err(); err != nil {
+			logError("could not save state to '%s': %s", server, err)
+			continue
+		}
+		saved++
+	}
+	if saved == 0 {
+		return fmt.Errorf("no redis master available")
+	}
+	return nil
+}
+
+// Load reads the state of every system from the first of its servers holding
+// one and merges them. It does not access the server state and can therefore
+// be called off the dispatcher.
+func (rs *RedisStateStore) Load(sources map[string]RedisShims) (*PersistentState, error) {
+	state := NewPersistentState()
+	loaded := 0
+	systems := make([]string, 0, len(sources))
+	for system := range sources {
+		systems = append(systems, system)
+	}
+	sort.Strings(systems)
+	for _, system := range systems {
+		for _, r := range sources[system] {
+			s, err := loadStateFromRedis(r)
+			if err != nil {
+				logError("could not load state from '%s': %s", r.server, err)
+				continue
+			}
+			// the master info of a system is only trusted if it was read
+			// from one of the system's own servers
+			if master := s.Masters[system]; master != "" {
+				state.Masters[system] = master
+			}
+			state.Merge(s)
+			loaded++
+			break
+		}
+	}
+	if loaded == 0 && len(systems) > 0 {
+		return nil, fmt.Errorf("no redis server available")
+	}
+	return state, nil
+}
+
+func loadStateFromRedis(r *RedisShim) (*PersistentState, error) {
+	state := NewPersistentState()
+	v, err := r.redis.Get(RedisStateKey).Result()
+	if err == nil {
+		err = json.Unmarshal([]byte(v), state)
+		return state, err
+	}
+	// fall back to the format of earlier versions
+	v, err = r.redis.Get(RedisLastSeenKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range strings.Split(v, ",") {
+		if x == "" {
+			continue
+		}
+		parts := strings.Split(x, ":")
+		id, t := parts[0], parts[len(parts)-1]
+		i, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			logError("could not recreate timestamp for id '%s': %s", id, t)
+			continue
+		}
+		state.ClientsLastSeen[id] = time.Unix(0, i)
+	}
+	return state, nil
+}
+
+// ConsulStateKey is the name of the consul state key holding the JSON encoded
+// server state.
+const ConsulStateKey = "server_state"
+
+// ConsulStateStore saves the state in the consul state space of the
+// application.
+type ConsulStateStore struct {
+	client *consul.Client
+}
+
+// Save writes the state to consul.
+func (cs *ConsulStateStore) Save(state *PersistentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return cs.client.UpdateState(ConsulStateKey, string(data))
+}
+
+// Load reads the state from consul. If no state has been saved yet, the
+// masters are taken from the master file content stored in consul. The
+// sources are not used.
+func (cs *ConsulStateStore) Load(sources map[string]RedisShims) (*PersistentState, error) {
+	kv, err := cs.client.GetState()
+	if err != nil {
+		return nil, err
+	}
+	state := NewPersistentState()
+	if v := kv[ConsulStateKey]; v != "" {
+		if err := json.Unmarshal([]byte(v), state); err != nil {
+			return nil, err
+		}
+	}
+	if len(state.Masters) == 0 {
+		for system, master := range UnmarshalMasterFileContent(kv["redis_master_file_content"]) {
+			state.Masters[system] = master
+		}
+	}
+	return state, nil
+}
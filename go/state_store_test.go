@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xing/beetle/consul"
+)
+
+// fakeConsulKV implements the parts of the consul KV API used by the state
+// store.
+func fakeConsulKV(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	kv := make(map[string]string)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case http.MethodPut:
+			b, _ := io.ReadAll(r.Body)
+			kv[key] = string(b)
+			w.Write([]byte("true"))
+		case http.MethodGet:
+			entries := make([]consul.Entry, 0)
+			for k, v := range kv {
+				if strings.HasPrefix(k, key) {
+					entries = append(entries, consul.Entry{Key: k, Value: base64.StdEncoding.EncodeToString([]byte(v))})
+				}
+			}
+			json.NewEncoder(w).Encode(entries)
+		}
+	}))
+}
+
+func TestConsulStateStoreRoundTrip(t *testing.T) {
+	srv := fakeConsulKV(t)
+	defer srv.Close()
+	store := &ConsulStateStore{client: consul.NewClient(srv.URL, "", "beetle")}
+
+	state := NewPersistentState()
+	state.ClientsLastSeen["x"] = time.Unix(1000, 0)
+	state.Tokens["beetle"] = 42
+	state.Masters["beetle"] = "127.0.0.1:7002"
+	if err := store.Save(state); err != nil {
+		t.Fatalf("saving state failed: %s", err)
+	}
+	loaded, err := store.Load(nil)
+	if err != nil {
+		t.Fatalf("loading state failed: %s", err)
+	}
+	checkEqual(t, loaded.Tokens, state.Tokens)
+	checkEqual(t, loaded.Masters, state.Masters)
+	if !loaded.ClientsLastSeen["x"].Equal(state.ClientsLastSeen["x"]) {
+		t.Errorf("last seen info was not restored: %v", loaded.ClientsLastSeen)
+	}
+}
+
+func TestConsulStateStoreFallsBackToMasterFileContent(t *testing.T) {
+	srv := fakeConsulKV(t)
+	defer srv.Close()
+	client := consul.NewClient(srv.URL, "", "beetle")
+	if err := client.UpdateState("redis_master_file_content", "beetle/127.0.0.1:7001"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := (&ConsulStateStore{client: client}).Load(nil)
+	if err != nil {
+		t.Fatalf("loading state failed: %s", err)
+	}
+	checkEqual(t, loaded.Masters, map[string]string{"beetle": "127.0.0.1:7001"})
+}
+
+func TestPersistentStateMerge(t *testing.T) {
+	a := NewPersistentState()
+	a.ClientsLastSeen["x"] = time.Unix(2000, 0)
+	a.Tokens["beetle"] = 5
+	a.Masters["beetle"] = "127.0.0.1:7001"
+	b := NewPersistentState()
+	b.ClientsLastSeen["x"] = time.Unix(1000, 0)
+	b.ClientsLastSeen["y"] = time.Unix(1000, 0)
+	b.Tokens["beetle"] = 7
+	b.Masters["beetle"] = "127.0.0.1:7002"
+	b.Masters["other"] = "127.0.0.1:7003"
+	a.Merge(b)
+	checkEqual(t, a.ClientsLastSeen["x"], time.Unix(2000, 0))
+	checkEqual(t, a.ClientsLastSeen["y"], time.Unix(1000, 0))
+	checkEqual(t, a.Tokens["beetle"], 7)
+	checkEqual(t, a.Masters, map[string]string{"beetle": "127.0.0.1:7001"})
+}
+
+// blockingStateStore blocks saving until released.
+type blockingStateStore struct {
+	release chan struct{}
+	saved   chan *PersistentState
+}
+
+func (bs *blockingStateStore) Save(state *PersistentState) error {
+	<-bs.release
+	bs.saved <- state
+	return nil
+}
+
+func (bs *blockingStateStore) Load(sources map[string]RedisShims) (*PersistentState, error) {
+	return NewPersistentState(), nil
+}
+
+func TestSaveStateDoesNotBlockOnTheStateStore(t *testing.T) {
+	s := NewServerState(serverTestOptions)
+	store := &blockingStateStore{release: make(chan struct{}), saved: make(chan *PersistentState, 10)}
+	s.stateStore = store
+	s.StartStateWriter()
+	fs := s.failovers[s.systemNames[0]]
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			fs.GenerateNewToken()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("saving the state blocked the caller")
+	}
+	close(store.release)
+	// the writer saves the snapshot it was blocked on and the most recent one
+	var state *PersistentState
+	for state == nil || state.Tokens[s.systemNames[0]] != fs.currentTokenInt {
+		select {
+		case state = <-store.saved:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("most recent state was not saved, last saved: %+v", state)
+		}
+	}
+}
+
+func TestPersistentStateMergeKeepsMostRecentClientRegistrations(t *testing.T) {
+	// x was retired and approved again later, y was approved and retired later
+	a := NewPersistentState()
+	a.ApprovedClients["beetle"] = []string{"x"}
+	a.RetiredClients = []string{"y"}
+	a.Registrations["x"] = time.Unix(2000, 0)
+	a.Registrations["y"] = time.Unix(2000, 0)
+	b := NewPersistentState()
+	b.ApprovedClients[ALL_SYSTEMS] = []string{"y", "z"}
+	b.RetiredClients = []string{"x"}
+	b.Registrations["x"] = time.Unix(1000, 0)
+	b.Registrations["y"] = time.Unix(1000, 0)
+	b.Registrations["z"] = time.Unix(1000, 0)
+	a.Merge(b)
+	checkEqual(t, a.ApprovedClients, map[string][]string{"beetle": {"x"}, ALL_SYSTEMS: {"z"}})
+	checkEqual(t, a.RetiredClients, []string{"y"})
+
+	b.Merge(a)
+	checkEqual(t, b.ApprovedClients, map[string][]string{"beetle": {"x"}, ALL_SYSTEMS: {"z"}})
+	checkEqual(t, b.RetiredClients, []string{"y"})
+	checkEqual(t, b.Registrations["x"], time.Unix(2000, 0))
+}
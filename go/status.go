@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Text renders the server status as stable, grep friendly key/value lines.
+// Global settings come first, followed by one block per failover set, where
+// each key is prefixed with the system name. List values are comma separated.
+func (s *ServerStatus) Text() string {
+	var b strings.Builder
+	line := func(key string, value interface{}) {
+		b.WriteString(strings.TrimRight(fmt.Sprintf("%s: %v", key, value), " ") + "\n")
+	}
+	line("beetle_version", s.BeetleVersion)
+	line("configured_client_ids", strings.Join(s.ConfiguredClientIds, ","))
+	line("unknown_client_ids", strings.Join(s.UnknownClientIds, ","))
+	line("unseen_client_ids", strings.Join(s.UnseenClientIds, ","))
+	line("approved_client_ids", strings.Join(s.ApprovedClientIds, ","))
+	line("retired_client_ids", strings.Join(s.RetiredClientIds, ","))
+	line("unresponsive_clients", strings.Join(s.UnresponsiveClients, ","))
+	line("notification_channels", s.NotificationChannels)
+	line("admin_token_required", s.AdminTokenRequired)
+	line("leader", s.Leader)
+	line("leader_address", s.LeaderAddress)
+	for _, fs := range s.Systems {
+		prefix := "system." + fs.SystemName + "."
+		line(prefix+"redis_master", fs.RedisMaster)
+		line(prefix+"redis_master_available", fs.RedisMasterAvailable)
+		line(prefix+"redis_slaves_available", strings.Join(fs.RedisSlavesAvailable, ","))
+		line(prefix+"configured_redis_servers", strings.Join(fs.ConfiguredRedisServers, ","))
+		line(prefix+"switch_in_progress", fs.SwitchInProgress)
+		line(prefix+"planned_switch_target", fs.PlannedSwitchTarget)
+		line(prefix+"split_brain", fs.SplitBrain)
+		line(prefix+"rogue_masters", strings.Join(fs.RogueMasters, ","))
+		line(prefix+"client_ids", strings.Join(fs.ClientIds, ","))
+		line(prefix+"confidence_level", fs.ConfidenceLevel)
+		line(prefix+"votes_received", strings.Join(fs.VotesReceived, ","))
+		lastGC := "unknown"
+		if fs.GCInfo != nil {
+			lastGC = time.Unix(fs.GCInfo.Timestamp, 0).UTC().Format(time.RFC3339)
+		}
+		line(prefix+"last_gc", lastGC)
+	}
+	return b.String()
+}
+
+// fetchServerStatus retrieves the given status page from a running
+// configuration server.
+func fetchServerStatus(config *Config, path string) ([]byte, error) {
+	tlsConfig, err := config.ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: config.HTTPScheme(), Host: config.ServerUrl(), Path: path}
+	client := &http.Client{
+		Timeout:   time.Duration(config.DialTimeout) * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve server status: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read server status: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not retrieve server status: %s", resp.Status)
+	}
+	return body, nil
+}
+
+// PrintServerStatus fetches the plain text status from a running configuration
+// server and prints it on stdout.
+func PrintServerStatus(config *Config) error {
+	body, err := fetchServerStatus(config, "/.txt")
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(body))
+	return nil
+}
+
+// FetchServerStatus retrieves the JSON status from a running configuration
+// server.
+func FetchServerStatus(config *Config) (*ServerStatus, error) {
+	body, err := fetchServerStatus(config, "/.json")
+	if err != nil {
+		return nil, err
+	}
+	status := &ServerStatus{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, fmt.Errorf("could not parse server status: %s", err)
+	}
+	return status, nil
+}
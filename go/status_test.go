@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestServerStatusText(t *testing.T) {
+	status := &ServerStatus{
+		BeetleVersion:        "1.2.3",
+		ConfiguredClientIds:  []string{"c1", "c2"},
+		UnknownClientIds:     []string{},
+		UnresponsiveClients:  []string{"c2: last seen 12s ago"},
+		UnseenClientIds:      []string{"c1"},
+		ApprovedClientIds:    []string{"c3"},
+		RetiredClientIds:     []string{"c4"},
+		NotificationChannels: 1,
+		AdminTokenRequired:   true,
+		Leader:               true,
+		Systems: []FailoverStatus{
+			{
+				SystemName:             "primary",
+				ConfiguredRedisServers: []string{"r1:6379", "r2:6379"},
+				RedisMaster:            "r1:6379",
+				RedisMasterAvailable:   true,
+				RedisSlavesAvailable:   []string{"r2:6379"},
+				PlannedSwitchTarget:    "r2:6379",
+				ClientIds:              []string{"c1", "c2"},
+				ConfidenceLevel:        100,
+				VotesReceived:          []string{"c1"},
+				GCInfo:                 &GCInfo{Timestamp: 1600000000},
+			},
+		},
+	}
+	expected := `beetle_version: 1.2.3
+configured_client_ids: c1,c2
+unknown_client_ids:
+unseen_client_ids: c1
+approved_client_ids: c3
+retired_client_ids: c4
+unresponsive_clients: c2: last seen 12s ago
+notification_channels: 1
+admin_token_required: true
+leader: true
+leader_address:
+system.primary.redis_master: r1:6379
+system.primary.redis_master_available: true
+system.primary.redis_slaves_available: r2:6379
+system.primary.configured_redis_servers: r1:6379,r2:6379
+system.primary.switch_in_progress: false
+system.primary.planned_switch_target: r2:6379
+system.primary.split_brain: false
+system.primary.rogue_masters:
+system.primary.client_ids: c1,c2
+system.primary.confidence_level: 100
+system.primary.votes_received: c1
+system.primary.last_gc: 2020-09-13T12:26:40Z
+`
+	checkEqual(t, status.Text(), expected)
+}
@@ -181,6 +181,7 @@ module Beetle
     # extract redis master from file content and return the server for our system
     def extract_redis_master(text)
       system_name = @config.system_name
+      return extract_redis_master_from_structured_content(text, system_name) if structured_master_file_content?(text)
       redis_master = ""
       text.each_line do |line|
         parts = line.split('/', 2)
@@ -195,6 +196,23 @@ module Beetle
       redis_master
     end
 
+    # master files written by the go configuration client can be in JSON or YAML format
+    def structured_master_file_content?(text)
+      text = text.lstrip
+      text.start_with?("{", "---", "systems:")
+    end
+
+    # extract the master of the given system from JSON or YAML master file content,
+    # systems without master (state invalidated) yield a blank string
+    def extract_redis_master_from_structured_content(text, system_name)
+      data = text.lstrip.start_with?("{") ? JSON.parse(text) : YAML.safe_load(text, permitted_classes: [Time, Date])
+      entry = ((data || {})["systems"] || {})[system_name] || {}
+      entry["master"].to_s
+    rescue JSON::ParserError, Psych::Exception => e
+      logger.error "Beetle: could not parse redis master file: #{e}"
+      ""
+    end
+
     # server:port string from the redis master file
     def read_master_file
       File.read(@config.redis_server).chomp
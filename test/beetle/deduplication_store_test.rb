@@ -84,6 +84,38 @@ module Beetle
       assert_equal "localhost:2", @store.redis.server
     end
 
+    test "should retrieve the redis master for the configured system name from a JSON master file" do
+      redis_test_master_file(<<~JSON)
+        {
+          "systems": {
+            "blabber": {"master": "localhost:2", "token": "3", "changed_at": "2024-01-01T00:00:00Z", "state": "active"},
+            "blubber": {"master": "localhost:1", "token": "5", "changed_at": "2024-01-01T00:00:00Z", "state": "active"}
+          }
+        }
+      JSON
+      Beetle.config.system_name = "blubber"
+      assert_equal "localhost:1", @store.redis.server
+    end
+
+    test "should retrieve the redis master for the configured system name from a YAML master file" do
+      redis_test_master_file(<<~YAML)
+        systems:
+          blubber:
+            master: localhost:1
+            token: "5"
+            changed_at: 2024-01-01T00:00:00Z
+            state: active
+      YAML
+      Beetle.config.system_name = "blubber"
+      assert_equal "localhost:1", @store.redis.server
+    end
+
+    test "redis should be nil if the system has been invalidated in a structured master file" do
+      redis_test_master_file('{"systems": {"blubber": {"master": "", "state": "invalidated"}}}')
+      Beetle.config.system_name = "blubber"
+      assert_nil @store.redis
+    end
+
     private
     def redis_test_master_file(server_string)
       tmp_dir = File.expand_path("../../../tmp", __FILE__)